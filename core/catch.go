@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// LispError is raised by (error "message" irritants...)
+type LispError struct {
+	Message   string
+	Irritants []Value
+}
+
+func (e *LispError) Error() string {
+	parts := []string{e.Message}
+	for _, irritant := range e.Irritants {
+		parts = append(parts, irritant.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// caughtValue is the value a guard binds for what an expression panicked
+// with, the first irritant of an error call and 0 for errors raised by
+// builtins. Limits, cancellation and bugs in the interpreter can't be caught.
+func caughtValue(r any) (Value, bool) {
+	if runtimeErr, ok := r.(*RuntimeError); ok {
+		r = runtimeErr.cause
+	}
+	switch r := r.(type) {
+	case *LimitExceeded, runtime.Error:
+		return nil, false
+	case *LispError:
+		if len(r.Irritants) > 0 {
+			return r.Irritants[0], true
+		}
+	case error:
+		if errors.Is(r, context.Canceled) {
+			return nil, false
+		}
+	}
+	return Fixnum(0), true
+}
+
+func evalSequence(body []ASTNode, scope *InterpreterScope) Value {
+	var value Value = Fixnum(0)
+	for _, expr := range body {
+		value = expr.Eval(scope)
+	}
+	return value
+}
+
+func (e *ErrorNode) Eval(scope *InterpreterScope) Value {
+	irritants := make([]Value, len(e.irritants))
+	for indx, irritant := range e.irritants {
+		irritants[indx] = irritant.Eval(scope)
+	}
+	panic(scope.runtimeError(&LispError{Message: e.message, Irritants: irritants}, e.Span))
+}
+
+func (c *CatchNode) Eval(scope *InterpreterScope) (value Value) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		caught, ok := caughtValue(r)
+		if !ok {
+			panic(r)
+		}
+		handlerScope := scope
+		if c.variable != "" {
+			handlerScope = NewInterpreterScope(scope)
+			handlerScope.inner[c.variable] = &IntegerNode{value: caught}
+		}
+		value = evalSequence(c.handler, handlerScope)
+	}()
+	return evalSequence(c.body, scope)
+}
+
+func (w *WindNode) Eval(scope *InterpreterScope) Value {
+	w.before.Eval(scope)
+	defer w.after.Eval(scope)
+	return w.body.Eval(scope)
+}
+
+// mayFail is whether the runtime can raise an error for operand
+func mayFail(operand string) bool {
+	if Includes([]string{"+", "-", "*"}, operand) {
+		return CheckOverflow
+	}
+	return Includes([]string{"/", "%", "remainder", "modulo"}, operand)
+}
+
+// checkError branches to the unwind target if the call before it raised an
+// error while a handler was active
+func checkError(asm *string) {
+	pending := generateNextSymbol()
+	failed := generateNextSymbol()
+	label := generateNextErrorLabel()[0]
+	*asm += fmt.Sprintf(`
+	%s = load i8, i8* @lisp_error_pending
+	%s = icmp ne i8 %s, 0
+	br i1 %s, label %%%s, label %%%s
+	`, pending, failed, pending, failed, unwindTarget, label)
+	unwindUsed = unwindUsed || unwindTarget == "unwind"
+	startBlock(asm, label)
+}
+
+// unwindBlock returns from a function whose error checks branched out of
+// it, the caller checks for the error in turn
+func unwindBlock(resultType string) string {
+	if !unwindUsed {
+		return ""
+	}
+	zero := map[string]string{"i64": "1", "double": "0.0", "i1": "false"}[resultType]
+	if zero == "" {
+		zero = "null"
+	}
+	return fmt.Sprintf(`unwind:
+	ret %s %s
+`, resultType, zero)
+}
+
+// codegenSequence evaluates body into symbol, an empty body is 0
+func codegenSequence(asm *string, body []ASTNode, symbol string, scope *CompilerScope) {
+	if len(body) == 0 {
+		*asm += fmt.Sprintf(`
+	%s = add i64 1,0
+	`, symbol)
+		return
+	}
+	for indx, expr := range body {
+		resultSymbol := symbol
+		if indx != len(body)-1 {
+			resultSymbol = generateNextSymbol()
+		}
+		expr.Codegen(asm, resultSymbol, scope)
+	}
+}
+
+// An error call never returns, the code after it is unreachable
+func (e *ErrorNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, e.Span)()
+	arguments := []string{"i8* " + stringConstant(e.message), fmt.Sprintf("i64 %d", len(e.irritants))}
+	for _, irritant := range e.irritants {
+		tagged := generateNextSymbol()
+		irritant.Codegen(asm, tagged, scope)
+		arguments = append(arguments, "i64 "+tagged)
+	}
+	*asm += fmt.Sprintf(`
+	call void (i8*, i64, ...) @lisp_raise(%s)
+	br label %%%s
+	`, strings.Join(arguments, ", "), unwindTarget)
+	unwindUsed = unwindUsed || unwindTarget == "unwind"
+	startBlock(asm, generateNextErrorLabel()[0])
+	*asm += fmt.Sprintf(`
+	%s = add i64 1,0
+	`, symbol)
+}
+
+// The body's failed calls branch to the handler block, which clears the
+// error and evaluates the handler
+func (c *CatchNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, c.Span)()
+	labels := generateNextErrorLabel()
+	outer := unwindTarget
+	*asm += `
+	call void @lisp_enter_handler()
+	`
+	unwindTarget = labels[1]
+	bodySymbol := generateNextSymbol()
+	codegenSequence(asm, c.body, bodySymbol, scope)
+	unwindTarget = outer
+	*asm += fmt.Sprintf(`
+	call void @lisp_leave_handler()
+	br label %%%s
+	`, labels[2])
+	bodyBlock := currentBlock
+	startBlock(asm, labels[1])
+	caught := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = call i64 @lisp_catch()
+	`, caught)
+	handlerScope := scope
+	if c.variable != "" {
+		slot := allocaSlot()
+		*asm += fmt.Sprintf(`
+	store i64 %s, i64* %s, align 4
+	`, caught, slot)
+		handlerScope = NewCompilerScope(scope)
+		handlerScope.inner[c.variable] = slot
+	}
+	handlerSymbol := generateNextSymbol()
+	codegenSequence(asm, c.handler, handlerSymbol, handlerScope)
+	handlerBlock := currentBlock
+	*asm += fmt.Sprintf(`
+	br label %%%s
+	`, labels[2])
+	startBlock(asm, labels[2])
+	*asm += fmt.Sprintf(`
+	%s = phi i64 [%s,%%%s],[%s,%%%s]
+	`, symbol, bodySymbol, bodyBlock, handlerSymbol, handlerBlock)
+}
+
+// after is generated twice, once where the body finished and once in the
+// cleanup block, which puts the error aside while after runs and raises it
+// again for the enclosing handler
+func (w *WindNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, w.Span)()
+	w.before.Codegen(asm, generateNextSymbol(), scope)
+	labels := generateNextErrorLabel()
+	outer := unwindTarget
+	*asm += `
+	call void @lisp_enter_handler()
+	`
+	unwindTarget = labels[1]
+	bodySymbol := generateNextSymbol()
+	w.body.Codegen(asm, bodySymbol, scope)
+	unwindTarget = outer
+	*asm += `
+	call void @lisp_leave_handler()
+	`
+	w.after.Codegen(asm, generateNextSymbol(), scope)
+	*asm += fmt.Sprintf(`
+	%s = add i64 %s,0
+	br label %%%s
+	`, symbol, bodySymbol, labels[2])
+	startBlock(asm, labels[1])
+	saved := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = call i8* @lisp_suspend_error()
+	`, saved)
+	w.after.Codegen(asm, generateNextSymbol(), scope)
+	*asm += fmt.Sprintf(`
+	call void @lisp_resume_error(i8* %s)
+	br label %%%s
+	`, saved, unwindTarget)
+	unwindUsed = unwindUsed || unwindTarget == "unwind"
+	startBlock(asm, labels[2])
+}
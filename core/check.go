@@ -0,0 +1,428 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Forms the parser treats specially, they can't be used as names
+var specialForms = []string{"def", "define", "if", "set!", "while", "do", "let", "defmacro", "quote", "import", "require", "export", "extern", "defcfun", "error", "catch", "guard", "dynamic-wind"}
+
+type checker struct {
+	functions   map[string]*FunctionNode
+	externs     map[string]*ExternNode
+	hosts       map[string]bool
+	globals     map[string]bool
+	diagnostics []Diagnostic
+	// compiled rejects what only the interpreter can run
+	compiled bool
+}
+
+// Check resolves every identifier and call in a parsed program before either
+// engine runs it. Functions can be called from anywhere in the file, globals
+// only after their define. Every problem found is reported, in source order.
+func Check(program []ASTNode) []Diagnostic {
+	return checkWithHosts(program, nil)
+}
+
+// Diagnostics is the error for a program that failed the check pass
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d))
+	for indx, diagnostic := range d {
+		messages[indx] = diagnostic.Message
+		if source := diagnostic.Span.Source; source != nil {
+			line, column := Position(source.Input, diagnostic.Span.Start)
+			messages[indx] = fmt.Sprintf("%s:%d:%d: %s", source.Path, line, column, diagnostic.Message)
+		}
+	}
+	return strings.Join(messages, "\n")
+}
+
+// CheckCompiled is Check for a program compile or jit generates code for,
+// quoted lists and symbols and quasiquote only exist in the interpreter and
+// the program needs a main to start from
+func CheckCompiled(program []ASTNode) []Diagnostic {
+	c := newChecker(nil)
+	c.compiled = true
+	diagnostics := c.checkProgram(program)
+	if c.functions["main"] == nil {
+		diagnostics = append([]Diagnostic{{Message: "the program has no main function"}}, diagnostics...)
+	}
+	return diagnostics
+}
+
+// checkWithHosts is Check for a program that can also call the host
+// functions a Session defines
+func checkWithHosts(program []ASTNode, hosts map[string]bool) []Diagnostic {
+	return newChecker(hosts).checkProgram(program)
+}
+
+func newChecker(hosts map[string]bool) *checker {
+	return &checker{functions: make(map[string]*FunctionNode), externs: make(map[string]*ExternNode), hosts: hosts, globals: make(map[string]bool)}
+}
+
+func (c *checker) checkProgram(program []ASTNode) []Diagnostic {
+	for _, node := range program {
+		if extern, ok := node.(*ExternNode); ok {
+			c.checkExtern(extern)
+		}
+		function, ok := node.(*FunctionNode)
+		if !ok {
+			continue
+		}
+		if c.functions[function.name] != nil || c.externs[function.name] != nil || c.hosts[function.name] {
+			c.errorf(function, "function %s is already defined", function.name)
+			continue
+		}
+		c.checkName(function, function.name)
+		c.functions[function.name] = function
+	}
+	for _, node := range program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			c.checkFunction(node)
+		case *ExternNode:
+		case *DefineNode:
+			c.check(node.value, nil)
+			if c.functions[node.name] != nil || c.externs[node.name] != nil || c.hosts[node.name] || c.globals[node.name] {
+				c.errorf(node, "%s is already defined", node.name)
+			}
+			c.checkName(node, node.name)
+			c.globals[node.name] = true
+		default:
+			c.check(node, nil)
+		}
+	}
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		return c.diagnostics[i].Span.Start < c.diagnostics[j].Span.Start
+	})
+	return c.diagnostics
+}
+
+func (c *checker) errorf(node any, format string, args ...any) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{Span: node.(spanned).sourceSpan(), Message: fmt.Sprintf(format, args...)})
+}
+
+// checkName rejects definitions that would be shadowed by a builtin
+func (c *checker) checkName(node ASTNode, name string) {
+	if Includes(builtInOperations, name) || Includes(specialForms, name) {
+		c.errorf(node, "%s is a builtin and can not be redefined", name)
+	}
+}
+
+// checkExtern checks the C types of an extern, modules can declare the same
+// function as long as they agree on its types
+func (c *checker) checkExtern(extern *ExternNode) {
+	c.checkName(extern, extern.name)
+	for _, parameter := range extern.parameters {
+		if parameter == "void" {
+			c.errorf(extern, "void can only be the result of %s", extern.name)
+		} else if cTypes[parameter] == "" {
+			c.errorf(extern, "unknown C type %s", parameter)
+		}
+	}
+	if cTypes[extern.result] == "" {
+		c.errorf(extern, "unknown C type %s", extern.result)
+	}
+	if previous := c.externs[extern.name]; previous != nil {
+		if strings.Join(previous.parameters, " ") != strings.Join(extern.parameters, " ") || previous.result != extern.result {
+			c.errorf(extern, "%s is already declared with different types", extern.name)
+		}
+		return
+	}
+	c.externs[extern.name] = extern
+}
+
+func (c *checker) checkFunction(function *FunctionNode) {
+	if function.name == "main" && len(function.arguments) != 0 {
+		c.errorf(function, "main takes no arguments")
+	}
+	for _, annotation := range function.parameterTypes {
+		c.checkAnnotation(annotation)
+	}
+	c.checkAnnotation(function.returnType)
+	if function.name == "main" && function.returnType != nil && annotationType(function.returnType) != IntType {
+		c.errorf(function.returnType, "main must return int")
+	}
+	locals := make(map[string]bool)
+	for indx, arg := range function.arguments {
+		if locals[arg] {
+			c.errorf(&function.parameterSpans[indx], "duplicate parameter %s in %s", arg, function.name)
+		}
+		locals[arg] = true
+	}
+	for _, expr := range function.body {
+		c.check(expr, locals)
+	}
+}
+
+var scalarTypes = []string{"int", "float"}
+
+// unrepresentable are the types of the type checker no value a program
+// computes has, annotating with them would never type check
+var unrepresentable = map[string]string{
+	"bool":   "comparisons can only be used as conditions",
+	"string": "strings can only be passed to foreign functions",
+	"list":   "lists only exist while macros expand",
+}
+
+func (c *checker) checkAnnotation(annotation *TypeAnnotation) {
+	if annotation == nil {
+		return
+	}
+	switch {
+	case unrepresentable[annotation.name] != "":
+		c.errorf(annotation, "no value has type %s, %s", annotation.name, unrepresentable[annotation.name])
+		return
+	case Includes(scalarTypes, annotation.name):
+		if len(annotation.args) != 0 {
+			c.errorf(annotation, "%s takes no type arguments", annotation.name)
+		}
+	default:
+		c.errorf(annotation, "unknown type %s", annotation.name)
+	}
+	for _, arg := range annotation.args {
+		c.checkAnnotation(arg)
+	}
+}
+
+func (c *checker) isVariable(name string, locals map[string]bool) bool {
+	return locals[name] || c.globals[name]
+}
+
+func (c *checker) checkVariable(node ASTNode, name string, locals map[string]bool) {
+	if c.isVariable(name, locals) {
+		return
+	}
+	if c.functions[name] != nil || c.hosts[name] {
+		c.errorf(node, "function %s can not be used as a value", name)
+		return
+	}
+	c.errorf(node, "%s is not defined", name)
+}
+
+func (c *checker) check(node ASTNode, locals map[string]bool) {
+	switch node := node.(type) {
+	case *IntegerNode, *FloatNode:
+	case *IdentifierNode:
+		c.checkVariable(node, node.name, locals)
+	case *ReferenceNode:
+		c.errorf(node, "references can only be passed to sys_write")
+		c.check(node.value, locals)
+	case *StringNode:
+		c.errorf(node, "strings can only be passed to foreign functions")
+	case *SExpr:
+		c.checkCall(node, locals)
+	case *IfNode:
+		c.checkCondition(node.condition, locals)
+		c.check(node.trueExpr, locals)
+		if node.falseExpr != nil {
+			c.check(node.falseExpr, locals)
+		}
+	case *SetNode:
+		if c.functions[node.name] != nil && !c.isVariable(node.name, locals) {
+			c.errorf(node, "cannot set! function %s", node.name)
+		} else {
+			c.checkVariable(node, node.name, locals)
+		}
+		c.check(node.value, locals)
+	case *WhileNode:
+		c.checkCondition(node.condition, locals)
+		for _, expr := range node.body {
+			c.check(expr, locals)
+		}
+	case *DoNode:
+		c.checkDo(node, locals)
+	case *LetNode:
+		letLocals := c.checkBindings(node, "let", node.bindings, locals)
+		for _, expr := range node.body {
+			c.check(expr, letLocals)
+		}
+	case *ErrorNode:
+		for _, irritant := range node.irritants {
+			c.check(irritant, locals)
+		}
+	case *CatchNode:
+		for _, expr := range node.body {
+			c.check(expr, locals)
+		}
+		handlerLocals := locals
+		if node.variable != "" {
+			handlerLocals = map[string]bool{node.variable: true}
+			for name := range locals {
+				handlerLocals[name] = true
+			}
+		}
+		for _, expr := range node.handler {
+			c.check(expr, handlerLocals)
+		}
+	case *WindNode:
+		c.check(node.before, locals)
+		c.check(node.body, locals)
+		c.check(node.after, locals)
+	case *QuoteNode:
+		switch node.datum.(type) {
+		case Fixnum, *Bignum, Flonum:
+		default:
+			if c.compiled {
+				c.errorf(node, "quoted lists and symbols only exist in the interpreter, they can not be compiled")
+			}
+		}
+	case *QuasiquoteNode:
+		if c.compiled {
+			c.errorf(node, "quasiquote only exists in the interpreter, it can not be compiled")
+		}
+		for _, hole := range templateHoles(node.template, nil) {
+			c.check(hole.expr, locals)
+		}
+	case *DefineNode:
+		c.errorf(node, "define is only allowed at top level")
+	case *FunctionNode:
+		c.errorf(node, "def is only allowed at top level")
+	}
+}
+
+// checkBindings checks the initial values of let and do outside the new
+// scope, the returned locals include the bound names
+func (c *checker) checkBindings(node ASTNode, kind string, bindings []Binding, locals map[string]bool) map[string]bool {
+	inner := make(map[string]bool)
+	for name := range locals {
+		inner[name] = true
+	}
+	bound := make(map[string]bool)
+	for _, binding := range bindings {
+		c.check(binding.init, locals)
+		if bound[binding.name] {
+			c.errorf(node, "duplicate %s variable %s", kind, binding.name)
+		}
+		bound[binding.name] = true
+		inner[binding.name] = true
+	}
+	return inner
+}
+
+func (c *checker) checkDo(node *DoNode, locals map[string]bool) {
+	loopLocals := c.checkBindings(node, "loop", node.bindings, locals)
+	for _, binding := range node.bindings {
+		if binding.step != nil {
+			c.check(binding.step, loopLocals)
+		}
+	}
+	c.checkCondition(node.test, loopLocals)
+	for _, expr := range node.body {
+		c.check(expr, loopLocals)
+	}
+	for _, expr := range node.result {
+		c.check(expr, loopLocals)
+	}
+}
+
+// Comparisons produce a flag rather than a value, so they only appear as the
+// condition of if, while and do
+func (c *checker) checkCondition(condition *SExpr, locals map[string]bool) {
+	if Includes(listPredicates, condition.operand) {
+		c.checkCall(condition, locals)
+		return
+	}
+	if !Includes(comparisionOps, condition.operand) {
+		c.errorf(condition, "condition should be a comparison, got %s", condition.operand)
+		c.checkCall(condition, locals)
+		return
+	}
+	if len(condition.arguments) != 2 {
+		c.errorf(condition, "comparison %s takes exactly two arguments, got %d", condition.operand, len(condition.arguments))
+	}
+	for _, arg := range condition.arguments {
+		c.check(arg, locals)
+	}
+}
+
+func (c *checker) checkCall(call *SExpr, locals map[string]bool) {
+	switch {
+	case Includes(comparisionOps, call.operand):
+		c.errorf(call, "comparison %s can only be used as a condition", call.operand)
+	case Includes(remainderOps, call.operand):
+		if len(call.arguments) != 2 {
+			c.errorf(call, "%s expects 2 arguments, got %d", call.operand, len(call.arguments))
+		}
+	case Includes(arithmeticOps, call.operand):
+		if len(call.arguments) == 0 {
+			c.errorf(call, "%s expects at least one argument", call.operand)
+		}
+	case Includes(numericOps, call.operand) || call.operand == "print":
+		if len(call.arguments) != 1 {
+			c.errorf(call, "%s expects 1 argument, got %d", call.operand, len(call.arguments))
+		}
+	case Includes(systemCalls, call.operand):
+		c.checkSystemCall(call, locals)
+		return
+	case Includes(builtInOperations, call.operand):
+	case c.isVariable(call.operand, locals):
+		c.errorf(call, "%s is not a function", call.operand)
+	case c.functions[call.operand] == nil && (listBuiltins[call.operand] != nil || Includes(listPredicates, call.operand)):
+		c.errorf(call, "%s can only be used in macros", call.operand)
+	case c.hosts[call.operand]:
+	case c.externs[call.operand] != nil:
+		c.checkForeignCall(call, c.externs[call.operand], locals)
+		return
+	case c.functions[call.operand] != nil:
+		function := c.functions[call.operand]
+		if len(call.arguments) != len(function.arguments) {
+			c.errorf(call, "%s expects %d arguments, got %d", call.operand, len(function.arguments), len(call.arguments))
+		}
+	default:
+		c.errorf(call, "%s is not defined", call.operand)
+	}
+	for _, arg := range call.arguments {
+		c.check(arg, locals)
+	}
+}
+
+// Foreign functions take string literals where they take a pointer
+func (c *checker) checkForeignCall(call *SExpr, extern *ExternNode, locals map[string]bool) {
+	if len(call.arguments) != len(extern.parameters) {
+		c.errorf(call, "%s expects %d arguments, got %d", call.operand, len(extern.parameters), len(call.arguments))
+	}
+	for indx, arg := range call.arguments {
+		if _, ok := arg.(*StringNode); ok && indx < len(extern.parameters) && extern.parameters[indx] == "ptr" {
+			continue
+		}
+		c.check(arg, locals)
+	}
+}
+
+// sys_write takes a literal file descriptor, a reference and a literal length
+func (c *checker) checkSystemCall(call *SExpr, locals map[string]bool) {
+	if len(call.arguments) != 3 {
+		c.errorf(call, "%s expects 3 arguments, got %d", call.operand, len(call.arguments))
+		return
+	}
+	if _, ok := call.arguments[0].(*IntegerNode); !ok {
+		c.errorf(call.arguments[0], "%s expects an integer literal file descriptor", call.operand)
+	}
+	if reference, ok := call.arguments[1].(*ReferenceNode); ok {
+		c.check(reference.value, locals)
+	} else {
+		c.errorf(call.arguments[1], "%s expects a reference", call.operand)
+	}
+	if _, ok := call.arguments[2].(*IntegerNode); !ok {
+		c.errorf(call.arguments[2], "%s expects an integer literal length", call.operand)
+	}
+}
+
+// Position turns an offset into a 1 based line and column
+func Position(input string, offset int) (int, int) {
+	if offset > len(input) {
+		offset = len(input)
+	}
+	line := strings.Count(input[:offset], "\n") + 1
+	column := offset - strings.LastIndex(input[:offset], "\n")
+	return line, column
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("offset %d: %s", d.Span.Start, d.Message)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func checkProgram(t *testing.T, input string) []string {
+	t.Helper()
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]string, 0)
+	for _, diagnostic := range Check(expressions) {
+		line, column := Position(input, diagnostic.Span.Start)
+		messages = append(messages, fmt.Sprintf("%d:%d: %s", line, column, diagnostic.Message))
+	}
+	return messages
+}
+
+func TestCheckAcceptsValidPrograms(t *testing.T) {
+	inputs := []string{
+		"(def main() (later 4)) (def later(x) (* x 10))",
+		"(def is_even(n) (if (= n 0) 1 (is_odd (- n 1)))) (def is_odd(n) (if (= n 0) 0 (is_even (- n 1)))) (def main() (is_even 10))",
+		"(define x 5) (define y (* x 2)) (def get() y) (def main() (set! x (get)) x)",
+		"(def main() (do ((i 0 (+ i 1)) (sum 0 (+ sum i))) ((= i 5) sum) (print i)))",
+		"(def count(n) (while (< n 10) (set! n (+ n 3))) n) (def main() (count 0))",
+		"(def main() (sys_write 1 &65 1))",
+		"(def main() (- 5) (/ 5) (sqrt 2.0) (modulo 7 -2))",
+		"(def add((a : int) (b : int)) : int (+ a b)) (def main() : int (add 1 2))",
+		"(extern puts (ptr) i32) (defcfun exit (i32) void) (def main() (puts \"hi\") (exit 0))",
+		"(extern puts (ptr) i32) (extern puts (ptr) i32) (def main() (puts 0))",
+	}
+	for _, input := range inputs {
+		if messages := checkProgram(t, input); len(messages) != 0 {
+			t.Errorf("%s: unexpected diagnostics %v", input, messages)
+		}
+	}
+}
+
+func TestCheckDiagnostics(t *testing.T) {
+	type TestCase struct {
+		input    string
+		messages []string
+	}
+	testCases := []TestCase{
+		{input: "(def f(x) x) (def main() (f 1 2))", messages: []string{"1:26: f expects 1 arguments, got 2"}},
+		{input: "(def main() (g))", messages: []string{"1:13: g is not defined"}},
+		{input: "(def main()\n  (+ x 1))", messages: []string{"2:6: x is not defined"}},
+		{input: "(def f(a a) a)", messages: []string{"1:10: duplicate parameter a in f"}},
+		{input: "(def g((x : int) (x : int)) x)", messages: []string{"1:18: duplicate parameter x in g"}},
+		{input: "(def main() (modulo 1) (% 1 2 3))", messages: []string{"1:13: modulo expects 2 arguments, got 1", "1:24: % expects 2 arguments, got 3"}},
+		{input: "(def f() 1) (def f() 2)", messages: []string{"1:13: function f is already defined"}},
+		{input: "(define x 1) (define x 2)", messages: []string{"1:14: x is already defined"}},
+		{input: "(def f() 1) (define f 2)", messages: []string{"1:13: f is already defined"}},
+		{input: "(def main() x) (define x 1)", messages: []string{"1:13: x is not defined"}},
+		{input: "(define x (+ x 1))", messages: []string{"1:14: x is not defined"}},
+		{input: "(def main() (+) (print 1 2) (sqrt))", messages: []string{
+			"1:13: + expects at least one argument",
+			"1:17: print expects 1 argument, got 2",
+			"1:29: sqrt expects 1 argument, got 0",
+		}},
+		{input: "(def main() (< 1 2))", messages: []string{"1:13: comparison < can only be used as a condition"}},
+		{input: "(def main() (if (+ 1 2) 1))", messages: []string{"1:17: condition should be a comparison, got +"}},
+		{input: "(def main() (while (< 1) 1))", messages: []string{"1:20: comparison < takes exactly two arguments, got 1"}},
+		{input: "(def f() 1) (def main() (set! f 2) f)", messages: []string{"1:25: cannot set! function f", "1:36: function f can not be used as a value"}},
+		{input: "(define x 1) (def main() (x))", messages: []string{"1:26: x is not a function"}},
+		{input: "(def main() (do ((i 0) (i 1)) ((= i 1))))", messages: []string{"1:13: duplicate loop variable i"}},
+		{input: "(def main() (do ((i 0 (+ i j))) ((= i 1))) j)", messages: []string{"1:28: j is not defined", "1:44: j is not defined"}},
+		{input: "(def main() &x)", messages: []string{"1:13: references can only be passed to sys_write", "1:14: x is not defined"}},
+		{input: "(def main() (sys_write x &1 2 3))", messages: []string{"1:13: sys_write expects 3 arguments, got 4"}},
+		{input: "(def main() (sys_write x 1 y))", messages: []string{
+			"1:24: sys_write expects an integer literal file descriptor",
+			"1:26: sys_write expects a reference",
+			"1:28: sys_write expects an integer literal length",
+		}},
+		{input: "(def main(x) x)", messages: []string{"1:1: main takes no arguments"}},
+		{input: "(def main() (guard (e e) e) (catch (error \"bad\" y) 0))", messages: []string{"1:26: e is not defined", "1:49: y is not defined"}},
+		{input: "(def main() (dynamic-wind (f) 1 x))", messages: []string{"1:27: f is not defined", "1:33: x is not defined"}},
+		{input: "(def print(x) x) (define sqrt 1)", messages: []string{"1:1: print is a builtin and can not be redefined", "1:18: sqrt is a builtin and can not be redefined"}},
+		{input: "(def main() (let ((x 1) (x 2)) x))", messages: []string{"1:13: duplicate let variable x"}},
+		{input: "(def main() (let ((x 1) (y x)) y))", messages: []string{"1:28: x is not defined"}},
+		{input: "(def main() (def f() 1) 1)", messages: []string{"1:13: def is only allowed at top level"}},
+		{input: "(def f((x : integer)) : (list) x)", messages: []string{"1:13: unknown type integer", "1:25: no value has type list, lists only exist while macros expand"}},
+		{input: "(def f((x : (int float))) x)", messages: []string{"1:13: int takes no type arguments"}},
+		{input: "(def main() : float 1.0)", messages: []string{"1:15: main must return int"}},
+		{input: "(defmacro twice (x) `(+ ,x ,x)) (def main() (twice y))", messages: []string{"1:45: y is not defined", "1:45: y is not defined"}},
+		{input: "(def main() (car 1))", messages: []string{"1:13: car can only be used in macros"}},
+		{input: "(extern f (void i31) foo)", messages: []string{"1:1: void can only be the result of f", "1:1: unknown C type i31", "1:1: unknown C type foo"}},
+		{input: "(extern puts (ptr) i32) (def main() (puts \"a\" 1))", messages: []string{"1:37: puts expects 1 arguments, got 2"}},
+		{input: "(extern labs (i64) i64) (def main() (labs \"a\") (print \"b\"))", messages: []string{
+			"1:43: strings can only be passed to foreign functions",
+			"1:55: strings can only be passed to foreign functions",
+		}},
+		{input: "(extern f () i32) (extern f (i32) i32)", messages: []string{"1:19: f is already declared with different types"}},
+		{input: "(extern f () i32) (def f() 1)", messages: []string{"1:19: function f is already defined"}},
+		{input: "(def f((b : bool)) : string b) (def g((xs : (list int))) xs)", messages: []string{
+			"1:13: no value has type bool, comparisons can only be used as conditions",
+			"1:22: no value has type string, strings can only be passed to foreign functions",
+			"1:45: no value has type list, lists only exist while macros expand",
+		}},
+	}
+	for _, testCase := range testCases {
+		messages := checkProgram(t, testCase.input)
+		if fmt.Sprint(messages) != fmt.Sprint(testCase.messages) {
+			t.Errorf("%s: expected %q, got %q", testCase.input, testCase.messages, messages)
+		}
+	}
+}
+
+func TestPosition(t *testing.T) {
+	input := "(def main()\n  (+ 1 2))\n"
+	for offset, expected := range map[int][2]int{0: {1, 1}, 11: {1, 12}, 12: {2, 1}, 14: {2, 3}, len(input): {3, 1}} {
+		if line, column := Position(input, offset); line != expected[0] || column != expected[1] {
+			t.Errorf("offset %d: expected %d:%d, got %d:%d", offset, expected[0], expected[1], line, column)
+		}
+	}
+}
+
+func TestCheckCompiledRejectsInterpreterData(t *testing.T) {
+	input := "(def main()\n  (print '(1 2))\n  (print 'x)\n  (print `(1 ,(+ 1 2)))\n  (print '2.5)\n  0)"
+	parser := NewParser(input)
+	parser.source = &SourceFile{Path: "main.lisp", Input: input}
+	expressions, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Check(expressions); len(diagnostics) != 0 {
+		t.Errorf("Expected the interpreter to accept quoted data, got %v", diagnostics)
+	}
+	expected := strings.Join([]string{
+		"main.lisp:2:10: quoted lists and symbols only exist in the interpreter, they can not be compiled",
+		"main.lisp:3:10: quoted lists and symbols only exist in the interpreter, they can not be compiled",
+		"main.lisp:4:10: quasiquote only exists in the interpreter, it can not be compiled",
+	}, "\n")
+	if err := Diagnostics(CheckCompiled(expressions)); err.Error() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, err)
+	}
+}
+
+func TestCheckCompiledNeedsMain(t *testing.T) {
+	expressions, err := NewParser("(def f(x) x)").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Check(expressions); len(diagnostics) != 0 {
+		t.Errorf("Expected the interpreter to accept a program without main, got %v", diagnostics)
+	}
+	if err := Diagnostics(CheckCompiled(expressions)); err.Error() != "the program has no main function" {
+		t.Errorf("Expected a missing main, got %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package core
 
 import (
 	"fmt"
+	"math"
 	"runtime"
+	"strings"
 )
 
 var prefix = `
@@ -39,56 +41,78 @@ var suffix = `
 `
 
 func (s *SExpr) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, s.Span)()
+	if InferredTypes.isFloat(s) && isUnboxedFloat(s.operand) {
+		double := codegenDouble(asm, s, scope)
+		*asm += fmt.Sprintf(`
+	%s = call i64 @lisp_box_double(double %s)
+		`, symbol, double)
+		return
+	}
 	if Includes(arithmeticOps, s.operand) {
-		if len(s.arguments) == 1 {
+		if len(s.arguments) == 1 && s.operand == "-" {
+			argSymbol := generateNextSymbol()
+			s.arguments[0].Codegen(asm, argSymbol, scope)
+			*asm += fmt.Sprintf(`
+	%s = call i64 @__lisp_negate(i64 %s)
+		`, symbol, argSymbol)
+			return
+		}
+		if len(s.arguments) == 1 && s.operand == "/" {
+			// (/ x) is (/ 1 x)
+			s = &SExpr{Span: s.Span, operand: s.operand, arguments: []ASTNode{newIntegerNode(Fixnum(1)), s.arguments[0]}}
+		} else if len(s.arguments) == 1 {
 			s.arguments[0].Codegen(asm, symbol, scope)
 			return
 		}
-		midpoint := getMidpointIndex[ASTNode](s.arguments)
-		firstHalf := s.arguments[:midpoint]
-		firstHalfSymbol := generateNextSymbol()
-		secondHalfSymbol := generateNextSymbol()
-		firstHalfSExpr := &SExpr{
-			operand:   s.operand,
-			arguments: firstHalf,
-		}
-		firstHalfSExpr.Codegen(asm, firstHalfSymbol, scope)
-		secondHalf := s.arguments[midpoint:]
-		secondHalfSExpr := &SExpr{
-			operand:   s.operand,
-			arguments: secondHalf,
-		}
-		secondHalfSExpr.Codegen(asm, secondHalfSymbol, scope)
-		*asm += fmt.Sprintf(`
-	%s = %s i64 %s,%s
-		`, symbol, operandFunctioanMap[s.operand], firstHalfSymbol, secondHalfSymbol)
+		// Fold from the left like the interpreter does, (- 10 1 2) is (- (- 10 1) 2)
+		accumulator := generateNextSymbol()
+		s.arguments[0].Codegen(asm, accumulator, scope)
+		for indx, arg := range s.arguments[1:] {
+			argSymbol := generateNextSymbol()
+			arg.Codegen(asm, argSymbol, scope)
+			resultSymbol := symbol
+			if indx != len(s.arguments)-2 {
+				resultSymbol = generateNextSymbol()
+			}
+			*asm += arithmeticInstruction(s.operand, resultSymbol, accumulator, argSymbol)
+			if mayFail(s.operand) {
+				checkError(asm)
+			}
+			accumulator = resultSymbol
+		}
 		return
 	}
 	if Includes(comparisionOps, s.operand) {
 		if len(s.arguments) != 2 {
 			panic("Error: comparision operators can have only two arguments")
 		}
-		var compareInstr string
-		switch s.operand {
-		case "<":
-			compareInstr = "slt"
-			break
-		case ">":
-			compareInstr = "sgt"
-			break
-		case "=":
-			compareInstr = "eq"
-			break
-		default:
-			panic("Error")
+		if InferredTypes.isFloat(s.arguments[0]) && InferredTypes.isFloat(s.arguments[1]) {
+			left := codegenDouble(asm, s.arguments[0], scope)
+			right := codegenDouble(asm, s.arguments[1], scope)
+			*asm += fmt.Sprintf(`
+	%s = fcmp %s double %s, %s
+		`, symbol, comparisonInstructions[comparisonHelpers[s.operand]][1], left, right)
+			return
 		}
 		arg1Symbol := generateNextSymbol()
 		arg2Symbol := generateNextSymbol()
 		s.arguments[0].Codegen(asm, arg1Symbol, scope)
 		s.arguments[1].Codegen(asm, arg2Symbol, scope)
 		*asm += fmt.Sprintf(`
-	%s = icmp %s i64 %s , %s
-		`, symbol, compareInstr, arg1Symbol, arg2Symbol)
+	%s = call i1 @__lisp_%s(i64 %s,i64 %s)
+		`, symbol, comparisonHelpers[s.operand], arg1Symbol, arg2Symbol)
+		return
+	}
+	if helper, ok := unaryHelpers[s.operand]; ok {
+		if len(s.arguments) != 1 {
+			panic(fmt.Sprintf("Error: %s takes exactly one argument", s.operand))
+		}
+		argSymbol := generateNextSymbol()
+		s.arguments[0].Codegen(asm, argSymbol, scope)
+		*asm += fmt.Sprintf(`
+	%s = call i64 @%s(i64 %s)
+		`, symbol, helper, argSymbol)
 		return
 	}
 	if Includes(systemCalls, s.operand) {
@@ -104,17 +128,23 @@ func (s *SExpr) Codegen(asm *string, symbol string, scope *CompilerScope) {
 		}
 		charNum, ok := s.arguments[2].(*IntegerNode)
 		charNumSymbol := generateNextSymbol()
-		outFd.Codegen(asm, outFdSymbol, scope)
-		referenceNode.Codegen(asm, referenceSymbol, scope)
-		charNum.Codegen(asm, charNumSymbol, scope)
 		if !ok {
 			panic("Expected Integer")
 		}
+		// The syscall takes machine integers, not tagged values
+		*asm += fmt.Sprintf(`
+	%s = add i64 %s,0
+	`, outFdSymbol, outFd.value)
+		referenceNode.Codegen(asm, referenceSymbol, scope)
+		*asm += fmt.Sprintf(`
+	%s = add i64 %s,0
+	`, charNumSymbol, charNum.value)
 		pointerToIntSymbol := generateNextSymbol()
 		syscallNumSymbol := generateNextSymbol()
 		syscallStatusSymbol := generateNextSymbol()
 		checkIfSyscallSuccessSymbol := generateNextSymbol()
 		symbolForOne := generateNextSymbol()
+		shiftedStatusSymbol := generateNextSymbol()
 		if runtime.GOOS == "darwin" {
 			*asm += fmt.Sprintf(`
 				%s = ptrtoint i64* %s to i64
@@ -124,10 +154,11 @@ func (s *SExpr) Codegen(asm *string, symbol string, scope *CompilerScope) {
 				%s = icmp eq i64 %s,%s
 				br i1 %s,label %%syscallSuccess,label %%syscallFail
 				syscallSuccess:
-					ret i64 0
+					ret i64 1
 				syscallFail:
-					%s = add i64 %s,0
-			`, pointerToIntSymbol, referenceSymbol, syscallNumSymbol, syscallStatusSymbol, outFdSymbol, pointerToIntSymbol, charNumSymbol, syscallNumSymbol, symbolForOne, checkIfSyscallSuccessSymbol, symbolForOne, syscallStatusSymbol, checkIfSyscallSuccessSymbol, symbol, syscallStatusSymbol)
+					%s = shl i64 %s,1
+					%s = or i64 %s,1
+			`, pointerToIntSymbol, referenceSymbol, syscallNumSymbol, syscallStatusSymbol, outFdSymbol, pointerToIntSymbol, charNumSymbol, syscallNumSymbol, symbolForOne, checkIfSyscallSuccessSymbol, symbolForOne, syscallStatusSymbol, checkIfSyscallSuccessSymbol, shiftedStatusSymbol, syscallStatusSymbol, symbol, shiftedStatusSymbol)
 		} else {
 			*asm += fmt.Sprintf(`
 				%s = ptrtoint i64* %s to i64
@@ -137,68 +168,314 @@ func (s *SExpr) Codegen(asm *string, symbol string, scope *CompilerScope) {
 				%s = icmp eq i64 %s,%s
 				br i1 %s,label %%syscallSuccess,label %%syscallFail
 				syscallSuccess:
-					ret i64 0
+					ret i64 1
 				syscallFail:
-					%s = add i64 %s,0
-			`, pointerToIntSymbol, referenceSymbol, syscallNumSymbol, syscallStatusSymbol, syscallNumSymbol, outFdSymbol, pointerToIntSymbol, charNumSymbol, symbolForOne, checkIfSyscallSuccessSymbol, symbolForOne, syscallStatusSymbol, checkIfSyscallSuccessSymbol, symbol, syscallStatusSymbol)
+					%s = shl i64 %s,1
+					%s = or i64 %s,1
+			`, pointerToIntSymbol, referenceSymbol, syscallNumSymbol, syscallStatusSymbol, syscallNumSymbol, outFdSymbol, pointerToIntSymbol, charNumSymbol, symbolForOne, checkIfSyscallSuccessSymbol, symbolForOne, syscallStatusSymbol, checkIfSyscallSuccessSymbol, shiftedStatusSymbol, syscallStatusSymbol, symbol, shiftedStatusSymbol)
 		}
+		currentBlock = "syscallFail"
 		return
 	}
-	currentSymbol := symbol
-	symbol = generateNextSymbol()
-	argumentStack := make([]string, 0)
-	for _, arg := range s.arguments {
-		argumentStack = append(argumentStack, symbol)
-		arg.Codegen(asm, symbol, scope)
-		symbol = generateNextSymbol()
+	if extern, ok := globalExterns[s.operand]; ok {
+		codegenForeignCall(asm, s, extern, symbol, scope)
+		return
 	}
+	value, valueType := codegenCall(asm, s, scope)
+	taggedFrom(asm, valueType, value, symbol)
+}
+
+// codegenCall calls a user function, arguments and the result use the LLVM
+// types the function was annotated with. It returns the result and its type.
+func codegenCall(asm *string, s *SExpr, scope *CompilerScope) (string, string) {
 	function, ok := globalFunctionStore.store[s.operand]
 	if !ok {
 		panic(fmt.Sprintf("%s function not defined", s.operand))
 	}
+	if len(s.arguments) != len(function.arguments) {
+		panic(fmt.Sprintf("Error: %s expects %d arguments, got %d", s.operand, len(function.arguments), len(s.arguments)))
+	}
+	argumentStack := make([]string, 0)
+	for indx, arg := range s.arguments {
+		argumentType := llvmType(function.parameterType(indx))
+		var argument string
+		if argumentType == "double" {
+			argument = codegenDouble(asm, arg, scope)
+		} else {
+			tagged := generateNextSymbol()
+			arg.Codegen(asm, tagged, scope)
+			argument = representationOf(asm, argumentType, tagged)
+		}
+		argumentStack = append(argumentStack, argumentType+" "+argument)
+	}
 	argumentString := "("
 	for indx, arg := range argumentStack {
-		argumentString += fmt.Sprintf("i64 %s", arg)
-		if indx != len(function.arguments)-1 {
+		argumentString += arg
+		if indx != len(argumentStack)-1 {
 			argumentString += ","
 		}
 	}
 	argumentString += ")"
+	resultType := llvmType(function.returnType)
+	result := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = call %s @%s%s
+	`, result, resultType, llvmFunctionName(s.operand), argumentString)
+	checkError(asm)
+	return result, resultType
+}
+
+func (f *FunctionNode) parameterType(indx int) *TypeAnnotation {
+	if indx < len(f.parameterTypes) {
+		return f.parameterTypes[indx]
+	}
+	return nil
+}
+
+// llvmType is how a value of the annotated type is passed, values are
+// tagged i64 words unless they are annotated as floats. There is no i1 or ptr
+// case, check rejects bool, string and list annotations since no value a
+// function can be passed has those types.
+func llvmType(annotation *TypeAnnotation) string {
+	if annotationType(annotation) == FloatType {
+		return "double"
+	}
+	return "i64"
+}
+
+// representationOf converts a tagged value to llvmType
+func representationOf(asm *string, llvmType string, tagged string) string {
+	if llvmType == "i64" {
+		return tagged
+	}
+	value := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = call double @lisp_to_double(i64 %s)
+	`, value, tagged)
+	return value
+}
+
+// taggedFrom stores value, of type llvmType, into symbol as a tagged value
+func taggedFrom(asm *string, llvmType string, value string, symbol string) {
+	switch llvmType {
+	case "i64":
+		*asm += fmt.Sprintf(`
+	%s = add i64 %s,0
+	`, symbol, value)
+	case "double":
+		*asm += fmt.Sprintf(`
+	%s = call i64 @lisp_box_double(double %s)
+	`, symbol, value)
+	}
+}
+
+// DeclareFunctions records the name and arity of every top level def and the
+// externs before any code is generated, calls are checked against it wherever
+// the callee is defined in the file
+func (s *CompilerScope) DeclareFunctions(program []ASTNode) {
+	globalFunctionStore = &FunctionStore{store: make(map[string]*FunctionNode)}
+	globalExterns = make(map[string]*ExternNode)
+	declaredExterns = make(map[string]bool)
+	for _, node := range program {
+		if extern, ok := node.(*ExternNode); ok {
+			globalExterns[extern.name] = extern
+		}
+		function, ok := node.(*FunctionNode)
+		if !ok {
+			continue
+		}
+		if _, ok := s.inner[function.name]; ok {
+			panic(fmt.Sprintf("Error: function %s is already defined", function.name))
+		}
+		globalFunctionStore.store[function.name] = function
+		s.inner[function.name] = function.name
+	}
+}
+
+// CodegenUnit generates the LLVM module for one unit of program, the whole
+// linked program. The functions and globals the unit uses from other units
+// are declared, and the program's __init initialises the other units first.
+func CodegenUnit(program []ASTNode, units []*Unit, unit *Unit) string {
+	scope := NewCompilerScope(nil)
+	scope.DeclareFunctions(program)
+	generateNextConstant = constantGenerator()
+	globalInitializers = nil
+	debugNodes = nil
+	if DebugInfo {
+		debugNodes = newDebugMetadata(unit.Source)
+	}
+	own := make(map[ASTNode]bool)
+	used := make(map[string]bool)
+	for _, node := range unit.Program {
+		own[node] = true
+		renameFree(node, nil, func(name string, node ASTNode) string {
+			used[name] = true
+			return name
+		})
+	}
+	asm := ""
+	for _, node := range program {
+		if own[node] {
+			continue
+		}
+		switch node := node.(type) {
+		case *FunctionNode:
+			if used[node.name] {
+				asm += functionDeclaration(node)
+			}
+		case *ExternNode:
+			if used[node.name] {
+				asm += externDeclaration(node)
+			}
+		case *DefineNode:
+			scope.inner[node.name] = llvmGlobalName(node.name)
+			if used[node.name] {
+				asm += fmt.Sprintf("%s = external global i64\n", llvmGlobalName(node.name))
+			}
+		}
+	}
+	for _, node := range unit.Program {
+		node.Codegen(&asm, "%sym1", scope)
+		asm += "\n"
+	}
+	if Annotate || DebugInfo {
+		asm = finishAnnotations(asm)
+	}
+	if !unit.Main {
+		asm += runtimeHelpers() + initFunction("void "+unitInitName(unit), nil)
+	} else {
+		imported := make([]string, 0)
+		for _, other := range units {
+			if !other.Main {
+				imported = append(imported, unitInitName(other))
+			}
+		}
+		asm += overflowFlag() + runtimeHelpers() + initFunction("internal void @__init", imported)
+	}
+	return moduleHeader(unit) + "\n" + FormatIR(asm+takeConstants()+takeDebugMetadata())
+}
+
+func unitInitName(unit *Unit) string {
+	return fmt.Sprintf(`@"%s.__init"`, unit.Name)
+}
+
+// functionDeclaration declares a function defined in another unit with the
+// types it is called with
+func functionDeclaration(f *FunctionNode) string {
+	parameters := make([]string, len(f.arguments))
+	for indx := range f.arguments {
+		parameters[indx] = llvmType(f.parameterType(indx))
+	}
+	return fmt.Sprintf("declare %s @%s(%s)\n", llvmType(f.returnType), llvmFunctionName(f.name), strings.Join(parameters, ", "))
+}
+
+func isUnboxedFloat(operand string) bool {
+	return floatInstructions[operand] != "" || floatIntrinsics[operand] != "" || operand == "exact->inexact"
+}
+
+// codegenDouble computes node as an unboxed double, expressions the types
+// say are flonums stay unboxed until their result is needed as a value
+func codegenDouble(asm *string, node ASTNode, scope *CompilerScope) string {
+	switch node := node.(type) {
+	case *FloatNode:
+		return fmt.Sprintf("0x%016X", math.Float64bits(float64(node.value)))
+	case *SExpr:
+		if function, ok := globalFunctionStore.store[node.operand]; ok && !Includes(builtInOperations, node.operand) && llvmType(function.returnType) == "double" {
+			result, _ := codegenCall(asm, node, scope)
+			return result
+		}
+		if !InferredTypes.isFloat(node) || !isUnboxedFloat(node.operand) {
+			break
+		}
+		if intrinsic, ok := floatIntrinsics[node.operand]; ok {
+			argument := codegenDouble(asm, node.arguments[0], scope)
+			result := generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = call double @%s(double %s)
+	`, result, intrinsic, argument)
+			return result
+		}
+		// The interpreter folds the arguments in front of the first flonum
+		// exactly, (/ 7 2 2.0) is (/ 3 2.0)
+		first := 0
+		for first < len(node.arguments) && !InferredTypes.isFloat(node.arguments[first]) {
+			first++
+		}
+		var accumulator string
+		if first > 1 {
+			accumulator = codegenDouble(asm, &SExpr{Span: node.Span, operand: node.operand, arguments: node.arguments[:first]}, scope)
+		} else {
+			first = 1
+			accumulator = codegenDouble(asm, node.arguments[0], scope)
+		}
+		if node.operand == "-" && len(node.arguments) == 1 {
+			result := generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = fneg double %s
+	`, result, accumulator)
+			return result
+		}
+		if node.operand == "/" && len(node.arguments) == 1 {
+			result := generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = fdiv double 1.0, %s
+	`, result, accumulator)
+			return result
+		}
+		for _, arg := range node.arguments[first:] {
+			argument := codegenDouble(asm, arg, scope)
+			result := generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = %s double %s, %s
+	`, result, floatInstructions[node.operand], accumulator, argument)
+			accumulator = result
+		}
+		return accumulator
+	}
+	boxed := generateNextSymbol()
+	node.Codegen(asm, boxed, scope)
+	double := generateNextSymbol()
 	*asm += fmt.Sprintf(`
-	%s = call i64 @%s%s
-	`, currentSymbol, s.operand, argumentString)
+	%s = call double @lisp_to_double(i64 %s)
+	`, double, boxed)
+	return double
 }
 
 func (f *FunctionNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
 	globalFunctionStore.store[f.name] = f
 	scope.inner[f.name] = f.name
+	// Arguments shadow globals inside this function only
+	scope = NewCompilerScope(scope)
 	argumentString := "("
-	generateNextIfLabel = ifLabelGenerator()
-	generateNextSymbol = nextSymbolGenerator()
-	symbol = generateNextSymbol()
+	startFunction()
+	startSubprogram(f)
 	for indx, arg := range f.arguments {
-		argumentString += ("i64 %" + arg)
+		argumentString += (llvmType(f.parameterType(indx)) + " %" + llvmName(arg))
 		if indx != len(f.arguments)-1 {
 			argumentString += ","
 		}
 	}
 	argumentString += ")"
+	// Arguments are kept tagged in their slots whatever type they were passed as
 	loadArgumentInstructions := ""
-	for _, arg := range f.arguments {
+	for indx, arg := range f.arguments {
+		slot := generateNextSymbol()
+		tagged := generateNextSymbol()
+		taggedFrom(&loadArgumentInstructions, llvmType(f.parameterType(indx)), "%"+llvmName(arg), tagged)
 		loadArgumentInstructions += fmt.Sprintf(`
   %s = alloca i64, align 4
-	store i64 %%%s, i64* %s, align 4
-    `, symbol, arg, symbol)
-		scope.inner[arg] = symbol
-		symbol = generateNextSymbol()
+	store i64 %s, i64* %s, align 4
+    `, slot, tagged, slot)
+		declareParameter(&loadArgumentInstructions, f, indx, slot)
+		scope.inner[arg] = slot
+	}
+	symbol = generateNextSymbol()
+	body := ""
+	if len(f.body) == 0 {
+		body = fmt.Sprintf(`
+	%s = add i64 1,0
+	`, symbol)
 	}
-	*asm += fmt.Sprintf(`
-define i64 @%s%s{
-    entry:
-	`, f.name, argumentString)
-	*asm += fmt.Sprintf(` 
-	%s
-	`, loadArgumentInstructions)
 	for i, expr := range f.body {
 		var symbolForExpression string // symbol for each expression in the function body, the last statement should use the main symbol(cause thats what gets returned) and the subsidiaries should use a new symbol
 		if i == len(f.body)-1 {
@@ -206,12 +483,176 @@ define i64 @%s%s{
 		} else {
 			symbolForExpression = generateNextSymbol()
 		}
-		expr.Codegen(asm, symbolForExpression, scope)
+		expr.Codegen(&body, symbolForExpression, scope)
+	}
+	resultType := llvmType(f.returnType)
+	result := representationOf(&body, resultType, symbol)
+	attachment := ""
+	if debugFunction != nil {
+		attachment = " !dbg " + debugFunction.id
+	}
+	if Annotate && f.Source != nil {
+		*asm += "\n" + annotation(f.Span)
+	}
+	*asm += fmt.Sprintf(`
+define %s @%s%s%s{
+    entry:
+	`, resultType, llvmFunctionName(f.name), argumentString, attachment)
+	instructions := fmt.Sprintf(` 
+	%s
+	%s
+	`, loadArgumentInstructions, functionAllocas)
+	instructions += body
+	instructions += fmt.Sprintf(`
+	ret %s %s
+%s`, resultType, result, unwindBlock(resultType))
+	*asm += attachLocations(instructions, f) + `}
+	`
+	if f.name == "main" {
+		*asm += mainWrapper
+	}
+}
+
+// startFunction resets the per function codegen state, symbols and labels are
+// only unique within a function
+func startFunction() {
+	generateNextIfLabel = ifLabelGenerator()
+	generateNextLoopLabel = loopLabelGenerator()
+	generateNextSymbol = nextSymbolGenerator()
+	generateNextErrorLabel = errorLabelGenerator()
+	functionAllocas = ""
+	currentBlock = "entry"
+	unwindTarget = "unwind"
+	unwindUsed = false
+	debugFunction = nil
+}
+
+// allocaSlot reserves a stack slot in the entry block, so slots used inside
+// loops are allocated once per call rather than once per iteration
+func allocaSlot() string {
+	slot := generateNextSymbol()
+	functionAllocas += fmt.Sprintf(`
+	%s = alloca i64, align 4`, slot)
+	return slot
+}
+
+// startBlock emits a label and records it as the block any following
+// instructions end up in, phi nodes need the block a value was computed in
+func startBlock(asm *string, label string) {
+	*asm += fmt.Sprintf(`
+	%s:
+	`, label)
+	currentBlock = label
+}
+
+// The lisp main returns a tagged value, the C entry point has to hand an
+// untagged status to the OS. Globals are initialised before it runs.
+var mainWrapper = `
+define i32 @main(){
+entry:
+	call void @__init()
+	%value = call i64 @lisp_main()
+	%status = call i64 @lisp_exit_code(i64 %value)
+	%exit = trunc i64 %status to i32
+	ret i32 %exit
+}
+`
+
+// JITEntry is what jit mode runs instead of main, appended to the main unit.
+// Like interpret it prints the value main returns rather than exiting with it.
+const JITEntry = `
+define i32 @lisp_jit_main() {
+entry:
+  call void @__init()
+  %value = call i64 @lisp_main()
+  %printed = call i64 @lisp_print(i64 %value)
+  ret i32 0
+}
+`
+
+// Globals whose value folds to a fixnum or flonum get a static initializer,
+// anything else is computed by its own function which __init calls before main
+func (d *DefineNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	if _, ok := scope.inner[d.name]; ok {
+		panic(fmt.Sprintf("Error: %s is already defined", d.name))
+	}
+	name := llvmGlobalName(d.name)
+	if value, ok := constantValue(d.value); ok {
+		if initializer, ok := staticInitializer(value); ok {
+			*asm += fmt.Sprintf(`
+%s = global i64 %s
+`, name, initializer)
+			scope.inner[d.name] = name
+			return
+		}
 	}
+	startFunction()
+	symbol = generateNextSymbol()
+	body := ""
+	d.value.Codegen(&body, symbol, NewCompilerScope(scope))
 	*asm += fmt.Sprintf(`
-	ret i64 %%sym%d
+%s = global i64 0
+
+define internal i64 @"global.%s.init"(){
+    entry:
+	%s
+	%s
+	ret i64 %s
+%s}
+	`, name, d.name, functionAllocas, body, symbol, unwindBlock("i64"))
+	globalInitializers = append(globalInitializers, d.name)
+	scope.inner[d.name] = name
+}
+
+// constantValue folds literals and arithmetic on them, anything that fails to
+// evaluate (division by zero, a checked overflow) is left for the runtime
+func constantValue(node ASTNode) (value Value, ok bool) {
+	switch node := node.(type) {
+	case *IntegerNode:
+		return node.value, true
+	case *FloatNode:
+		return node.value, true
+	case *SExpr:
+		if !Includes(arithmeticOps, node.operand) && !Includes(numericOps, node.operand) {
+			return nil, false
+		}
+		arguments := make([]Value, 0)
+		for _, arg := range node.arguments {
+			argument, ok := constantValue(arg)
+			if !ok {
+				return nil, false
+			}
+			arguments = append(arguments, argument)
+		}
+		defer func() {
+			if recover() != nil {
+				value, ok = nil, false
+			}
+		}()
+		return BuiltinFuncMap[node.operand](arguments), true
+	}
+	return nil, false
 }
-	`, len(f.arguments)+1)
+
+func llvmGlobalName(name string) string {
+	return fmt.Sprintf(`@"global.%s"`, name)
+}
+
+func llvmFunctionName(name string) string {
+	if name == "main" {
+		return "lisp_main"
+	}
+	return llvmName(name)
+}
+
+// llvmName quotes names with characters LLVM identifiers can't hold, even?
+func llvmName(name string) string {
+	for _, char := range name {
+		if !(char >= 'a' && char <= 'z' || char >= '0' && char <= '9' || char == '_' || char == '.') {
+			return `"` + name + `"`
+		}
+	}
+	return name
 }
 
 func (i *IdentifierNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
@@ -223,101 +664,229 @@ func (i *IdentifierNode) Codegen(asm *string, symbol string, scope *CompilerScop
 }
 
 func (i *IfNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
-	allocVariable := generateNextSymbol()
-	*asm += fmt.Sprintf(`
-	%s = alloca i64, align 4
-	`, allocVariable)
-
+	defer markLocation(asm, i.Span)()
 	conditionSymbol := generateNextSymbol()
 	ifLabel := generateNextIfLabel()
 
 	i.condition.Codegen(asm, conditionSymbol, scope)
+	conditionBlock := currentBlock
 
+	falseLabel := ifLabel[2]
 	if i.falseExpr != nil {
-		*asm += fmt.Sprintf(`
-	br i1 %s,label %%%s,label %%%s
-	%s:
-	`, conditionSymbol, ifLabel[0], ifLabel[1], ifLabel[0])
-	} else {
-		*asm += fmt.Sprintf(`
-	br i1 %s,label %%%s,label %%%s
-	%s:
-	`, conditionSymbol, ifLabel[0], ifLabel[2], ifLabel[0])
+		falseLabel = ifLabel[1]
 	}
-	basicBlockQueue = append(basicBlockQueue, ifLabel[0])
+	*asm += fmt.Sprintf(`
+	br i1 %s,label %%%s,label %%%s
+	`, conditionSymbol, ifLabel[0], falseLabel)
+	startBlock(asm, ifLabel[0])
 
 	trueSymbol := generateNextSymbol()
 	falseSymbol := generateNextSymbol()
 
 	i.trueExpr.Codegen(asm, trueSymbol, scope)
-
+	trueBlock := currentBlock
 	*asm += fmt.Sprintf(`
     br label %%%s
 	`, ifLabel[2])
 
-	if i.falseExpr != nil {
-		*asm += fmt.Sprintf(`
-	%s:
-	`, ifLabel[1])
-		i.falseExpr.Codegen(asm, falseSymbol, scope)
+	if i.falseExpr == nil {
+		// Without a false branch the if evaluates to a tagged 0
+		startBlock(asm, ifLabel[2])
 		*asm += fmt.Sprintf(`
+    %s = phi i64 [%s,%%%s],[1,%%%s]
+	`, symbol, trueSymbol, trueBlock, conditionBlock)
+		return
+	}
+	startBlock(asm, ifLabel[1])
+	i.falseExpr.Codegen(asm, falseSymbol, scope)
+	falseBlock := currentBlock
+	*asm += fmt.Sprintf(`
       br label %%%s
   `, ifLabel[2])
-		basicBlockQueue = append(basicBlockQueue, ifLabel[1])
+	startBlock(asm, ifLabel[2])
+	*asm += fmt.Sprintf(`
+    %s = phi i64 [%s,%%%s],[%s,%%%s]
+	`, symbol, trueSymbol, trueBlock, falseSymbol, falseBlock)
+}
+
+func (s *SetNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, s.Span)()
+	slot, err := scope.get(s.name)
+	if err != nil {
+		panic(fmt.Sprintf("Symbol not in scope %s", s.name))
 	}
+	if slot == s.name {
+		panic(fmt.Sprintf("Error: cannot set! function %s", s.name))
+	}
+	valueSymbol := generateNextSymbol()
+	s.value.Codegen(asm, valueSymbol, scope)
+	*asm += fmt.Sprintf(`
+	store i64 %s, i64* %s, align 4
+	%s = add i64 %s,0
+	`, valueSymbol, slot, symbol, valueSymbol)
+}
 
-	if i.falseExpr == nil {
+// while evaluates to a tagged 0 once the condition fails
+func (w *WhileNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, w.Span)()
+	loopLabel := generateNextLoopLabel()
+	*asm += fmt.Sprintf(`
+	br label %%%s
+	`, loopLabel[0])
+	startBlock(asm, loopLabel[0])
+	conditionSymbol := generateNextSymbol()
+	w.condition.Codegen(asm, conditionSymbol, scope)
+	*asm += fmt.Sprintf(`
+	br i1 %s,label %%%s,label %%%s
+	`, conditionSymbol, loopLabel[1], loopLabel[2])
+	startBlock(asm, loopLabel[1])
+	for _, expr := range w.body {
+		expr.Codegen(asm, generateNextSymbol(), scope)
+	}
+	*asm += fmt.Sprintf(`
+	br label %%%s
+	`, loopLabel[0])
+	startBlock(asm, loopLabel[2])
+	*asm += fmt.Sprintf(`
+	%s = add i64 1,0
+	`, symbol)
+}
 
-		if len(basicBlockQueue) == 0 {
-			panic("block queue cannot be empty")
+// Let variables get stack slots so set! can assign to them
+func (l *LetNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, l.Span)()
+	letScope := bindSlots(asm, l.bindings, scope)
+	if len(l.body) == 0 {
+		*asm += fmt.Sprintf(`
+	%s = add i64 1,0
+	`, symbol)
+		return
+	}
+	for indx, expr := range l.body {
+		resultSymbol := symbol
+		if indx != len(l.body)-1 {
+			resultSymbol = generateNextSymbol()
 		}
+		expr.Codegen(asm, resultSymbol, letScope)
+	}
+}
 
-		phiTrueLabel := basicBlockQueue[len(basicBlockQueue)-1]
-		basicBlockQueue = basicBlockQueue[:len(basicBlockQueue)-1]
-		var phiFalseLabel string
-		if len(basicBlockQueue) == 0 {
-			phiFalseLabel = "entry"
-		} else {
-
-			phiFalseLabel = basicBlockQueue[len(basicBlockQueue)-1]
-			basicBlockQueue = basicBlockQueue[:len(basicBlockQueue)-1]
-		}
+// bindSlots evaluates the initial values in scope and stores them in fresh
+// slots, the returned scope binds the names to the slots
+func bindSlots(asm *string, bindings []Binding, scope *CompilerScope) *CompilerScope {
+	inner := NewCompilerScope(scope)
+	for _, binding := range bindings {
+		initSymbol := generateNextSymbol()
+		binding.init.Codegen(asm, initSymbol, scope)
+		slot := allocaSlot()
 		*asm += fmt.Sprintf(`
-	%s:
-    %s = phi i64 [%s,%%%s],[0,%%%s]
-	`, ifLabel[2], symbol, trueSymbol, phiTrueLabel, phiFalseLabel)
-	} else {
-		if len(basicBlockQueue) == 0 {
-			panic("block queue cannot be empty")
-		}
+	store i64 %s, i64* %s, align 4
+	`, initSymbol, slot)
+		inner.inner[binding.name] = slot
+	}
+	return inner
+}
 
-		phiFalseLabel := basicBlockQueue[len(basicBlockQueue)-1]
-		basicBlockQueue = basicBlockQueue[:len(basicBlockQueue)-1]
-		if len(basicBlockQueue) == 0 {
-			panic("block queue cannot be empty")
+// The loop variables live in stack slots of their own, the steps are all
+// computed before any slot is written
+func (d *DoNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	defer markLocation(asm, d.Span)()
+	loopScope := bindSlots(asm, d.bindings, scope)
+	loopLabel := generateNextLoopLabel()
+	*asm += fmt.Sprintf(`
+	br label %%%s
+	`, loopLabel[0])
+	startBlock(asm, loopLabel[0])
+	testSymbol := generateNextSymbol()
+	d.test.Codegen(asm, testSymbol, loopScope)
+	*asm += fmt.Sprintf(`
+	br i1 %s,label %%%s,label %%%s
+	`, testSymbol, loopLabel[2], loopLabel[1])
+	startBlock(asm, loopLabel[1])
+	for _, expr := range d.body {
+		expr.Codegen(asm, generateNextSymbol(), loopScope)
+	}
+	steps := make(map[string]string)
+	for _, binding := range d.bindings {
+		if binding.step != nil {
+			steps[binding.name] = generateNextSymbol()
+			binding.step.Codegen(asm, steps[binding.name], loopScope)
 		}
-		phiTrueLabel := basicBlockQueue[len(basicBlockQueue)-1]
-		basicBlockQueue = basicBlockQueue[:len(basicBlockQueue)-1]
-
+	}
+	for _, binding := range d.bindings {
+		if step, ok := steps[binding.name]; ok {
+			*asm += fmt.Sprintf(`
+	store i64 %s, i64* %s, align 4
+	`, step, loopScope.inner[binding.name])
+		}
+	}
+	*asm += fmt.Sprintf(`
+	br label %%%s
+	`, loopLabel[0])
+	startBlock(asm, loopLabel[2])
+	if len(d.result) == 0 {
 		*asm += fmt.Sprintf(`
-	%s:
-    %s = phi i64 [%s,%%%s],[%s,%%%s]
-	`, ifLabel[2], symbol, trueSymbol, phiTrueLabel, falseSymbol, phiFalseLabel)
+	%s = add i64 1,0
+	`, symbol)
+		return
+	}
+	for indx, expr := range d.result {
+		resultSymbol := symbol
+		if indx != len(d.result)-1 {
+			resultSymbol = generateNextSymbol()
+		}
+		expr.Codegen(asm, resultSymbol, loopScope)
 	}
-	basicBlockQueue = append(basicBlockQueue, ifLabel[2])
 }
 
+// References point at an untagged machine integer so the syscalls can read
+// the bytes directly
 func (r *ReferenceNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
 	valueSymbol := generateNextSymbol()
+	untaggedSymbol := generateNextSymbol()
 	r.value.Codegen(asm, valueSymbol, scope)
+	slot := allocaSlot()
 	*asm += fmt.Sprintf(`
-	%s = alloca i64, align 4
+	%s = ashr i64 %s,1
 	store i64 %s,i64* %s,align 4
-	`, symbol, valueSymbol, symbol)
+	%s = getelementptr i64, i64* %s, i64 0
+	`, untaggedSymbol, valueSymbol, untaggedSymbol, slot, symbol, slot)
 }
 
 func (i *IntegerNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
-	*asm += fmt.Sprintf(`
-	%s = add i64 %d,0
-	`, symbol, i.value)
+	*asm += integerConstant(i.value, symbol)
+}
+
+func (f *FloatNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	*asm += floatConstant(f.value, symbol)
+}
+
+// Only numbers can be quoted in compiled code, lists and symbols exist in the
+// interpreter alone
+func (q *QuoteNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	switch datum := q.datum.(type) {
+	case Flonum:
+		*asm += floatConstant(datum, symbol)
+	case Fixnum, *Bignum:
+		*asm += integerConstant(datum, symbol)
+	default:
+		panic(fmt.Sprintf("quoted %s can not be compiled, lists and symbols only exist in the interpreter", datum))
+	}
+}
+
+func (q *QuasiquoteNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	panic("quasiquote can not be compiled, lists and symbols only exist in the interpreter")
+}
+
+func (m *MacroNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+}
+
+func (m *MacroCallNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	panic(fmt.Sprintf("macro %s was not expanded", m.macro.name))
+}
+
+func (i *ImportNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+}
+
+func (e *ExportNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
 }
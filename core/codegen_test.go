@@ -0,0 +1,561 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	runtimeObjectOnce sync.Once
+	runtimeObject     string
+	runtimeObjectErr  error
+)
+
+// buildRuntimeObject compiles the C runtime once per test binary so lli can
+// load it next to the generated module.
+func buildRuntimeObject(t *testing.T) string {
+	t.Helper()
+	runtimeObjectOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "lisp-runtime-test")
+		if err != nil {
+			runtimeObjectErr = err
+			return
+		}
+		runtimeObject = filepath.Join(dir, "lisp_runtime.o")
+		output, err := exec.Command("gcc", "-c", "-fPIC", "-o", runtimeObject, "runtime/lisp_runtime.c").CombinedOutput()
+		if err != nil {
+			runtimeObjectErr = fmt.Errorf("%s: %s", err, output)
+		}
+	})
+	if runtimeObjectErr != nil {
+		t.Fatal(runtimeObjectErr)
+	}
+	return runtimeObject
+}
+
+// runCompiled generates the module for input and runs it with lli, returning
+// the exit code (main's return value), stdout and stderr.
+func runCompiled(t *testing.T, input string) (int, string, string) {
+	t.Helper()
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runModule(t, lli, compileModule(expressions))
+}
+
+func compileModule(expressions []ASTNode) string {
+	asm := ""
+	scope := NewCompilerScope(nil)
+	scope.DeclareFunctions(expressions)
+	for _, expression := range expressions {
+		expression.Codegen(&asm, "%sym1", scope)
+		asm += "\n"
+	}
+	return asm + RuntimeSupport()
+}
+
+func runModule(t *testing.T, lli string, asm string, flags ...string) (int, string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found in PATH")
+	}
+	path := filepath.Join(t.TempDir(), "output.ll")
+	if err := os.WriteFile(path, []byte(asm), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	cmd := exec.Command(lli, append(append([]string{"-extra-object=" + buildRuntimeObject(t)}, flags...), path)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), stdout.String(), stderr.String()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stdout.String(), stderr.String()
+}
+
+// captureStdout returns what fn printed, print writes straight to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	fn()
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func TestCompiledDivisionMatchesInterpreter(t *testing.T) {
+	inputs := []string{
+		"(def main() (/ 7 2))",
+		"(def main() (+ (/ (- 0 7) 2) 10))",
+		"(def main() (- 10 1 2 3))",
+		"(def main() (+ (/ 1) (/ 5) (/ (- 0 1))))",
+		"(def main() (/ 100 2 5))",
+		"(def main() (+ (remainder (- 0 7) 2) 5))",
+		"(def main() (modulo (- 0 7) 2))",
+		"(def main() (+ (modulo 7 (- 0 2)) 5))",
+	}
+	for _, input := range inputs {
+		expected := evalProgram(t, input)
+		exitCode, _, stderr := runCompiled(t, input)
+		if Fixnum(exitCode) != expected {
+			t.Errorf("%s: interpreter returned %s, compiled code %d (%s)", input, expected, exitCode, stderr)
+		}
+	}
+}
+
+func TestCompiledDivisionByZeroTraps(t *testing.T) {
+	_, _, stderr := runCompiled(t, "(def div (a b) (/ a b)) (def main() (div 1 0))")
+	if !strings.Contains(stderr, "runtime error: division by zero") {
+		t.Errorf("Expected division by zero message, got %q", stderr)
+	}
+}
+
+func TestCompiledCheckOverflowTraps(t *testing.T) {
+	CheckOverflow = true
+	defer func() { CheckOverflow = false }()
+	_, _, stderr := runCompiled(t, "(def main() (* 4611686018427387904 2))")
+	if !strings.Contains(stderr, "runtime error: integer overflow") {
+		t.Errorf("Expected integer overflow message, got %q", stderr)
+	}
+}
+
+func TestCompiledBignumsMatchInterpreter(t *testing.T) {
+	fact := "(def fact (n) (if (< n 2) 1 (* n (fact (- n 1)))))"
+	expressions := []string{
+		"(fact 25)",
+		"(/ (fact 30) (fact 28))",
+		"(- (fact 21) (fact 21) 5)",
+		"(+ 4611686018427387903 1)",
+		"(- (- 0 4611686018427387904) 1)",
+		"(* (- 0 4611686018427387904) (- 0 4611686018427387904))",
+		"123456789012345678901234567890",
+		"(/ (- 0 4611686018427387904) (- 0 1))",
+		"(modulo (- 0 100000000000000000000) 7)",
+		"(remainder (- 0 100000000000000000000) 7)",
+		"(modulo (+ (fact 22) 1) (- 0 23))",
+		"(if (< 99999999999999999999 100000000000000000000) 1 0)",
+		"(if (= (fact 23) (* 23 (fact 22))) 1 0)",
+	}
+	for _, expression := range expressions {
+		input := fact + "(def main() (print " + expression + ") 0)"
+		expected := evalProgram(t, fact+"(def main() "+expression+")")
+		_, stdout, stderr := runCompiled(t, input)
+		if strings.TrimSpace(stdout) != expected.String() {
+			t.Errorf("%s: interpreter returned %s, compiled code printed %q (%s)", expression, expected, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledFloatsMatchInterpreter(t *testing.T) {
+	expressions := []string{
+		"3.14",
+		"1e-9",
+		"2.5e3",
+		"1234567.0",
+		"0.0001",
+		"(/ 1 3.0)",
+		"(+ 1 2.5)",
+		"(* 2 0.5)",
+		"(- 1 0.25)",
+		"(/ 7 2.0)",
+		"(/ 4.0)",
+		"(/ 1.0 0)",
+		"(/ (- 0 1.0) 0)",
+		"(- 0 0.0)",
+		"(+ 100000000000000000000 0.5)",
+		"(remainder (- 0 7.5) 2)",
+		"(modulo (- 0 7.5) 2)",
+		"(modulo 7.5 (- 0 2))",
+		"(exact->inexact 3)",
+		"(exact->inexact 123456789012345678901234567890)",
+		"(floor 2.7)",
+		"(floor (- 0 2.5))",
+		"(floor 7)",
+		"(round 2.5)",
+		"(round 3.5)",
+		"(sqrt 16)",
+		"(sqrt 2)",
+		"(sqrt (- 0 1))",
+		"(if (< 1 1.5) 1 0)",
+		"(if (> 100000000000000000000 1e19) 1 0)",
+		"(if (= 2 2.0) 1 0)",
+		"(if (= (sqrt (- 0 1)) (sqrt (- 0 1))) 1 0)",
+	}
+	for _, expression := range expressions {
+		expected := evalProgram(t, "(def main() "+expression+")")
+		_, stdout, stderr := runCompiled(t, "(def main() (print "+expression+") 0)")
+		if strings.TrimSpace(stdout) != expected.String() {
+			t.Errorf("%s: interpreter returned %s, compiled code printed %q (%s)", expression, expected, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledNegationMatchesInterpreter(t *testing.T) {
+	expressions := []string{
+		"-5",
+		"(- 5)",
+		"(- -5)",
+		"(- 2.5)",
+		"(- 0.0)",
+		"(- -4611686018427387904)",
+		"(- 123456789012345678901234567890)",
+		"#x-1F",
+		"(+ #b101 1_000 #d-1)",
+	}
+	for _, expression := range expressions {
+		expected := evalProgram(t, "(def main() "+expression+")")
+		_, stdout, stderr := runCompiled(t, "(def main() (print "+expression+") 0)")
+		if strings.TrimSpace(stdout) != expected.String() {
+			t.Errorf("%s: interpreter returned %s, compiled code printed %q (%s)", expression, expected, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledGlobalsMatchInterpreter(t *testing.T) {
+	inputs := []string{
+		"(define x 5) (def main() (print (+ x 1)) 0)",
+		"(define x 5) (define y (* x 2)) (def main() (print y) 0)",
+		"(define x 1.5) (def main() (print (+ x 1)) 0)",
+		"(define big (* 4611686018427387904 4)) (def main() (print big) 0)",
+		"(define x 5) (def get() x) (def shadow(x) (get)) (def main() (print (shadow 100)) 0)",
+		"(def twice(x) (* x 2)) (define y (twice 21)) (def main() (print y) 0)",
+		"(define first (print 1)) (define second (print 2)) (def main() (print (+ first second)) 0)",
+		"(define x (if (< 1 2) 10 20)) (def main() (print x) 0)",
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledLoopsMatchInterpreter(t *testing.T) {
+	inputs := []string{
+		"(def main() (print (do ((i 0 (+ i 1)) (sum 0 (+ sum i))) ((= i 5) sum))) 0)",
+		"(def main() (print (do ((a 0 b) (b 1 (+ a b)) (n 0 (+ n 1))) ((= n 100) a))) 0)",
+		"(def count(n) (while (< n 10) (set! n (+ n 3))) n) (def main() (print (count 0)) 0)",
+		"(define total 0) (def add(x) (set! total (+ total x))) (def main() (add 5) (add 6) (print total) 0)",
+		"(define x 1) (def bump(x) (set! x 5)) (def main() (bump x) (print x) 0)",
+		// Ifs and loops nested in each other need the phi nodes to name the right blocks
+		"(def main() (print (do ((i 0 (+ i 1)) (odd 0)) ((= i 7) odd) (if (= (modulo i 2) 1) (set! odd (+ odd 1))))) 0)",
+		"(def main() (print (if (< 1 2) (do ((i 0 (+ i 1))) ((= i 3) i)) 7)) 0)",
+		"(def main() (print (+ (if (> 1 2) 1) (if (< 1 2) (if (< 2 3) 5 6)))) 0)",
+		"(def main() (print (do ((i 0 (+ i 1)) (j 0 (do ((k 0 (+ k 1))) ((= k i) (+ j k))))) ((= i 10) j))) 0)",
+		"(def main() (print (while (< 1 0) 5)) 0)",
+		"(define x 1) (def main() (print (let ((x 10) (y x)) (+ x y))) (print x) 0)",
+		"(def main() (print (let ((x 1)) (set! x (+ x 1)) x)) (print (let ((x 1)))) 0)",
+		"(def main() (print (do ((i 0 (+ i 1)) (sum 0 (let ((sq (* i i))) (+ sum sq)))) ((= i 4) sum))) 0)",
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledReferenceInLoop(t *testing.T) {
+	// Slots are allocated in the entry block, a reference in a hot loop must
+	// not grow the stack
+	exitCode, stdout, stderr := runCompiled(t, "(def main() (do ((i 0 (+ i 1))) ((= i 2000000) (print i)) &i) 0)")
+	if exitCode != 0 || stdout != "2000000\n" {
+		t.Errorf("Expected the loop to finish, got exit code %d, %q (%s)", exitCode, stdout, stderr)
+	}
+}
+
+func TestCompiledForwardReferences(t *testing.T) {
+	mutualRecursion := "(def is_even(n) (if (= n 0) 1 (is_odd (- n 1)))) (def is_odd(n) (if (= n 0) 0 (is_even (- n 1))))"
+	inputs := []string{
+		"(def main() (print (later 4)) 0) (def later(x) (* x 10))",
+		mutualRecursion + " (def main() (print (is_even 10)) (print (is_odd 7)) 0)",
+		"(def main() (print (is_even 7)) 0) " + mutualRecursion,
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+	for _, input := range []string{"(def f() 1) (def f() 2)", "(def main() (f 1 2)) (def f(x) x)"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected compiling %s to panic", input)
+				}
+			}()
+			expressions, err := NewParser(input).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			asm := ""
+			scope := NewCompilerScope(nil)
+			scope.DeclareFunctions(expressions)
+			for _, expression := range expressions {
+				expression.Codegen(&asm, "%sym1", scope)
+			}
+		}()
+	}
+}
+
+func TestCompiledUnboxedFloats(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	input := `(def norm(x y) (sqrt (+ (* x x) (* y y))))
+(def mean(a b c) (/ (+ a b c) 3.0))
+(def main()
+  (print (norm 3.0 4.0))
+  (print (- (mean 1.0 2.5 4.0)))
+  (print (floor (* 2.5 1.5)))
+  (if (< (norm 1.0 1.0) 1.5) (print 1) (print 0))
+  (print (/ 7 2 2.0))
+  (print (+ 1 2.5))
+  (print (/ (norm 3.0 4.0)))
+  0)`
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, diagnostics := InferTypes(expressions)
+	if len(diagnostics) != 0 {
+		t.Fatal(diagnostics)
+	}
+	InferredTypes = types
+	defer func() { InferredTypes = nil }()
+	asm := compileModule(expressions)
+	for _, instruction := range []string{"fmul double", "fadd double", "fdiv double", "fneg double", "fcmp olt double", "@llvm.sqrt.f64(double"} {
+		if !strings.Contains(asm, instruction) {
+			t.Errorf("Expected the typed module to use %s", instruction)
+		}
+	}
+	interpreted := captureStdout(t, func() { evalProgram(t, input) })
+	_, stdout, stderr := runModule(t, lli, asm)
+	if stdout != interpreted {
+		t.Errorf("Interpreter printed %q, compiled code printed %q (%s)", interpreted, stdout, stderr)
+	}
+}
+
+func TestCompiledTypeAnnotations(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	input := `(def add((a : int) (b : int)) : int (+ a b))
+(def scale((x : float) (k : float)) : float (* x k))
+(def twice((n : int)) (* n 2))
+(def main() : int
+  (print (add 2 3))
+  (print (scale 1.5 (scale 2.0 2.0)))
+  (print (twice -4))
+  0)`
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, diagnostics := InferTypes(expressions)
+	if len(diagnostics) != 0 {
+		t.Fatal(diagnostics)
+	}
+	InferredTypes = types
+	defer func() { InferredTypes = nil }()
+	asm := compileModule(expressions)
+	for _, signature := range []string{"define i64 @add(i64 %a,i64 %b)", "define double @scale(double %x,double %k)", "define i64 @twice(i64 %n)", "call double @scale(double 0x4000000000000000,double 0x4000000000000000)"} {
+		if !strings.Contains(asm, signature) {
+			t.Errorf("Expected the module to contain %s", signature)
+		}
+	}
+	interpreted := captureStdout(t, func() { evalProgram(t, input) })
+	_, stdout, stderr := runModule(t, lli, asm)
+	if stdout != interpreted {
+		t.Errorf("Interpreter printed %q, compiled code printed %q (%s)", interpreted, stdout, stderr)
+	}
+}
+
+func TestCompiledForeignFunctionsMatchInterpreter(t *testing.T) {
+	inputs := []string{
+		"(extern puts (ptr) i32) (def main() (print (puts \"hello\\tworld\")) 0)",
+		"(extern putchar (i32) i32) (def main() (putchar 72) (putchar 10) (print (putchar 321)) 0)",
+		"(extern labs (i64) i64) (extern abs (i32) i32) (def main() (print (labs -5)) (print (abs 4294967295)) (print (labs -4611686018427387905)) 0)",
+		"(extern pow (double double) double) (extern cos (double) double) (def main() (print (pow 2 0.5)) (print (cos 0)) 0)",
+		"(extern strlen (ptr) i64) (def main() (print (strlen \"four\")) 0)",
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+	// The interpreter has no stand-in for a function taking a C float
+	if _, stdout, stderr := runCompiled(t, "(extern cosf (float) float) (def main() (print (cosf 0)) 0)"); stdout != "1.0\n" {
+		t.Errorf("Expected (cosf 0) to print 1.0, got %q (%s)", stdout, stderr)
+	}
+}
+
+func TestCompiledMacrosMatchInterpreter(t *testing.T) {
+	inputs := []string{
+		"(def sign(x) (cond ((< x 0) -1) ((= x 0) 0) (else 1))) (def main() (print (sign -5)) (print (sign 0)) (print (sign 3)) 0)",
+		"(def main() (let ((tmp 1) (other 2)) (swap! tmp other) (print tmp) (print other)) (when (< 1 2) (print 3)) (unless (< 1 2) (print 4)) 0)",
+		"(defmacro inc! (x) `(set! ,x (+ ,x 1))) (def main() (let ((i 0)) (while (< i 5) (inc! i)) (print i)) (print '2.5) 0)",
+	}
+	for _, input := range inputs {
+		input = testMacros + input
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledErrorHandlingMatchesInterpreter(t *testing.T) {
+	inputs := []string{
+		"(def safe(a b) (catch (/ a b) -1)) (def main() (print (safe 10 2)) (print (safe 10 0)) 0)",
+		"(def check(x) (if (< x 0) (error \"negative\" x) x)) (def twice(x) (* 2 (check x))) (def main() (print (guard (e (+ e 100)) (twice 5))) (print (guard (e (+ e 100)) (twice -7))) 0)",
+		"(def main() (print (catch (dynamic-wind (print 1) (error \"stop\") (print 3)) 42)) (print (dynamic-wind (print 4) 5 (print 6))) 0)",
+		"(def main() (print (guard (e e) (catch (error \"inner\" 5) (error \"outer\" 6)))) 0)",
+		"(def half((x : float)) : float (if (< x 0.0) (error \"negative\" x) (/ x 2.0))) (def main() (print (guard (e e) (half -3.0))) (print (catch (half 3.0) 0.0)) 0)",
+		"(def main() (let ((i 0)) (while (< i 3) (print (catch (/ 6 (- i 1)) 99)) (set! i (+ i 1)))) 0)",
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		_, stdout, stderr := runCompiled(t, input)
+		if stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", input, interpreted, stdout, stderr)
+		}
+	}
+}
+
+func TestCompiledUncaughtErrorTraps(t *testing.T) {
+	_, stdout, stderr := runCompiled(t, "(def main() (print 1) (dynamic-wind 0 (error \"bad input\" 1 2.5) (print 2)) 0)")
+	if stdout != "1\n2\n" || !strings.Contains(stderr, "runtime error: bad input 1 2.5") {
+		t.Errorf("Expected the cleanup to run before the error is reported, got %q and %q", stdout, stderr)
+	}
+}
+
+func TestJITEntryPrintsMainsValue(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	inputs := []string{
+		"(def main() (print 1) 42)",
+		"(define g (* 3 4)) (def main() (/ g 8.0))",
+		"(def main() (* 4611686018427387904 4))",
+	}
+	for _, input := range inputs {
+		expressions, err := NewParser(input).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value Value
+		interpreted := captureStdout(t, func() { value = evalProgram(t, input) }) + fmt.Sprintln(value)
+		status, stdout, stderr := runModule(t, lli, compileModule(expressions)+JITEntry, "-entry-function=lisp_jit_main")
+		if status != 0 || stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, jit printed %q and exited with %d (%s)", input, interpreted, stdout, status, stderr)
+		}
+	}
+}
+
+func TestCompiledDebugInfo(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	input := "(def fib(n)\n  (if (< n 2)\n      n\n      (+ (fib (- n 1))\n         (fib (- n 2)))))\n(def main() (print (fib 10)) 0)"
+	dir := writeModules(t, map[string]string{"main.lisp": input})
+	program, err := loadModules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DebugInfo = true
+	defer func() { DebugInfo = false }()
+	asm := CodegenUnit(program, nil, &Unit{Main: true, Source: program[0].(*FunctionNode).Source, Program: program})
+	for _, expected := range []string{
+		`define i64 @fib(i64 %n) !dbg`,
+		`distinct !DISubprogram(name: "fib", linkageName: "fib"`,
+		`!DIFile(filename: "main.lisp", directory: ` + fmt.Sprintf("%q", dir),
+		`!DILocalVariable(name: "n", arg: 1`,
+		`!DILocation(line: 4, column: 10`,
+		`!DILocation(line: 5, column: 10`,
+	} {
+		if !strings.Contains(asm, expected) {
+			t.Errorf("Expected %s in\n%s", expected, asm)
+		}
+	}
+	if strings.Contains(asm, "; "+dir) {
+		t.Errorf("Expected no annotations without --annotate, got\n%s", asm)
+	}
+	// lli verifies the module, debug information that doesn't fit the code is an error
+	if code, stdout, stderr := runModule(t, lli, asm); code != 0 || stdout != "55\n" {
+		t.Errorf("Expected 55, got %d %q %q", code, stdout, stderr)
+	}
+}
+
+func TestAnnotatedIR(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	input := "(def fib(n)\n  (if (< n 2)\n      n\n      (+ (fib (- n 1))\n         (fib (- n 2)))))\n(def main() (print (fib 10)) 0)"
+	dir := writeModules(t, map[string]string{"main.lisp": input})
+	program, err := loadModules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Annotate = true
+	defer func() { Annotate = false }()
+	asm := CodegenUnit(program, nil, &Unit{Main: true, Source: program[0].(*FunctionNode).Source, Program: program})
+	path := filepath.Join(dir, "main.lisp")
+	for _, expected := range []string{
+		"; " + path + ":1:1 (def fib(n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))\ndefine i64 @fib",
+		"; " + path + ":4:10 (fib (- n 1))\n  %sym",
+		"; " + path + ":6:13 (print (fib 10))",
+	} {
+		if !strings.Contains(asm, expected) {
+			t.Errorf("Expected %q in\n%s", expected, asm)
+		}
+	}
+	lines := strings.Split(asm, "\n")
+	for indx, line := range lines {
+		if strings.Contains(line, "call i64 @fib(") {
+			source, ok := SourceOfLine(asm, indx+1)
+			if expected := path + ":4:10 (fib (- n 1))"; source != expected || !ok {
+				t.Errorf("Expected line %d to come from %s, got %q", indx+1, expected, source)
+			}
+			break
+		}
+	}
+	if code, stdout, stderr := runModule(t, lli, asm); code != 0 || stdout != "55\n" {
+		t.Errorf("Expected 55, got %d %q %q", code, stdout, stderr)
+	}
+}
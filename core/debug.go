@@ -0,0 +1,263 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DebugInfo makes compile emit DWARF debug information, set by -g
+var DebugInfo = false
+
+// debugNodes holds the debug metadata of the unit being generated, it is nil
+// when DebugInfo is off
+var debugNodes *debugMetadata
+
+// debugFunction is the subprogram of the function being generated and
+// currentLocation the expression whose code is being generated in it
+var debugFunction *debugSubprogram
+var currentLocation Span
+
+// Annotate makes the generated IR say which expression every run of
+// instructions came from, `; file.lisp:12:5 (+ a b)`, set by --annotate
+var Annotate = false
+
+// annotatedSpans maps the annotations codegen leaves before the instructions
+// of an expression back to the expression, debug information is attached
+// through them. They are removed again unless the IR is annotated.
+var annotatedSpans = make(map[string]Span)
+
+type debugMetadata struct {
+	nodes []string
+	unit  string
+	files map[*SourceFile]string
+	types map[string]string
+	// declare is whether llvm.dbg.declare is called, it has to be declared
+	declare bool
+}
+
+type debugSubprogram struct {
+	id        string
+	source    *SourceFile
+	locations map[[2]int]string
+}
+
+func newDebugMetadata(source *SourceFile) *debugMetadata {
+	d := &debugMetadata{files: make(map[*SourceFile]string), types: make(map[string]string)}
+	d.unit = d.add(`distinct !DICompileUnit(language: DW_LANG_C99, file: %s, producer: "lisp-compiler", isOptimized: false, runtimeVersion: 0, emissionKind: FullDebug)`, d.file(source))
+	return d
+}
+
+// add appends a metadata node and returns its id, nodes can refer to ones
+// added later
+func (d *debugMetadata) add(format string, args ...any) string {
+	d.nodes = append(d.nodes, fmt.Sprintf(format, args...))
+	return fmt.Sprintf("!%d", len(d.nodes)-1)
+}
+
+func (d *debugMetadata) file(source *SourceFile) string {
+	if id, ok := d.files[source]; ok {
+		return id
+	}
+	// The prelude is embedded, it isn't necessarily where its path says
+	filename, directory := source.Path, ""
+	if path, err := filepath.Abs(source.Path); err == nil {
+		if _, err := os.Stat(path); err == nil {
+			filename, directory = filepath.Base(path), filepath.Dir(path)
+		}
+	}
+	d.files[source] = d.add(`!DIFile(filename: %q, directory: %q)`, filename, directory)
+	return d.files[source]
+}
+
+// debugType describes how values of llvmType are passed, tagged values are
+// shown as the 64 bit words they are
+func (d *debugMetadata) debugType(llvmType string) string {
+	if id, ok := d.types[llvmType]; ok {
+		return id
+	}
+	if llvmType == "double" {
+		d.types[llvmType] = d.add(`!DIBasicType(name: "double", size: 64, encoding: DW_ATE_float)`)
+	} else {
+		d.types[llvmType] = d.add(`!DIBasicType(name: "lisp_value", size: 64, encoding: DW_ATE_signed)`)
+	}
+	return d.types[llvmType]
+}
+
+// takeDebugMetadata is the module level metadata of the unit, appended to
+// its IR
+func takeDebugMetadata() string {
+	d := debugNodes
+	debugNodes = nil
+	if d == nil {
+		return ""
+	}
+	metadata := ""
+	if d.declare {
+		metadata += "declare void @llvm.dbg.declare(metadata, metadata, metadata)\n"
+	}
+	metadata += fmt.Sprintf(`!llvm.dbg.cu = !{%s}
+!llvm.module.flags = !{!%d, !%d}
+`, d.unit, len(d.nodes), len(d.nodes)+1)
+	for indx, node := range d.nodes {
+		metadata += fmt.Sprintf("!%d = %s\n", indx, node)
+	}
+	metadata += fmt.Sprintf(`!%d = !{i32 7, !"Dwarf Version", i32 4}
+!%d = !{i32 2, !"Debug Info Version", i32 3}
+`, len(d.nodes), len(d.nodes)+1)
+	return metadata
+}
+
+// startSubprogram describes f, the instructions of its body get locations in
+// it. Functions read without a source file get no debug information.
+func startSubprogram(f *FunctionNode) {
+	currentLocation = f.Span
+	if debugNodes == nil || f.Source == nil {
+		return
+	}
+	file := debugNodes.file(f.Source)
+	types := []string{debugNodes.debugType(llvmType(f.returnType))}
+	for indx := range f.arguments {
+		types = append(types, debugNodes.debugType(llvmType(f.parameterType(indx))))
+	}
+	line, _ := Position(f.Source.Input, f.Start)
+	subroutine := debugNodes.add(`!DISubroutineType(types: !{%s})`, strings.Join(types, ", "))
+	debugFunction = &debugSubprogram{source: f.Source, locations: make(map[[2]int]string)}
+	debugFunction.id = debugNodes.add(`distinct !DISubprogram(name: %q, linkageName: %q, scope: %s, file: %s, line: %d, type: %s, scopeLine: %d, spFlags: DISPFlagDefinition, unit: %s)`,
+		f.name, strings.Trim(llvmFunctionName(f.name), `"`), file, file, line, subroutine, line, debugNodes.unit)
+}
+
+// declareParameter describes the slot the indx'th parameter of f is kept in
+func declareParameter(asm *string, f *FunctionNode, indx int, slot string) {
+	if debugFunction == nil {
+		return
+	}
+	line, _ := Position(f.Source.Input, f.Start)
+	variable := debugNodes.add(`!DILocalVariable(name: %q, arg: %d, scope: %s, file: %s, line: %d, type: %s)`,
+		f.arguments[indx], indx+1, debugFunction.id, debugNodes.file(f.Source), line, debugNodes.debugType("i64"))
+	debugNodes.declare = true
+	*asm += fmt.Sprintf(`
+	call void @llvm.dbg.declare(metadata i64* %s, metadata %s, metadata !DIExpression())
+	`, slot, variable)
+}
+
+// markLocation marks the code generated after it as coming from span, the
+// function it returns marks the enclosing expression's code again
+func markLocation(asm *string, span Span) func() {
+	if span.Source == nil || (!Annotate && debugFunction == nil) {
+		return func() {}
+	}
+	enclosing := currentLocation
+	currentLocation = span
+	*asm += "\n\t" + annotation(span) + "\n\t"
+	return func() {
+		currentLocation = enclosing
+		if enclosing.Source != nil {
+			*asm += "\n\t" + annotation(enclosing) + "\n\t"
+		}
+	}
+}
+
+// annotation is the comment naming span's location and source text, long
+// expressions are cut short
+func annotation(span Span) string {
+	text := strings.Join(strings.Fields(span.Source.Input[span.Start:span.End]), " ")
+	if len(text) > 60 {
+		text = text[:57] + "..."
+	}
+	comment := fmt.Sprintf("; %s %s", spanLocation(span), text)
+	annotatedSpans[comment] = span
+	return comment
+}
+
+// attachLocations gives every instruction of a function's body the location
+// of the annotation before it, instructions before the first one are at the
+// function itself
+func attachLocations(body string, f *FunctionNode) string {
+	if debugFunction == nil {
+		return body
+	}
+	location := debugFunction.location(f.Start)
+	lines := strings.Split(body, "\n")
+	for indx, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if span, ok := annotatedSpans[trimmed]; ok {
+			if span.Source == debugFunction.source {
+				location = debugFunction.location(span.Start)
+			}
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, ";") || strings.HasSuffix(trimmed, ":") {
+			continue
+		}
+		lines[indx] = line + ", !dbg " + location
+	}
+	return strings.Join(lines, "\n")
+}
+
+// finishAnnotations removes the annotations from a unit's IR unless it is
+// annotated, in which case only the last of a run of annotations is kept
+func finishAnnotations(asm string) string {
+	lines := strings.Split(asm, "\n")
+	kept := make([]string, 0, len(lines))
+	pending := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if _, ok := annotatedSpans[trimmed]; ok {
+			if Annotate {
+				pending = line
+			}
+			continue
+		}
+		if pending != "" && trimmed != "" {
+			kept = append(kept, pending)
+			pending = ""
+		}
+		kept = append(kept, line)
+	}
+	annotatedSpans = make(map[string]Span)
+	return strings.Join(kept, "\n")
+}
+
+// SourceOfLine is the annotation of the expression line, counting from 1, of
+// annotated IR was generated for, without the comment's semicolon
+func SourceOfLine(asm string, line int) (string, bool) {
+	lines := strings.Split(asm, "\n")
+	for indx := min(line, len(lines)) - 1; indx >= 0; indx-- {
+		trimmed := strings.TrimSpace(lines[indx])
+		if trimmed == "}" {
+			break
+		}
+		if comment, ok := strings.CutPrefix(trimmed, "; "); ok && isAnnotation(comment) {
+			return comment, true
+		}
+	}
+	return "", false
+}
+
+// isAnnotation is whether comment starts with a path:line:col location
+func isAnnotation(comment string) bool {
+	location, _, _ := strings.Cut(comment, " ")
+	parts := strings.Split(location, ":")
+	if len(parts) < 3 {
+		return false
+	}
+	for _, part := range parts[len(parts)-2:] {
+		if _, err := strconv.Atoi(part); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *debugSubprogram) location(offset int) string {
+	line, column := Position(s.source.Input, offset)
+	key := [2]int{line, column}
+	if id, ok := s.locations[key]; ok {
+		return id
+	}
+	s.locations[key] = debugNodes.add(`!DILocation(line: %d, column: %d, scope: %s)`, line, column, s.id)
+	return s.locations[key]
+}
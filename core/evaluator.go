@@ -1,90 +1,217 @@
 package core
 
-import "fmt"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+var (
+	ErrDivisionByZero  = errors.New("division by zero")
+	ErrIntegerOverflow = errors.New("integer overflow")
+)
 
-func (i *IntegerNode) Eval(scope *InterpreterScope) int {
+func (i *IntegerNode) Eval(scope *InterpreterScope) Value {
 	return i.value
 }
 
-var BuiltinFuncMap = map[string]func([]int) int{
-	"+": builtinAdd,
-	"-": builtinSub,
-	"*": builtinMul,
-	"/": builtinDiv,
+func (f *FloatNode) Eval(scope *InterpreterScope) Value {
+	return f.value
 }
 
-func builtinAdd(nums []int) int {
+var BuiltinFuncMap = map[string]func([]Value) Value{
+	"+":              builtinAdd,
+	"-":              builtinSub,
+	"*":              builtinMul,
+	"/":              builtinDiv,
+	"%":              builtinRemainder,
+	"remainder":      builtinRemainder,
+	"modulo":         builtinModulo,
+	"print":          builtinPrint,
+	"exact->inexact": builtinExactToInexact,
+	"floor":          builtinFloor,
+	"round":          builtinRound,
+	"sqrt":           builtinSqrt,
+}
+
+func foldValues(nums []Value, op func(Value, Value) Value) Value {
 	sum := nums[0]
 	for _, number := range nums[1:] {
-		sum += number
+		sum = op(sum, number)
 	}
 	return sum
 }
 
-func builtinSub(nums []int) int {
-	sum := nums[0]
-	for _, number := range nums[1:] {
-		sum -= number
+func builtinAdd(nums []Value) Value {
+	return foldValues(nums, addValues)
+}
+
+// A single argument is negated, (- x)
+func builtinSub(nums []Value) Value {
+	if len(nums) == 1 {
+		return negateValue(nums[0])
 	}
-	return sum
+	return foldValues(nums, subValues)
 }
 
-func builtinMul(nums []int) int {
-	sum := nums[0]
-	for _, number := range nums[1:] {
-		sum *= number
+func builtinMul(nums []Value) Value {
+	return foldValues(nums, mulValues)
+}
+
+// A single argument is inverted, (/ x) is (/ 1 x)
+func builtinDiv(nums []Value) Value {
+	if len(nums) == 1 {
+		return divValues(Fixnum(1), nums[0])
 	}
-	return sum
+	return foldValues(nums, divValues)
 }
 
-func builtinDiv(nums []int) int {
-	sum := nums[0]
-	for _, number := range nums[1:] {
-		sum /= number
+func builtinRemainder(nums []Value) Value {
+	return remValues(binaryArguments("remainder", nums))
+}
+
+func builtinModulo(nums []Value) Value {
+	return modValues(binaryArguments("modulo", nums))
+}
+
+func builtinPrint(values []Value) Value {
+	fmt.Println(unaryArgument("print", values))
+	return values[0]
+}
+
+func builtinExactToInexact(values []Value) Value {
+	return Flonum(toFloat(unaryArgument("exact->inexact", values)))
+}
+
+// floor and round leave exact integers alone, round breaks ties to even
+func builtinFloor(values []Value) Value {
+	if float, ok := unaryArgument("floor", values).(Flonum); ok {
+		return Flonum(math.Floor(float64(float)))
 	}
-	return sum
+	return values[0]
+}
+
+func builtinRound(values []Value) Value {
+	if float, ok := unaryArgument("round", values).(Flonum); ok {
+		return Flonum(math.RoundToEven(float64(float)))
+	}
+	return values[0]
+}
+
+func builtinSqrt(values []Value) Value {
+	return Flonum(math.Sqrt(toFloat(unaryArgument("sqrt", values))))
 }
 
-func evalBuiltin(operand string, arguments []ASTNode, scope *InterpreterScope) int {
-	evaluatedArgs := make([]int, 0)
+func unaryArgument(name string, values []Value) Value {
+	if len(values) != 1 {
+		panic(fmt.Sprintf("Error: %s takes exactly one argument", name))
+	}
+	return values[0]
+}
+
+func binaryArguments(name string, values []Value) (Value, Value) {
+	if len(values) != 2 {
+		panic(fmt.Sprintf("Error: %s expects 2 arguments, got %d", name, len(values)))
+	}
+	return values[0], values[1]
+}
+
+func evalBuiltin(operand string, arguments []ASTNode, scope *InterpreterScope) Value {
+	evaluatedArgs := make([]Value, 0)
 	for _, arg := range arguments {
 		evaluatedArg := arg.Eval(scope)
 		evaluatedArgs = append(evaluatedArgs, evaluatedArg)
 	}
-	return BuiltinFuncMap[operand](evaluatedArgs)
+	// Check rejects these, but macros run before it does
+	builtin, ok := BuiltinFuncMap[operand]
+	if !ok && Includes(comparisionOps, operand) {
+		panic(fmt.Sprintf("Error: comparison %s can only be used as a condition", operand))
+	} else if !ok {
+		panic(fmt.Sprintf("Error: %s is not a function", operand))
+	}
+	if Includes(arithmeticOps, operand) && len(evaluatedArgs) == 0 {
+		panic(fmt.Sprintf("Error: %s expects at least one argument", operand))
+	}
+	return builtin(evaluatedArgs)
 }
 
-func applyFunction(function *FunctionNode, functionEnv *InterpreterScope) int {
-	value := 0
+// applyFunction runs the body of function on arguments, call is where it
+// was called from
+func applyFunction(function *FunctionNode, arguments []Value, call Span) Value {
+	functionEnv := NewInterpreterScope(function.scope)
+	for indx, argument := range arguments {
+		functionEnv.inner[function.arguments[indx]] = &IntegerNode{value: argument}
+	}
+	functionEnv.enter()
+	functionEnv.push(Frame{Function: function.name, Arguments: arguments, Span: call})
+	defer func() {
+		functionEnv.pop()
+		functionEnv.leave()
+	}()
+	var value Value = Fixnum(0)
 	for _, expr := range function.body {
 		value = expr.Eval(functionEnv)
 	}
 	return value
 }
 
-func (s *SExpr) Eval(scope *InterpreterScope) int {
+func (s *SExpr) Eval(scope *InterpreterScope) Value {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(scope.runtimeError(r, s.Span))
+		}
+	}()
+	scope.step()
+	if s.operand == "sys_write" {
+		return evalSystemCall(s, scope)
+	}
 	if Includes(builtInOperations, s.operand) {
-		return evalBuiltin(s.operand, s.arguments, scope)
+		return scope.allocated(evalBuiltin(s.operand, s.arguments, scope))
+	}
+	if builtin, ok := listBuiltins[s.operand]; ok && scope.get(s.operand) == nil {
+		evaluatedArgs := make([]Value, len(s.arguments))
+		for indx, arg := range s.arguments {
+			evaluatedArgs[indx] = arg.Eval(scope)
+		}
+		return scope.allocated(builtin(evaluatedArgs))
 	}
 	if scope.get(s.operand) == nil {
 		panic(fmt.Sprintf("%s not in scope", s.operand))
 	}
 	astNode := scope.get(s.operand)
+	switch callee := astNode.(type) {
+	case *ExternNode, *hostFunction:
+		evaluatedArgs := make([]Value, len(s.arguments))
+		for indx, arg := range s.arguments {
+			evaluatedArgs[indx] = arg.Eval(scope)
+		}
+		if extern, ok := callee.(*ExternNode); ok {
+			return extern.call(evaluatedArgs)
+		}
+		return callee.(*hostFunction).call(evaluatedArgs)
+	}
 	function, ok := astNode.(*FunctionNode)
 	if !ok {
-		panic("Expected function node,got some nonsense")
+		panic(fmt.Sprintf("Error: %s is not a function", s.operand))
 	}
-	extendedEnv := NewInterpreterScope(scope)
-	for indx := range s.arguments {
-		extendedEnv.inner[function.arguments[indx]] = &IntegerNode{value: s.arguments[indx].Eval(scope)}
+	// Arguments are evaluated by the caller, the body only sees the scope the
+	// function was defined in
+	if len(s.arguments) != len(function.arguments) {
+		panic(fmt.Sprintf("Error: %s expects %d arguments, got %d", s.operand, len(function.arguments), len(s.arguments)))
 	}
-
-	return applyFunction(function, extendedEnv)
+	evaluatedArgs := make([]Value, len(s.arguments))
+	for indx, arg := range s.arguments {
+		evaluatedArgs[indx] = arg.Eval(scope)
+	}
+	return applyFunction(function, evaluatedArgs, s.Span)
 }
 
-func (f *FunctionNode) Eval(scope *InterpreterScope) int {
+func (f *FunctionNode) Eval(scope *InterpreterScope) Value {
 	scope.inner[f.name] = f
-	value := 0
+	f.scope = scope
+	var value Value = Fixnum(0)
 	if f.name == "main" {
 		for _, expr := range f.body {
 			value = expr.Eval(scope)
@@ -93,10 +220,205 @@ func (f *FunctionNode) Eval(scope *InterpreterScope) int {
 	return value
 }
 
-func (r *ReferenceNode) Eval(scope *InterpreterScope) int {
+// Globals are evaluated once, in declaration order, and have to be defined
+// before the functions that use them are called
+func (d *DefineNode) Eval(scope *InterpreterScope) Value {
+	if scope.inner[d.name] != nil {
+		panic(fmt.Sprintf("Error: %s is already defined", d.name))
+	}
+	value := d.value.Eval(scope)
+	scope.inner[d.name] = &IntegerNode{value: value}
+	return value
+}
+
+// set! replaces the entry in whichever scope holds the binding, functions can
+// not be reassigned
+func (s *SetNode) Eval(scope *InterpreterScope) Value {
+	binding := scope.get(s.name)
+	if binding == nil {
+		panic(fmt.Sprintf("%s not in scope", s.name))
+	}
+	if _, ok := binding.(*FunctionNode); ok {
+		panic(fmt.Sprintf("Error: cannot set! function %s", s.name))
+	}
+	value := s.value.Eval(scope)
+	scope.set(s.name, &IntegerNode{value: value})
+	return value
+}
+
+func (w *WhileNode) Eval(scope *InterpreterScope) Value {
+	for evalCondition(w.condition, scope) {
+		scope.step()
+		for _, expr := range w.body {
+			expr.Eval(scope)
+		}
+	}
+	return Fixnum(0)
+}
+
+func (l *LetNode) Eval(scope *InterpreterScope) Value {
+	letScope := NewInterpreterScope(scope)
+	for _, binding := range l.bindings {
+		letScope.inner[binding.name] = &IntegerNode{value: binding.init.Eval(scope)}
+	}
+	var value Value = Fixnum(0)
+	for _, expr := range l.body {
+		value = expr.Eval(letScope)
+	}
+	return value
+}
+
+// The initial values are evaluated outside the loop and the steps are all
+// evaluated before any variable is updated
+func (d *DoNode) Eval(scope *InterpreterScope) Value {
+	loopScope := NewInterpreterScope(scope)
+	initial := make([]Value, len(d.bindings))
+	for indx, binding := range d.bindings {
+		initial[indx] = binding.init.Eval(scope)
+	}
+	for indx, binding := range d.bindings {
+		loopScope.inner[binding.name] = &IntegerNode{value: initial[indx]}
+	}
+	for !evalCondition(d.test, loopScope) {
+		scope.step()
+		for _, expr := range d.body {
+			expr.Eval(loopScope)
+		}
+		steps := make(map[string]Value)
+		for _, binding := range d.bindings {
+			if binding.step != nil {
+				steps[binding.name] = binding.step.Eval(loopScope)
+			}
+		}
+		for name, value := range steps {
+			loopScope.inner[name] = &IntegerNode{value: value}
+		}
+	}
+	var value Value = Fixnum(0)
+	for _, expr := range d.result {
+		value = expr.Eval(loopScope)
+	}
+	return value
+}
+
+func (q *QuoteNode) Eval(scope *InterpreterScope) Value {
+	return introduce(q.datum, scope.expansion)
+}
+
+func (q *QuasiquoteNode) Eval(scope *InterpreterScope) Value {
+	return fillTemplate(q.template, scope)
+}
+
+// fillTemplate evaluates the holes of a template, ,@ splices a list into the
+// one around it
+func fillTemplate(template Value, scope *InterpreterScope) Value {
+	switch template := template.(type) {
+	case *unquote:
+		if template.splice {
+			panic("Error: ,@ can only be used inside a list")
+		}
+		return template.expr.Eval(scope)
+	case List:
+		filled := List{}
+		for _, item := range template {
+			if hole, ok := item.(*unquote); ok && hole.splice {
+				filled = append(filled, toList(",@", hole.expr.Eval(scope))...)
+				continue
+			}
+			filled = append(filled, fillTemplate(item, scope))
+		}
+		return filled
+	}
+	return introduce(template, scope.expansion)
+}
+
+// Macros are gone once the program is expanded
+func (m *MacroNode) Eval(scope *InterpreterScope) Value {
+	return Fixnum(0)
+}
+
+func (m *MacroCallNode) Eval(scope *InterpreterScope) Value {
+	panic(fmt.Sprintf("macro %s was not expanded", m.macro.name))
+}
+
+// Imports and exports are gone once the modules are linked
+func (i *ImportNode) Eval(scope *InterpreterScope) Value {
+	return Fixnum(0)
+}
+
+func (e *ExportNode) Eval(scope *InterpreterScope) Value {
+	return Fixnum(0)
+}
+
+func (r *ReferenceNode) Eval(scope *InterpreterScope) Value {
 	panic("Interpreter does not support references")
 }
 
+// evalSystemCall writes the low bytes of the referenced integer, the way the
+// compiled code writes the word it stored. Like the compiled code it gives 0
+// when exactly one byte was written and the count otherwise.
+func evalSystemCall(s *SExpr, scope *InterpreterScope) Value {
+	if len(s.arguments) != 3 {
+		panic(fmt.Sprintf("Error: sys_write expects 3 arguments, got %d", len(s.arguments)))
+	}
+	reference, ok := s.arguments[1].(*ReferenceNode)
+	if !ok {
+		panic("Error: sys_write expects a reference")
+	}
+	files := map[int64]*os.File{1: os.Stdout, 2: os.Stderr}
+	fd, length := toBig(s.arguments[0].Eval(scope)).Int64(), toBig(s.arguments[2].Eval(scope)).Int64()
+	file, ok := files[fd]
+	if !ok {
+		panic(fmt.Sprintf("Error: sys_write can only write to 1 or 2, got %d", fd))
+	}
+	word := make([]byte, 8)
+	binary.LittleEndian.PutUint64(word, uint64(toBig(reference.value.Eval(scope)).Int64()))
+	if length > 8 {
+		length = 8
+	}
+	written, _ := file.Write(word[:length])
+	if written == 1 {
+		return Fixnum(0)
+	}
+	return Fixnum(written)
+}
+
+// DeclareFunctions binds every top level def before the program runs, so a
+// function can call ones defined further down the file
+func (s *InterpreterScope) DeclareFunctions(program []ASTNode) {
+	for _, node := range program {
+		if extern, ok := node.(*ExternNode); ok {
+			s.inner[extern.name] = extern
+		}
+		function, ok := node.(*FunctionNode)
+		if !ok {
+			continue
+		}
+		if s.inner[function.name] != nil {
+			panic(fmt.Sprintf("Error: function %s is already defined", function.name))
+		}
+		s.inner[function.name] = function
+		function.scope = s
+	}
+}
+
+// Run evaluates a whole program, the result is what main returned or the
+// value of the last expression when there is no main
+func (s *InterpreterScope) Run(program []ASTNode) Value {
+	s.DeclareFunctions(program)
+	var value, result Value
+	for _, node := range program {
+		value = node.Eval(s)
+		if function, ok := node.(*FunctionNode); ok && function.name == "main" {
+			result = value
+		}
+	}
+	if result == nil {
+		return value
+	}
+	return result
+}
+
 func (s *InterpreterScope) get(variable string) ASTNode {
 	if s.inner[variable] == nil {
 		if s.outer == nil {
@@ -107,6 +429,14 @@ func (s *InterpreterScope) get(variable string) ASTNode {
 	return s.inner[variable]
 }
 
+func (s *InterpreterScope) set(variable string, value ASTNode) {
+	if s.inner[variable] == nil && s.outer != nil {
+		s.outer.set(variable, value)
+		return
+	}
+	s.inner[variable] = value
+}
+
 func (s *CompilerScope) get(variable string) (string, error) {
 	inner, innerOk := s.inner[variable]
 	if !innerOk {
@@ -118,7 +448,7 @@ func (s *CompilerScope) get(variable string) (string, error) {
 	return inner, nil
 }
 
-func (i *IdentifierNode) Eval(scope *InterpreterScope) int {
+func (i *IdentifierNode) Eval(scope *InterpreterScope) Value {
 	if scope.get(i.name) == nil {
 		panic(fmt.Sprintf("Compiler error: %s not found in scope", i.name))
 	}
@@ -127,45 +457,32 @@ func (i *IdentifierNode) Eval(scope *InterpreterScope) int {
 
 var (
 	comparisionOps = []string{"<", ">", "="}
-	arithmeticOps  = []string{"+", "-", "*", "/", "%"}
+	arithmeticOps  = []string{"+", "-", "*", "/", "%", "modulo", "remainder"}
+	remainderOps   = []string{"%", "modulo", "remainder"}
+	numericOps     = []string{"exact->inexact", "floor", "round", "sqrt"}
 	systemCalls    = []string{"sys_write"}
 )
 
-func (i *IfNode) Eval(scope *InterpreterScope) int {
-	if !Includes(comparisionOps, i.condition.operand) {
+func evalCondition(condition *SExpr, scope *InterpreterScope) bool {
+	if Includes(listPredicates, condition.operand) {
+		return evalPredicate(condition, scope)
+	}
+	if !Includes(comparisionOps, condition.operand) {
 		panic("Should have a comparision operator in if condition")
 	}
-	if len(i.condition.arguments) != 2 {
+	if len(condition.arguments) != 2 {
 		panic("Conditional operators are binary")
 	}
-	var isCondTrue bool
-	switch i.condition.operand {
-	case "<":
-		isCondTrue = i.condition.arguments[0].Eval(scope) < i.condition.arguments[1].Eval(scope)
-		break
-	case ">":
-		isCondTrue = i.condition.arguments[0].Eval(scope) > i.condition.arguments[1].Eval(scope)
-		break
-	case "=":
-		isCondTrue = i.condition.arguments[0].Eval(scope) == i.condition.arguments[1].Eval(scope)
-		break
-	default:
-		panic("Error")
-	}
-	if isCondTrue {
+	return compareNumbers(condition.operand, condition.arguments[0].Eval(scope), condition.arguments[1].Eval(scope))
+}
+
+func (i *IfNode) Eval(scope *InterpreterScope) Value {
+	if evalCondition(i.condition, scope) {
 		return i.trueExpr.Eval(scope)
 	} else {
 		if i.falseExpr != nil {
 			return i.falseExpr.Eval(scope)
 		}
-		return 0
-	}
-}
-
-func getMidpointIndex[T any](arr []T) int {
-	if len(arr)%2 == 0 {
-		return len(arr) / 2
-	} else {
-		return (len(arr) + 1) / 2
+		return Fixnum(0)
 	}
 }
@@ -0,0 +1,409 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func evalProgram(t *testing.T, input string) Value {
+	t.Helper()
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewInterpreterScope(nil).Run(expressions)
+}
+
+func expectPanic(t *testing.T, expected error, fn func()) {
+	t.Helper()
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected panic with %v, got %v", expected, err)
+		}
+	}()
+	fn()
+}
+
+func TestDivisionSemantics(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated int
+	}
+	inputs := []TestCase{
+		{input: "(def main() (/ 7 2))", evaluated: 3},
+		{input: "(def main() (/ (- 0 7) 2))", evaluated: -3},
+		{input: "(def main() (/ 100 2 5))", evaluated: 10},
+		{input: "(def main() (- 10 1 2 3))", evaluated: 4},
+		{input: "(def main() (% 7 2))", evaluated: 1},
+		{input: "(def main() (remainder (- 0 7) 2))", evaluated: -1},
+		{input: "(def main() (remainder 7 (- 0 2)))", evaluated: 1},
+		{input: "(def main() (modulo (- 0 7) 2))", evaluated: 1},
+		{input: "(def main() (modulo 7 (- 0 2)))", evaluated: -1},
+		{input: "(def main() (modulo 6 3))", evaluated: 0},
+		{input: "(def main() (/ 5))", evaluated: 0},
+		{input: "(def main() (/ (- 0 1)))", evaluated: -1},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated != Fixnum(input.evaluated) {
+			t.Errorf("%s: expected %d, got %d", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	for _, input := range []string{"(/ 1 0)", "(/ 0)", "(% 1 0)", "(modulo 1 0)", "(remainder 1 0)"} {
+		expectPanic(t, ErrDivisionByZero, func() {
+			evalProgram(t, "(def main() "+input+")")
+		})
+	}
+}
+
+func TestCheckOverflow(t *testing.T) {
+	CheckOverflow = true
+	defer func() { CheckOverflow = false }()
+	inputs := []string{
+		"(+ 9223372036854775807 1)",
+		"(- (- 0 9223372036854775807) 2)",
+		"(* 4611686018427387904 2)",
+	}
+	for _, input := range inputs {
+		expectPanic(t, ErrIntegerOverflow, func() {
+			evalProgram(t, "(def main() "+input+")")
+		})
+	}
+	if evaluated := evalProgram(t, "(def main() (* 3037000499 3037000499))"); evaluated != Fixnum(9223372030926249001) {
+		t.Errorf("Expected 9223372030926249001, got %s", evaluated)
+	}
+}
+
+func TestBignumPromotion(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	fact := "(def fact (n) (if (< n 2) 1 (* n (fact (- n 1)))))"
+	inputs := []TestCase{
+		{input: fact + "(def main() (fact 25))", evaluated: "15511210043330985984000000"},
+		{input: fact + "(def main() (/ (fact 30) (fact 28)))", evaluated: "870"},
+		{input: fact + "(def main() (- (fact 21) (fact 21)))", evaluated: "0"},
+		{input: "(def main() (+ 9223372036854775807 1))", evaluated: "9223372036854775808"},
+		{input: "(def main() (- (- 0 9223372036854775807) 2))", evaluated: "-9223372036854775809"},
+		{input: "(def main() (* 4611686018427387904 4))", evaluated: "18446744073709551616"},
+		{input: "(def main() 123456789012345678901234567890)", evaluated: "123456789012345678901234567890"},
+		{input: "(def main() (modulo (- 0 100000000000000000000) 7))", evaluated: "5"},
+		{input: "(def main() (remainder (- 0 100000000000000000000) 7))", evaluated: "-2"},
+		{input: "(def main() (if (< 99999999999999999999 100000000000000000000) 1 0))", evaluated: "1"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+	if _, ok := evalProgram(t, fact+"(def main() (/ (fact 22) (fact 20)))").(Fixnum); !ok {
+		t.Errorf("Expected results that fit a machine word to be normalised to a Fixnum")
+	}
+}
+
+func TestFloatingPoint(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "3.14", evaluated: "3.14"},
+		{input: "1e-9", evaluated: "1e-09"},
+		{input: "2.5e3", evaluated: "2500.0"},
+		{input: "(+ 1 2.5)", evaluated: "3.5"},
+		{input: "(* 2 0.5)", evaluated: "1.0"},
+		{input: "(- 1 0.25)", evaluated: "0.75"},
+		{input: "(/ 7 2.0)", evaluated: "3.5"},
+		{input: "(/ 1.0 0)", evaluated: "+inf.0"},
+		{input: "(/ 7 2)", evaluated: "3"},
+		{input: "(+ 100000000000000000000 0.5)", evaluated: "1e+20"},
+		{input: "(remainder (- 0 7.5) 2)", evaluated: "-1.5"},
+		{input: "(modulo (- 0 7.5) 2)", evaluated: "0.5"},
+		{input: "(exact->inexact 3)", evaluated: "3.0"},
+		{input: "(floor 2.7)", evaluated: "2.0"},
+		{input: "(floor (- 0 2.5))", evaluated: "-3.0"},
+		{input: "(floor 7)", evaluated: "7"},
+		{input: "(round 2.5)", evaluated: "2.0"},
+		{input: "(round 3.5)", evaluated: "4.0"},
+		{input: "(sqrt 16)", evaluated: "4.0"},
+		{input: "(sqrt 2)", evaluated: "1.4142135623730951"},
+		{input: "(if (< 1 1.5) 1 0)", evaluated: "1"},
+		{input: "(if (= 2 2.0) 1 0)", evaluated: "1"},
+		{input: "(if (= (sqrt (- 0 1)) (sqrt (- 0 1))) 1 0)", evaluated: "0"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, "(def main() "+input.input+")"); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+func TestUnaryMinus(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def neg (x) (- x)) (def main() (neg 5))", evaluated: "-5"},
+		{input: "(def main() (- -5))", evaluated: "5"},
+		{input: "(def main() (- 2.5))", evaluated: "-2.5"},
+		{input: "(def main() (- 0.0))", evaluated: "-0.0"},
+		{input: "(def main() (- -9223372036854775808))", evaluated: "9223372036854775808"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+func TestGlobalDefines(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(define x 5) (def main() (+ x 1))", evaluated: "6"},
+		{input: "(define x 5) (define y (* x 2)) (def main() y)", evaluated: "10"},
+		{input: "(define x 5) (def get() x) (def main() (get))", evaluated: "5"},
+		{input: "(define x 1.5) (def main() (+ x 1))", evaluated: "2.5"},
+		{input: "(define big (* 4611686018427387904 4)) (def main() big)", evaluated: "18446744073709551616"},
+		// Arguments shadow globals, but only inside the function that declares them
+		{input: "(define x 5) (def get() x) (def shadow(x) (get)) (def main() (shadow 100))", evaluated: "5"},
+		{input: "(def twice(x) (* x 2)) (define y (twice 21)) (def main() y)", evaluated: "42"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected redefining a global to panic")
+		}
+	}()
+	evalProgram(t, "(define x 1) (define x 2)")
+}
+
+func TestLoopsAndAssignment(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def main() (do ((i 0 (+ i 1)) (sum 0 (+ sum i))) ((= i 5) sum)))", evaluated: "10"},
+		// The steps see the values from the previous iteration
+		{input: "(def main() (do ((a 0 b) (b 1 (+ a b)) (n 0 (+ n 1))) ((= n 10) a)))", evaluated: "55"},
+		{input: "(def main() (do ((i 0 (+ i 1))) ((= i 3))))", evaluated: "0"},
+		{input: "(def count(n) (while (< n 10) (set! n (+ n 3))) n) (def main() (count 0))", evaluated: "12"},
+		{input: "(define total 0) (def add(x) (set! total (+ total x))) (def main() (add 5) (add 6) total)", evaluated: "11"},
+		{input: "(def main() (do ((i 0 (+ i 1)) (odd 0)) ((= i 7) odd) (if (= (modulo i 2) 1) (set! odd (+ odd 1)))))", evaluated: "3"},
+		{input: "(def main() (while (< 1 0) 5))", evaluated: "0"},
+		// Assigning to an argument leaves the caller's binding alone
+		{input: "(define x 1) (def bump(x) (set! x 5)) (def main() (bump x) x)", evaluated: "1"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+func TestForwardReferences(t *testing.T) {
+	mutualRecursion := "(def is_even(n) (if (= n 0) 1 (is_odd (- n 1)))) (def is_odd(n) (if (= n 0) 0 (is_even (- n 1))))"
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def main() (later 4)) (def later(x) (* x 10))", evaluated: "40"},
+		{input: mutualRecursion + " (def main() (is_even 10))", evaluated: "1"},
+		{input: mutualRecursion + " (def main() (is_odd 7))", evaluated: "1"},
+		{input: "(def main() (is_even 7)) " + mutualRecursion, evaluated: "0"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+	for _, input := range []string{"(def f() 1) (def f() 2)", "(def f(x) x) (def main() (f 1 2))", "(def f(x y) x) (def main() (f 1))"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected %s to panic", input)
+				}
+			}()
+			evalProgram(t, input)
+		}()
+	}
+}
+
+func TestLet(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def main() (let ((x 2) (y 3)) (* x y)))", evaluated: "6"},
+		// The values are evaluated before any name is bound
+		{input: "(define x 1) (def main() (let ((x 10) (y x)) (+ x y)))", evaluated: "11"},
+		{input: "(def main() (let ((x 1)) (set! x (+ x 1)) x))", evaluated: "2"},
+		{input: "(def main() (let ((x 1))))", evaluated: "0"},
+		{input: "(define x 1) (def main() (let ((x 5)) x) x)", evaluated: "1"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+const testMacros = `(defmacro when (test . body) ` + "`" + `(if ,test (let () ,@body)))
+(defmacro unless (test . body) ` + "`" + `(if ,test 0 (let () ,@body)))
+(defmacro cond (. clauses)
+  (if (null? clauses)
+      0
+      (let ((clause (car clauses)))
+        (if (eq? (car clause) 'else)
+            ` + "`" + `(let () ,@(cdr clause))
+            ` + "`" + `(if ,(car clause) (let () ,@(cdr clause)) (cond ,@(cdr clauses)))))))
+(defmacro swap! (a b) ` + "`" + `(let ((tmp ,a)) (set! ,a ,b) (set! ,b tmp)))
+`
+
+func TestMacros(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def main() (when (< 1 2) 5 6))", evaluated: "6"},
+		{input: "(def main() (when (> 1 2) 5))", evaluated: "0"},
+		{input: "(def main() (unless (> 1 2) 7))", evaluated: "7"},
+		{input: "(def sign(x) (cond ((< x 0) -1) ((= x 0) 0) (else 1))) (def main() (+ (* 100 (sign -5)) (* 10 (sign 0)) (sign 9)))", evaluated: "-99"},
+		// The tmp the macro binds does not capture the caller's tmp
+		{input: "(def main() (let ((tmp 1) (other 2)) (swap! tmp other) (- (* 10 tmp) other)))", evaluated: "19"},
+		{input: "(def main() (let ((x 1) (y 2)) (swap! x y) (- (* 10 x) y)))", evaluated: "19"},
+		{input: "(defmacro square (x) `(* ,x ,x)) (def main() (square (square 3)))", evaluated: "81"},
+		{input: "(defmacro defconst (name value) `(define ,name ,value)) (defconst answer 42) (def main() answer)", evaluated: "42"},
+		{input: "(defmacro count (. args) (length args)) (def main() (count a (b c) 3))", evaluated: "3"},
+		{input: "(def main() '(a (b 2.5) c))", evaluated: "(a (b 2.5) c)"},
+		{input: "(def main() `(1 ,(+ 1 1) ,@(cdr '(0 3 4))))", evaluated: "(1 2 3 4)"},
+		{input: "(def main() (quote x))", evaluated: "x"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, testMacros+input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+}
+
+func TestRuntimeErrorTrace(t *testing.T) {
+	input := `(def inv (n) (/ 100 n))
+(def walk (n) (+ (inv n) (walk (- n 1))))
+(def main () (walk 2))`
+	parser := NewParser(input)
+	parser.source = &SourceFile{Path: "walk.lisp", Input: input}
+	expressions, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		runtimeErr, ok := recover().(*RuntimeError)
+		if !ok {
+			t.Fatalf("Expected a RuntimeError, got %v", runtimeErr)
+		}
+		expected := `walk.lisp:1:14: division by zero
+  in (inv 0) at walk.lisp:2:18
+  in (walk 0) at walk.lisp:2:26
+  in (walk 1) at walk.lisp:2:26
+  in (walk 2) at walk.lisp:3:14`
+		if trace := runtimeErr.Trace(); trace != expected {
+			t.Errorf("Expected trace\n%s\ngot\n%s", expected, trace)
+		}
+		if !errors.Is(runtimeErr, ErrDivisionByZero) {
+			t.Errorf("Expected %v to wrap ErrDivisionByZero", runtimeErr)
+		}
+	}()
+	NewInterpreterScope(nil).Run(expressions)
+}
+
+func TestRunLimitedReportsTheCalls(t *testing.T) {
+	input := `(def forever (n) (catch (forever (+ n 1)) 0))
+(def main () (forever 1))`
+	parser := NewParser(input)
+	parser.source = &SourceFile{Path: "forever.lisp", Input: input}
+	expressions, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		runtimeErr, ok := recover().(*RuntimeError)
+		if !ok {
+			t.Fatalf("Expected a RuntimeError, got %v", runtimeErr)
+		}
+		expected := `forever.lisp:1:25: call depth limit of 25 exceeded
+  in (forever 25) at forever.lisp:1:25
+  in (forever 24) at forever.lisp:1:25
+  in (forever 23) at forever.lisp:1:25
+  in (forever 22) at forever.lisp:1:25
+  in (forever 21) at forever.lisp:1:25
+  in (forever 20) at forever.lisp:1:25
+  in (forever 19) at forever.lisp:1:25
+  in (forever 18) at forever.lisp:1:25
+  in (forever 17) at forever.lisp:1:25
+  in (forever 16) at forever.lisp:1:25
+  ... 5 more calls
+  in (forever 10) at forever.lisp:1:25
+  in (forever 9) at forever.lisp:1:25
+  in (forever 8) at forever.lisp:1:25
+  in (forever 7) at forever.lisp:1:25
+  in (forever 6) at forever.lisp:1:25
+  in (forever 5) at forever.lisp:1:25
+  in (forever 4) at forever.lisp:1:25
+  in (forever 3) at forever.lisp:1:25
+  in (forever 2) at forever.lisp:1:25
+  in (forever 1) at forever.lisp:2:14`
+		if trace := runtimeErr.Trace(); trace != expected {
+			t.Errorf("Expected trace\n%s\ngot\n%s", expected, trace)
+		}
+		var limitErr *LimitExceeded
+		if !errors.As(runtimeErr, &limitErr) || limitErr.Limit != "call depth" {
+			t.Errorf("Expected %v to wrap the LimitExceeded", runtimeErr)
+		}
+	}()
+	// catch doesn't stop the limit
+	NewInterpreterScope(nil).RunLimited(expressions, Limits{MaxDepth: 25})
+}
+
+func TestErrorHandling(t *testing.T) {
+	type TestCase struct {
+		input     string
+		evaluated string
+	}
+	inputs := []TestCase{
+		{input: "(def main() (catch (/ 1 0) 7))", evaluated: "7"},
+		{input: "(def main() (catch (+ 1 2) 7))", evaluated: "3"},
+		{input: "(def check(x) (if (< x 0) (error \"negative\" x 2) x)) (def main() (guard (e (* e 10)) (check -4)))", evaluated: "-40"},
+		// Builtin errors and errors without irritants bind 0
+		{input: "(def main() (guard (e (+ e 1)) (error \"empty\")))", evaluated: "1"},
+		{input: "(def main() (guard (e e) (catch (error \"inner\" 1) (error \"outer\" 2))))", evaluated: "2"},
+		{input: "(define log 0) (def main() (catch (dynamic-wind (set! log 1) (/ 1 0) (set! log (+ log 10))) 0) log)", evaluated: "11"},
+		{input: "(def main() (dynamic-wind 1 2 3))", evaluated: "2"},
+	}
+	for _, input := range inputs {
+		if evaluated := evalProgram(t, input.input); evaluated.String() != input.evaluated {
+			t.Errorf("%s: expected %s, got %s", input.input, input.evaluated, evaluated)
+		}
+	}
+	defer func() {
+		runtimeErr, ok := recover().(*RuntimeError)
+		if !ok || runtimeErr.Message != "bad input 1 2.5" {
+			t.Errorf("Expected an uncaught error, got %v", runtimeErr)
+		}
+	}()
+	evalProgram(t, "(def main() (error \"bad input\" 1 2.5))")
+}
@@ -0,0 +1,281 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// cTypes maps the types an extern can use to their LLVM types. ptr is a
+// char * or any other pointer, void can only be returned.
+var cTypes = map[string]string{
+	"i8":     "i8",
+	"i16":    "i16",
+	"i32":    "i32",
+	"i64":    "i64",
+	"float":  "float",
+	"double": "double",
+	"ptr":    "i8*",
+	"void":   "void",
+}
+
+// ForeignFunctions stand in for C functions when a program is interpreted.
+// Arguments arrive converted to the C types the extern declares, integers as
+// Fixnums, floating point numbers as Flonums and strings as Strings, and the
+// result is converted back to the declared result type.
+var ForeignFunctions = map[string]func([]Value) Value{
+	// putchar returns the byte it wrote as an unsigned char
+	"putchar": func(values []Value) Value {
+		c := byte(toInt64(values[0]))
+		os.Stdout.Write([]byte{c})
+		return Fixnum(c)
+	},
+	// glibc's puts returns the number of bytes written
+	"puts": func(values []Value) Value {
+		s := foreignString("puts", values[0])
+		fmt.Fprintln(os.Stdout, s)
+		return Fixnum(len(s) + 1)
+	},
+	"strlen": func(values []Value) Value {
+		return Fixnum(len(foreignString("strlen", values[0])))
+	},
+	"abs":   foreignInteger(func(n int64) int64 { return max(n, -n) }),
+	"labs":  foreignInteger(func(n int64) int64 { return max(n, -n) }),
+	"llabs": foreignInteger(func(n int64) int64 { return max(n, -n) }),
+	"sin":   foreignDouble(math.Sin),
+	"cos":   foreignDouble(math.Cos),
+	"exp":   foreignDouble(math.Exp),
+	"log":   foreignDouble(math.Log),
+	"ceil":  foreignDouble(math.Ceil),
+	"pow": func(values []Value) Value {
+		return Flonum(math.Pow(toFloat(values[0]), toFloat(values[1])))
+	},
+	"exit": func(values []Value) Value {
+		os.Exit(int(toInt64(values[0])))
+		return Fixnum(0)
+	},
+}
+
+func foreignInteger(fn func(int64) int64) func([]Value) Value {
+	return func(values []Value) Value {
+		return Fixnum(fn(toInt64(values[0])))
+	}
+}
+
+func foreignDouble(fn func(float64) float64) func([]Value) Value {
+	return func(values []Value) Value {
+		return Flonum(fn(toFloat(values[0])))
+	}
+}
+
+func foreignString(name string, value Value) string {
+	s, ok := value.(String)
+	if !ok {
+		panic(fmt.Sprintf("Error: %s expects a string, got %s", name, value))
+	}
+	return string(s)
+}
+
+// toInt64 is the low 64 bits of an integer, flonums are truncated, the way
+// lisp_to_int64 converts arguments in compiled code
+func toInt64(value Value) int64 {
+	switch value := value.(type) {
+	case Fixnum:
+		return int64(value)
+	case Flonum:
+		return int64(value)
+	case *Bignum:
+		low := new(big.Int).And(new(big.Int).Abs(value.value), new(big.Int).SetUint64(math.MaxUint64)).Uint64()
+		if value.value.Sign() < 0 {
+			return -int64(low)
+		}
+		return int64(low)
+	}
+	panic(fmt.Sprintf("Error: expected an integer, got %s", value))
+}
+
+// truncateInteger wraps n around to the width of cType
+func truncateInteger(cType string, n int64) int64 {
+	switch cType {
+	case "i8":
+		return int64(int8(n))
+	case "i16":
+		return int64(int16(n))
+	case "i32":
+		return int64(int32(n))
+	}
+	return n
+}
+
+// cValue converts a value to cType, both for the arguments of a foreign
+// function and its result
+func cValue(cType string, value Value) Value {
+	switch cType {
+	case "void":
+		return Fixnum(0)
+	case "ptr":
+		if _, ok := value.(String); ok {
+			return value
+		}
+		return Fixnum(toInt64(value))
+	case "float":
+		return Flonum(float32(toFloat(value)))
+	case "double":
+		return Flonum(toFloat(value))
+	}
+	return Fixnum(truncateInteger(cType, toInt64(value)))
+}
+
+func (e *ExternNode) call(arguments []Value) Value {
+	standIn, ok := ForeignFunctions[e.name]
+	if !ok {
+		panic(fmt.Sprintf("Error: %s has no stand-in in the interpreter, compile the program to call it", e.name))
+	}
+	if len(arguments) != len(e.parameters) {
+		panic(fmt.Sprintf("Error: %s expects %d arguments, got %d", e.name, len(e.parameters), len(arguments)))
+	}
+	converted := make([]Value, len(arguments))
+	for indx, argument := range arguments {
+		converted[indx] = cValue(e.parameters[indx], argument)
+	}
+	return cValue(e.result, standIn(converted))
+}
+
+// Externs are bound before the program runs, like functions
+func (e *ExternNode) Eval(scope *InterpreterScope) Value {
+	scope.inner[e.name] = e
+	return Fixnum(0)
+}
+
+func (s *StringNode) Eval(scope *InterpreterScope) Value {
+	return String(s.value)
+}
+
+// externDeclaration declares a C function the first time the module uses it
+func externDeclaration(e *ExternNode) string {
+	if declaredExterns[e.name] {
+		return ""
+	}
+	declaredExterns[e.name] = true
+	parameters := make([]string, len(e.parameters))
+	for indx, parameter := range e.parameters {
+		parameters[indx] = cTypes[parameter]
+	}
+	return fmt.Sprintf("\ndeclare %s @%s(%s)\n", cTypes[e.result], llvmName(e.name), strings.Join(parameters, ", "))
+}
+
+func (e *ExternNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	*asm += externDeclaration(e)
+}
+
+func (s *StringNode) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	panic("Error: strings can only be passed to foreign functions")
+}
+
+// codegenForeignCall converts the arguments to the C types the extern
+// declares and the result back to a tagged value
+func codegenForeignCall(asm *string, s *SExpr, extern *ExternNode, symbol string, scope *CompilerScope) {
+	if len(s.arguments) != len(extern.parameters) {
+		panic(fmt.Sprintf("Error: %s expects %d arguments, got %d", s.operand, len(extern.parameters), len(s.arguments)))
+	}
+	arguments := make([]string, len(s.arguments))
+	for indx, arg := range s.arguments {
+		cType := cTypes[extern.parameters[indx]]
+		arguments[indx] = cType + " " + foreignArgument(asm, cType, arg, scope)
+	}
+	resultType := cTypes[extern.result]
+	call := fmt.Sprintf("call %s @%s(%s)", resultType, llvmName(extern.name), strings.Join(arguments, ", "))
+	if resultType == "void" {
+		*asm += fmt.Sprintf(`
+	%s
+	%s = add i64 1,0
+	`, call, symbol)
+		return
+	}
+	result := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = %s
+	`, result, call)
+	switch resultType {
+	case "double":
+		taggedFrom(asm, "double", result, symbol)
+	case "float":
+		extended := generateNextSymbol()
+		*asm += fmt.Sprintf(`
+	%s = fpext float %s to double
+	`, extended, result)
+		taggedFrom(asm, "double", extended, symbol)
+	default:
+		integer := result
+		if resultType == "i8*" {
+			integer = generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = ptrtoint i8* %s to i64
+	`, integer, result)
+		} else if resultType != "i64" {
+			integer = generateNextSymbol()
+			*asm += fmt.Sprintf(`
+	%s = sext %s %s to i64
+	`, integer, resultType, result)
+		}
+		*asm += fmt.Sprintf(`
+	%s = call i64 @lisp_from_int64(i64 %s)
+	`, symbol, integer)
+	}
+}
+
+// foreignArgument computes arg as cType, string literals become pointers to
+// constants and integers are truncated to the width of the type
+func foreignArgument(asm *string, cType string, arg ASTNode, scope *CompilerScope) string {
+	if str, ok := arg.(*StringNode); ok {
+		return stringConstant(str.value)
+	}
+	if cType == "double" || cType == "float" {
+		double := codegenDouble(asm, arg, scope)
+		if cType == "double" {
+			return double
+		}
+		truncated := generateNextSymbol()
+		*asm += fmt.Sprintf(`
+	%s = fptrunc double %s to float
+	`, truncated, double)
+		return truncated
+	}
+	tagged := generateNextSymbol()
+	arg.Codegen(asm, tagged, scope)
+	integer := generateNextSymbol()
+	*asm += fmt.Sprintf(`
+	%s = call i64 @lisp_to_int64(i64 %s)
+	`, integer, tagged)
+	if cType == "i64" {
+		return integer
+	}
+	converted := generateNextSymbol()
+	if cType == "i8*" {
+		*asm += fmt.Sprintf(`
+	%s = inttoptr i64 %s to i8*
+	`, converted, integer)
+	} else {
+		*asm += fmt.Sprintf(`
+	%s = trunc i64 %s to %s
+	`, converted, integer, cType)
+	}
+	return converted
+}
+
+// stringConstant is a pointer to a NUL terminated copy of s
+func stringConstant(s string) string {
+	name := generateNextConstant()
+	escaped := ""
+	for _, b := range []byte(s) {
+		if b < ' ' || b > '~' || b == '"' || b == '\\' {
+			escaped += fmt.Sprintf("\\%02X", b)
+		} else {
+			escaped += string(b)
+		}
+	}
+	globalConstants += fmt.Sprintf("%s = private unnamed_addr constant [%d x i8] c\"%s\\00\"\n", name, len(s)+1, escaped)
+	return fmt.Sprintf("getelementptr inbounds ([%d x i8], [%d x i8]* %s, i64 0, i64 0)", len(s)+1, len(s)+1, name)
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// TargetTriple is the target triple units are generated for, the host's by
+// default. It is left out of the IR when it is empty.
+var TargetTriple = hostTriple()
+
+func hostTriple() string {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		return "x86_64-pc-linux-gnu"
+	case "linux/arm64":
+		return "aarch64-unknown-linux-gnu"
+	case "darwin/amd64":
+		return "x86_64-apple-macosx"
+	case "darwin/arm64":
+		return "arm64-apple-macosx"
+	}
+	return ""
+}
+
+// moduleHeader names the unit's source file and the target
+func moduleHeader(unit *Unit) string {
+	header := ""
+	if unit.Source != nil {
+		header += fmt.Sprintf("; ModuleID = '%s'\nsource_filename = %q\n", unit.Source.Path, unit.Source.Path)
+	}
+	if TargetTriple != "" {
+		header += fmt.Sprintf("target triple = %q\n", TargetTriple)
+	}
+	return header
+}
+
+// generatedSymbol matches the values codegen numbers itself
+var generatedSymbol = regexp.MustCompile(`%sym[0-9]+\b`)
+
+// FormatIR lays generated IR out the way LLVM prints it: instructions are
+// indented by two spaces, labels aren't, and blank lines separate functions,
+// basic blocks and runs of declarations, globals and metadata. Operands are
+// separated by a comma and a space. The symbols of every function are
+// numbered from 1 in the order they appear, codegen skips the numbers of
+// symbols it didn't need.
+func FormatIR(asm string) string {
+	formatted := make([]string, 0)
+	inFunction := false
+	previousKind := ""
+	symbols := make(map[string]string)
+	renumber := func(symbol string) string {
+		if _, ok := symbols[symbol]; !ok {
+			symbols[symbol] = fmt.Sprintf("%%sym%d", len(symbols)+1)
+		}
+		return symbols[symbol]
+	}
+	for _, line := range strings.Split(asm, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if inFunction {
+			switch {
+			case line == "}":
+				formatted = append(formatted, line)
+				inFunction = false
+				previousKind = "}"
+			case strings.HasPrefix(line, ";"):
+				formatted = append(formatted, "  "+line)
+			case strings.HasSuffix(line, ":"):
+				if !strings.HasSuffix(formatted[len(formatted)-1], "{") {
+					formatted = append(formatted, "")
+				}
+				formatted = append(formatted, line)
+			default:
+				formatted = append(formatted, "  "+generatedSymbol.ReplaceAllStringFunc(formatOperands(line), renumber))
+			}
+			continue
+		}
+		kind := topLevelKind(line)
+		if len(formatted) > 0 && kind != previousKind && !(previousKind == ";" && kind == "define") {
+			formatted = append(formatted, "")
+		}
+		previousKind = kind
+		if kind == ";" {
+			formatted = append(formatted, line)
+			continue
+		}
+		line = formatOperands(line)
+		if kind == "define" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "{"), " ") + " {"
+			inFunction = true
+			symbols = make(map[string]string)
+		}
+		formatted = append(formatted, line)
+	}
+	return strings.Join(formatted, "\n") + "\n"
+}
+
+// topLevelKind groups the lines outside functions, a blank line goes
+// between lines of different kinds
+func topLevelKind(line string) string {
+	for _, kind := range []string{";", "define", "declare", "@", "!", "attributes"} {
+		if strings.HasPrefix(line, kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// formatOperands collapses the whitespace of an instruction and puts a
+// single space after every comma, leaving string literals as they are
+func formatOperands(line string) string {
+	var formatted strings.Builder
+	quoted := false
+	space := false
+	for indx := 0; indx < len(line); indx++ {
+		char := line[indx]
+		switch {
+		case quoted:
+			formatted.WriteByte(char)
+			if char == '\\' && indx+1 < len(line) {
+				indx++
+				formatted.WriteByte(line[indx])
+			} else if char == '"' {
+				quoted = false
+			}
+			continue
+		case char == ' ' || char == '\t':
+			space = true
+			continue
+		case char == ',':
+			formatted.WriteByte(char)
+			space = true
+			continue
+		}
+		if space && formatted.Len() > 0 {
+			formatted.WriteByte(' ')
+		}
+		space = false
+		quoted = char == '"'
+		formatted.WriteByte(char)
+	}
+	return formatted.String()
+}
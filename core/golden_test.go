@@ -0,0 +1,93 @@
+package core
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenIR loads path without the prelude and generates its IR for a fixed
+// target, so the output is the same on every host
+func goldenIR(t *testing.T, path string) string {
+	t.Helper()
+	input, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := NewLoader(nil)
+	loader.Prelude = false
+	program, err := loader.Load(path, string(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	triple := TargetTriple
+	TargetTriple = "x86_64-pc-linux-gnu"
+	defer func() { TargetTriple = triple }()
+	units := loader.Units()
+	return CodegenUnit(program, units, units[len(units)-1])
+}
+
+func TestGoldenIR(t *testing.T) {
+	paths, err := filepath.Glob("testdata/golden/*.lisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		golden := strings.TrimSuffix(path, ".lisp") + ".ll"
+		asm := goldenIR(t, path)
+		if *update {
+			if err := os.WriteFile(golden, []byte(asm), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asm != string(expected) {
+			t.Errorf("%s differs from %s, run go test ./core -run TestGoldenIR -update to accept it\n%s", path, golden, asm)
+		}
+	}
+}
+
+func TestIRIsDeterministic(t *testing.T) {
+	first := goldenIR(t, "testdata/golden/macros.lisp")
+	// Loading other programs in between mustn't change how expansions and
+	// constants are numbered
+	goldenIR(t, "testdata/golden/fib.lisp")
+	if _, err := NewParser("(defmacro twice (x) `(let ((y ,x)) (+ y y))) (twice (twice 1))").Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if second := goldenIR(t, "testdata/golden/macros.lisp"); first != second {
+		t.Errorf("Expected the same IR twice, got\n%s\nand\n%s", first, second)
+	}
+}
+
+func TestGoldenIRRuns(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	if hostTriple() != "x86_64-pc-linux-gnu" {
+		t.Skip("the golden files are generated for x86_64 linux")
+	}
+	for _, name := range []string{"fib", "loops", "errors"} {
+		path := filepath.Join("testdata/golden", name+".lisp")
+		interpreted := captureStdout(t, func() {
+			input, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evalProgram(t, string(input))
+		})
+		if _, stdout, stderr := runModule(t, lli, goldenIR(t, path)); stdout != interpreted {
+			t.Errorf("%s: interpreter printed %q, compiled code printed %q (%s)", path, interpreted, stdout, stderr)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// maxExpansionDepth stops macros that keep expanding into themselves
+const maxExpansionDepth = 100
+
+// expansionLimits bound the macros a parser without a budget of its own
+// runs, so a macro that loops or recurses forever fails to expand instead of
+// hanging Parse
+var expansionLimits = Limits{MaxDepth: 1000, MaxSteps: 1_000_000, MaxAllocations: 10_000_000}
+
+// Reader shorthands, (quote x) is printed back as 'x
+var quotePrefixes = map[string]string{
+	"quote":            "'",
+	"quasiquote":       "`",
+	"unquote":          ",",
+	"unquote-splicing": ",@",
+}
+
+// Lists only exist while macros run, these are the builtins macro bodies use
+// to take their arguments apart
+var listBuiltins = map[string]func([]Value) Value{
+	"car":    builtinCar,
+	"cdr":    builtinCdr,
+	"cons":   builtinCons,
+	"list":   builtinList,
+	"append": builtinAppend,
+	"length": builtinLength,
+}
+
+// Predicates on data are conditions, like comparisons
+var listPredicates = []string{"null?", "pair?", "symbol?", "eq?"}
+
+func toList(name string, value Value) List {
+	list, ok := value.(List)
+	if !ok {
+		panic(fmt.Sprintf("Error: %s expects a list, got %s", name, value))
+	}
+	return list
+}
+
+func builtinCar(values []Value) Value {
+	list := toList("car", unaryArgument("car", values))
+	if len(list) == 0 {
+		panic("Error: car of an empty list")
+	}
+	return list[0]
+}
+
+func builtinCdr(values []Value) Value {
+	list := toList("cdr", unaryArgument("cdr", values))
+	if len(list) == 0 {
+		panic("Error: cdr of an empty list")
+	}
+	return list[1:]
+}
+
+func builtinCons(values []Value) Value {
+	if len(values) != 2 {
+		panic("Error: cons takes exactly two arguments")
+	}
+	return append(List{values[0]}, toList("cons", values[1])...)
+}
+
+func builtinList(values []Value) Value {
+	return append(List{}, values...)
+}
+
+func builtinAppend(values []Value) Value {
+	result := List{}
+	for _, value := range values {
+		result = append(result, toList("append", value)...)
+	}
+	return result
+}
+
+func builtinLength(values []Value) Value {
+	return Fixnum(len(toList("length", unaryArgument("length", values))))
+}
+
+func evalPredicate(condition *SExpr, scope *InterpreterScope) bool {
+	arguments := make([]Value, len(condition.arguments))
+	for indx, arg := range condition.arguments {
+		arguments[indx] = arg.Eval(scope)
+	}
+	if condition.operand == "eq?" {
+		if len(arguments) != 2 {
+			panic("Error: eq? takes exactly two arguments")
+		}
+		return sameDatum(arguments[0], arguments[1])
+	}
+	value := unaryArgument(condition.operand, arguments)
+	switch condition.operand {
+	case "null?":
+		list, ok := value.(List)
+		return ok && len(list) == 0
+	case "pair?":
+		list, ok := value.(List)
+		return ok && len(list) > 0
+	}
+	_, ok := value.(Symbol)
+	return ok
+}
+
+// sameDatum compares symbols by name, whichever expansion they came from,
+// numbers by value and lists only when both are empty
+func sameDatum(a Value, b Value) bool {
+	switch a := a.(type) {
+	case Symbol:
+		symbol, ok := b.(Symbol)
+		return ok && a.name == symbol.name
+	case List:
+		list, ok := b.(List)
+		return ok && len(a) == 0 && len(list) == 0
+	}
+	_, aList := a.(List)
+	_, bSymbol := b.(Symbol)
+	_, bList := b.(List)
+	if aList || bSymbol || bList {
+		return false
+	}
+	return compareNumbers("=", a, b)
+}
+
+// introduce marks the symbols of a template with the running expansion
+func introduce(datum Value, expansion int) Value {
+	if expansion == 0 {
+		return datum
+	}
+	switch datum := datum.(type) {
+	case Symbol:
+		if datum.expansion == 0 {
+			datum.expansion = expansion
+		}
+		return datum
+	case List:
+		marked := make(List, len(datum))
+		for indx, item := range datum {
+			marked[indx] = introduce(item, expansion)
+		}
+		return marked
+	}
+	return datum
+}
+
+// expandProgram replaces every macro call with its expansion, the macro
+// definitions themselves are dropped since neither engine runs them
+func (p *Parser) expandProgram(program []ASTNode) []ASTNode {
+	expanded := make([]ASTNode, 0, len(program))
+	for _, node := range program {
+		if _, ok := node.(*MacroNode); ok {
+			continue
+		}
+		node = p.expand(node)
+		if _, ok := node.(*MacroNode); ok {
+			continue
+		}
+		expanded = append(expanded, node)
+	}
+	return expanded
+}
+
+func (p *Parser) expandAll(nodes []ASTNode) []ASTNode {
+	for indx, node := range nodes {
+		nodes[indx] = p.expand(node)
+	}
+	return nodes
+}
+
+func (p *Parser) expandBindings(bindings []Binding) {
+	for indx := range bindings {
+		bindings[indx].init = p.expand(bindings[indx].init)
+		if bindings[indx].step != nil {
+			bindings[indx].step = p.expand(bindings[indx].step)
+		}
+	}
+}
+
+// templateHoles lists the unquoted expressions of a template
+func templateHoles(template Value, holes []*unquote) []*unquote {
+	switch template := template.(type) {
+	case *unquote:
+		holes = append(holes, template)
+	case List:
+		for _, item := range template {
+			holes = templateHoles(item, holes)
+		}
+	}
+	return holes
+}
+
+// expand rewrites node in place, only a macro call is replaced outright
+func (p *Parser) expand(node ASTNode) ASTNode {
+	switch node := node.(type) {
+	case *MacroCallNode:
+		return p.expandCall(node)
+	case *SExpr:
+		p.expandAll(node.arguments)
+	case *FunctionNode:
+		p.expandAll(node.body)
+	case *DefineNode:
+		node.value = p.expand(node.value)
+	case *SetNode:
+		node.value = p.expand(node.value)
+	case *ReferenceNode:
+		node.value = p.expand(node.value)
+	case *IfNode:
+		p.expand(node.condition)
+		node.trueExpr = p.expand(node.trueExpr)
+		if node.falseExpr != nil {
+			node.falseExpr = p.expand(node.falseExpr)
+		}
+	case *WhileNode:
+		p.expand(node.condition)
+		p.expandAll(node.body)
+	case *DoNode:
+		p.expandBindings(node.bindings)
+		p.expand(node.test)
+		p.expandAll(node.result)
+		p.expandAll(node.body)
+	case *LetNode:
+		p.expandBindings(node.bindings)
+		p.expandAll(node.body)
+	case *ErrorNode:
+		p.expandAll(node.irritants)
+	case *CatchNode:
+		p.expandAll(node.body)
+		p.expandAll(node.handler)
+	case *WindNode:
+		node.before = p.expand(node.before)
+		node.body = p.expand(node.body)
+		node.after = p.expand(node.after)
+	case *QuasiquoteNode:
+		for _, hole := range templateHoles(node.template, nil) {
+			hole.expr = p.expand(hole.expr)
+		}
+	}
+	return node
+}
+
+func (p *Parser) expansionError(call *MacroCallNode, format string, args ...any) {
+	panic(&ParseError{Offset: call.Start, Message: fmt.Sprintf(format, args...), Source: call.Source})
+}
+
+// expandCall runs the macro on the data it was called with and reads the
+// result back as code. The expansion is read by its own parser so that the
+// nodes in it are reported at the call.
+func (p *Parser) expandCall(call *MacroCallNode) ASTNode {
+	macro := call.macro
+	if p.depth >= maxExpansionDepth {
+		p.expansionError(call, "expansion of %s is nested too deeply", macro.name)
+	}
+	if len(call.arguments) < len(macro.parameters) || (macro.rest == "" && len(call.arguments) > len(macro.parameters)) {
+		expected := fmt.Sprint(len(macro.parameters))
+		if macro.rest != "" {
+			expected = "at least " + expected
+		}
+		p.expansionError(call, "%s expects %s arguments, got %d", macro.name, expected, len(call.arguments))
+	}
+	scope := NewInterpreterScope(nil)
+	scope.budget = p.budget
+	if scope.budget == nil {
+		scope.budget = &budget{limits: expansionLimits}
+	}
+	for indx, parameter := range macro.parameters {
+		scope.inner[parameter] = &IntegerNode{value: call.arguments[indx]}
+	}
+	if macro.rest != "" {
+		scope.inner[macro.rest] = &IntegerNode{value: append(List{}, call.arguments[len(macro.parameters):]...)}
+	}
+	expansion := p.nextExpansion()
+	scope.expansion = expansion
+	result := p.runMacro(call, scope)
+	source := datumSource(result, boundNames(result, expansion, nil), expansion)
+
+	expander := NewParser(source)
+	expander.macros = p.macros
+	expander.expansion = &call.Span
+	expander.depth = p.depth + 1
+	expander.nesting = p.nesting
+	expander.budget = p.budget
+	expander.nextExpansion = p.nextExpansion
+	expander.formStart = -1
+	if call.topLevel {
+		expander.formStart = 0
+	}
+	node := expander.readExpansion(call, source)
+	return expander.expand(node)
+}
+
+func (p *Parser) runMacro(call *MacroCallNode, scope *InterpreterScope) (result Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			if runtimeErr, ok := r.(*RuntimeError); ok {
+				r = runtimeErr.cause
+			}
+			if parseErr, ok := r.(*ParseError); ok {
+				panic(parseErr)
+			}
+			// The limits of the run the parser belongs to stop it, only the
+			// default ones are the expansion's failure
+			if _, ok := r.(runtime.Error); !ok && p.budget != nil {
+				if err, ok := r.(error); ok && (errors.As(err, new(*LimitExceeded)) || errors.Is(err, context.Canceled)) {
+					panic(err)
+				}
+			}
+			p.expansionError(call, "error expanding %s: %v", call.macro.name, r)
+		}
+	}()
+	result = Fixnum(0)
+	for _, expr := range call.macro.body {
+		result = expr.Eval(scope)
+	}
+	return result
+}
+
+// readExpansion parses the source a macro produced, it has to be a single
+// expression
+func (p *Parser) readExpansion(call *MacroCallNode, source string) (node ASTNode) {
+	defer func() {
+		if r := recover(); r != nil {
+			parseErr, ok := r.(*ParseError)
+			if !ok {
+				panic(r)
+			}
+			p.expansionError(call, "in expansion of %s, %s: %s", call.macro.name, source, parseErr.Message)
+		}
+	}()
+	p.skipWhitespace()
+	node = p.ParseExpression()
+	p.skipWhitespace()
+	if !p.isEndOfInput() {
+		p.errorf("expected a single expression")
+	}
+	return node
+}
+
+// boundNames finds the variables an expansion introduces itself, the names
+// let, do and def bind that came from the macro's templates rather than from
+// its arguments
+func boundNames(datum Value, expansion int, names map[string]bool) map[string]bool {
+	if names == nil {
+		names = make(map[string]bool)
+	}
+	list, ok := datum.(List)
+	if !ok {
+		return names
+	}
+	introduced := func(item Value) {
+		if binding, ok := item.(List); ok && len(binding) > 0 {
+			item = binding[0]
+		}
+		if symbol, ok := item.(Symbol); ok && symbol.expansion == expansion {
+			names[symbol.name] = true
+		}
+	}
+	if len(list) > 2 {
+		head, _ := list[0].(Symbol)
+		bindings, isList := list[1].(List)
+		if head.name == "def" {
+			bindings, isList = list[2].(List)
+		}
+		if isList && (head.name == "let" || head.name == "do" || head.name == "def") {
+			for _, binding := range bindings {
+				introduced(binding)
+			}
+		}
+		if isList && head.name == "guard" && len(bindings) > 0 {
+			introduced(bindings[0])
+		}
+	}
+	for _, item := range list {
+		boundNames(item, expansion, names)
+	}
+	return names
+}
+
+// datumSource prints an expansion back as source, renaming the variables it
+// binds to name.N so they can not capture the caller's
+func datumSource(datum Value, bound map[string]bool, expansion int) string {
+	switch datum := datum.(type) {
+	case Symbol:
+		if datum.expansion == expansion && bound[datum.name] {
+			return fmt.Sprintf("%s.%d", datum.name, expansion)
+		}
+		return datum.name
+	case List:
+		if len(datum) == 2 {
+			if head, ok := datum[0].(Symbol); ok && quotePrefixes[head.name] != "" {
+				return quotePrefixes[head.name] + datumSource(datum[1], bound, expansion)
+			}
+		}
+		items := make([]string, len(datum))
+		for indx, item := range datum {
+			items[indx] = datumSource(item, bound, expansion)
+		}
+		return "(" + strings.Join(items, " ") + ")"
+	case String:
+		return quoteString(string(datum))
+	}
+	return datum.String()
+}
+
+// quoteString is s as a string literal readString reads back
+func quoteString(s string) string {
+	quoted := ""
+	for _, b := range []byte(s) {
+		switch b {
+		case '\n':
+			quoted += "\\n"
+		case '\t':
+			quoted += "\\t"
+		case '"', '\\':
+			quoted += "\\" + string(b)
+		default:
+			quoted += string(b)
+		}
+	}
+	return `"` + quoted + `"`
+}
+
+func (u *unquote) String() string {
+	if u.splice {
+		return ",@..."
+	}
+	return ",..."
+}
@@ -0,0 +1,395 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loader reads a program together with the modules it imports. Every module
+// other than the program itself gets its own namespace, its definitions are
+// renamed to module/name when the modules are linked into one program.
+type Loader struct {
+	// SearchPath is where (require lib) looks for lib.lisp after the
+	// directory of the file requiring it
+	SearchPath []string
+	// Prelude reads the standard prelude ahead of the program
+	Prelude bool
+	modules map[string]*module
+	// order has every module after the ones it imports
+	order []*module
+	// loading is the chain of imports being read, to find cycles
+	loading []string
+	units   []*Unit
+}
+
+// Unit is one module of a loaded program, compile mode turns every unit into
+// its own object file
+type Unit struct {
+	Name    string
+	Main    bool
+	Source  *SourceFile
+	Program []ASTNode
+	// Hash covers the unit's source and the hashes of the units it imports,
+	// their macros and definitions change the code generated for it
+	Hash string
+}
+
+type module struct {
+	name    string
+	main    bool
+	source  *SourceFile
+	program []ASTNode
+	imports []*module
+	exports map[string]bool
+}
+
+func NewLoader(searchPath []string) *Loader {
+	return &Loader{SearchPath: searchPath, Prelude: true, modules: make(map[string]*module)}
+}
+
+// Load reads the program in input, read from path, and everything it
+// imports. The result is one program the check pass and both engines can run.
+func (l *Loader) Load(path string, input string) (program []ASTNode, err error) {
+	main := &module{main: true, source: &SourceFile{Path: path, Input: input}}
+	parser := NewParser(input)
+	parser.source = main.source
+	parser.loader = l
+	parser.module = main
+	if l.Prelude {
+		if err := parser.UsePrelude(); err != nil {
+			return nil, err
+		}
+	}
+	main.program, err = parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			parseErr, ok := r.(*ParseError)
+			if !ok {
+				panic(r)
+			}
+			program, err = nil, parseErr
+		}
+	}()
+	prelude := make(map[ASTNode]bool)
+	for _, node := range parser.prelude {
+		prelude[node] = true
+	}
+	// What the program defines, modules can't use it
+	programNames := make(map[string]bool)
+	for _, node := range main.program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			programNames[node.name] = !prelude[node]
+		case *DefineNode:
+			programNames[node.name] = true
+		case *ExternNode:
+			programNames[node.name] = true
+		}
+	}
+	program = make([]ASTNode, 0)
+	hashes := make(map[*module]string)
+	l.units = nil
+	for _, m := range append(l.order, main) {
+		linked := m.link(prelude, programNames)
+		program = append(program, linked...)
+		hashes[m] = m.hash(hashes, l.Prelude)
+		l.units = append(l.units, &Unit{Name: m.name, Main: m.main, Source: m.source, Program: linked, Hash: hashes[m]})
+	}
+	return program, nil
+}
+
+// Units returns the modules of the program Load read, every unit comes after
+// the units it imports and the program itself is last
+func (l *Loader) Units() []*Unit {
+	return l.units
+}
+
+// hash identifies the module's source together with its imports, which are
+// hashed before the modules importing them
+func (m *module) hash(hashes map[*module]string, prelude bool) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%v\x00%s\x00", m.name, m.main && prelude, m.source.Input)
+	for _, imported := range m.imports {
+		fmt.Fprintf(hash, "%s\x00", hashes[imported])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// resolve finds the file an import names, imports are relative to the file
+// they are in and requires are looked up along the search path
+func (l *Loader) resolve(from string, node *ImportNode) (string, error) {
+	directories := []string{filepath.Dir(from)}
+	file := node.path
+	if node.required {
+		directories = append(directories, l.SearchPath...)
+		file += ".lisp"
+	}
+	if filepath.IsAbs(file) {
+		directories = []string{""}
+	}
+	for _, directory := range directories {
+		candidate := filepath.Join(directory, file)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return filepath.Abs(candidate)
+		}
+	}
+	if node.required {
+		return "", fmt.Errorf("module %s not found in %s", node.path, strings.Join(directories, ", "))
+	}
+	return "", fmt.Errorf("module %s not found", filepath.Join(filepath.Dir(from), file))
+}
+
+// importModule reads the module an import names, once however many modules
+// import it. The module shares the importer's macros, so macros it defines
+// can be used after the import.
+func (l *Loader) importModule(p *Parser, node *ImportNode, offset int) *module {
+	path, err := l.resolve(p.source.Path, node)
+	if err != nil {
+		p.errorAt(offset, "%s", err)
+	}
+	for indx, loading := range l.loading {
+		if loading == path {
+			// The chain starts and ends at the module whose import closes
+			// it, where the error is reported
+			cycle := []string{filepath.Base(p.source.Path)}
+			for _, file := range l.loading[indx:] {
+				cycle = append(cycle, filepath.Base(file))
+			}
+			p.errorAt(offset, "import cycle %s", strings.Join(cycle, " -> "))
+		}
+	}
+	m := l.modules[path]
+	if m == nil {
+		m = l.readModule(p, path, offset)
+	}
+	for _, imported := range p.module.imports {
+		if imported == m {
+			return m
+		}
+	}
+	p.module.imports = append(p.module.imports, m)
+	return m
+}
+
+func (l *Loader) readModule(p *Parser, path string, offset int) *module {
+	input, err := os.ReadFile(path)
+	if err != nil {
+		p.errorAt(offset, "%s", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".lisp")
+	for _, other := range l.modules {
+		if other.name == name {
+			p.errorAt(offset, "modules %s and %s are both named %s", other.source.Path, path, name)
+		}
+	}
+	m := &module{name: name, source: &SourceFile{Path: path, Input: string(input)}}
+	l.modules[path] = m
+	l.loading = append(l.loading, path)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+	parser := NewParser(m.source.Input)
+	parser.macros = p.macros
+	parser.nextExpansion = p.nextExpansion
+	parser.source = m.source
+	parser.loader = l
+	parser.module = m
+	m.program, err = parser.Parse()
+	if err != nil {
+		panic(err)
+	}
+	l.order = append(l.order, m)
+	return m
+}
+
+func (m *module) errorf(node ASTNode, format string, args ...any) {
+	span := node.(spanned).sourceSpan()
+	panic(&ParseError{Offset: span.Start, Message: fmt.Sprintf(format, args...), Source: span.Source})
+}
+
+// link renames the module's definitions into its namespace and points the
+// names it imports at the modules exporting them. A module without an
+// export exports everything it defines, and can't see what the program
+// defines.
+func (m *module) link(prelude map[ASTNode]bool, programNames map[string]bool) []ASTNode {
+	defined := make(map[string]bool)
+	externs := make(map[string]bool)
+	for _, node := range m.program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			defined[node.name] = !prelude[node]
+		case *DefineNode:
+			defined[node.name] = true
+		case *ExternNode:
+			externs[node.name] = true
+		}
+	}
+	m.exports = make(map[string]bool)
+	exported := false
+	for _, node := range m.program {
+		if export, ok := node.(*ExportNode); ok {
+			exported = true
+			for _, name := range export.names {
+				if !defined[name] {
+					m.errorf(export, "%s is exported but not defined", name)
+				}
+				m.exports[name] = true
+			}
+		}
+	}
+	if !exported {
+		for name, own := range defined {
+			m.exports[name] = own
+		}
+	}
+	qualify := func(name string) string {
+		if m.main {
+			return name
+		}
+		return m.name + "/" + name
+	}
+	exporters := make(map[string][]*module)
+	for _, imported := range m.imports {
+		for name, ok := range imported.exports {
+			if ok {
+				exporters[name] = append(exporters[name], imported)
+			}
+		}
+	}
+	rename := func(name string, node ASTNode) string {
+		if defined[name] {
+			return qualify(name)
+		}
+		if slash := strings.Index(name, "/"); slash > 0 && slash < len(name)-1 {
+			for _, imported := range m.imports {
+				if imported.name == name[:slash] && !imported.exports[name[slash+1:]] {
+					m.errorf(node, "%s is not exported by %s", name[slash+1:], imported.name)
+				}
+			}
+			return name
+		}
+		switch modules := exporters[name]; len(modules) {
+		case 0:
+			// Names defined nowhere are left for the check pass to report
+			if !m.main && programNames[name] && !externs[name] {
+				m.errorf(node, "%s is neither defined in %s nor imported", name, m.name)
+			}
+			return name
+		case 1:
+			return modules[0].name + "/" + name
+		default:
+			m.errorf(node, "%s is exported by both %s and %s", name, modules[0].name, modules[1].name)
+		}
+		return name
+	}
+	linked := make([]ASTNode, 0, len(m.program))
+	for _, node := range m.program {
+		switch node := node.(type) {
+		case *ImportNode, *ExportNode:
+			continue
+		case *FunctionNode:
+			if !prelude[node] {
+				node.name = qualify(node.name)
+				renameFree(node, nil, rename)
+			}
+		case *DefineNode:
+			node.name = qualify(node.name)
+			renameFree(node, nil, rename)
+		default:
+			renameFree(node, nil, rename)
+		}
+		linked = append(linked, node)
+	}
+	return linked
+}
+
+// renameFree replaces the free names node refers to, names bound by
+// parameters, let and do are left alone. Returning the name unchanged walks
+// the references without renaming them.
+func renameFree(node ASTNode, locals map[string]bool, rename func(name string, node ASTNode) string) {
+	bind := func(names ...string) map[string]bool {
+		inner := make(map[string]bool)
+		for name := range locals {
+			inner[name] = true
+		}
+		for _, name := range names {
+			inner[name] = true
+		}
+		return inner
+	}
+	bindingNames := func(bindings []Binding) []string {
+		names := make([]string, len(bindings))
+		for indx, binding := range bindings {
+			names[indx] = binding.name
+		}
+		return names
+	}
+	all := func(nodes []ASTNode, locals map[string]bool) {
+		for _, node := range nodes {
+			renameFree(node, locals, rename)
+		}
+	}
+	switch node := node.(type) {
+	case *IdentifierNode:
+		if !locals[node.name] {
+			node.name = rename(node.name, node)
+		}
+	case *SExpr:
+		if !locals[node.operand] && !Includes(builtInOperations, node.operand) {
+			node.operand = rename(node.operand, node)
+		}
+		all(node.arguments, locals)
+	case *SetNode:
+		if !locals[node.name] {
+			node.name = rename(node.name, node)
+		}
+		renameFree(node.value, locals, rename)
+	case *ReferenceNode:
+		renameFree(node.value, locals, rename)
+	case *IfNode:
+		renameFree(node.condition, locals, rename)
+		renameFree(node.trueExpr, locals, rename)
+		if node.falseExpr != nil {
+			renameFree(node.falseExpr, locals, rename)
+		}
+	case *WhileNode:
+		renameFree(node.condition, locals, rename)
+		all(node.body, locals)
+	case *DoNode:
+		inner := bind(bindingNames(node.bindings)...)
+		for _, binding := range node.bindings {
+			renameFree(binding.init, locals, rename)
+			if binding.step != nil {
+				renameFree(binding.step, inner, rename)
+			}
+		}
+		renameFree(node.test, inner, rename)
+		all(node.body, inner)
+		all(node.result, inner)
+	case *LetNode:
+		for _, binding := range node.bindings {
+			renameFree(binding.init, locals, rename)
+		}
+		all(node.body, bind(bindingNames(node.bindings)...))
+	case *DefineNode:
+		renameFree(node.value, locals, rename)
+	case *FunctionNode:
+		all(node.body, bind(node.arguments...))
+	case *ErrorNode:
+		all(node.irritants, locals)
+	case *CatchNode:
+		all(node.body, locals)
+		all(node.handler, bind(node.variable))
+	case *WindNode:
+		all([]ASTNode{node.before, node.body, node.after}, locals)
+	case *QuasiquoteNode:
+		for _, hole := range templateHoles(node.template, nil) {
+			renameFree(hole.expr, locals, rename)
+		}
+	}
+}
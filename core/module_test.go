@@ -0,0 +1,248 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModules writes files into a temporary directory and returns it
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func loadModules(dir string, searchPath ...string) ([]ASTNode, error) {
+	loader := NewLoader(searchPath)
+	loader.Prelude = false
+	input, err := os.ReadFile(filepath.Join(dir, "main.lisp"))
+	if err != nil {
+		return nil, err
+	}
+	return loader.Load(filepath.Join(dir, "main.lisp"), string(input))
+}
+
+var shapesModules = map[string]string{
+	"lib/shapes.lisp": `(require mathx)
+(export area perimeter)
+(define sides 4)
+(def helper(x) (mathx/twice x))
+(def area(w h) (* w h))
+(def perimeter(w h) (helper (+ w h)))`,
+	"vendor/mathx.lisp": "(def twice(x) (* x 2)) (def helper(x) 1000)",
+	"main.lisp": `(import "lib/shapes.lisp")
+(require mathx)
+(def helper(x) x)
+(def main()
+  (print (area 2 3))
+  (print (shapes/perimeter 2 3))
+  (print (twice 5))
+  (print (helper 7))
+  0)`,
+}
+
+func TestModules(t *testing.T) {
+	dir := writeModules(t, shapesModules)
+	program, err := loadModules(dir, filepath.Join(dir, "vendor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Check(program); len(diagnostics) != 0 {
+		t.Fatalf("Unexpected diagnostics %v", diagnostics)
+	}
+	names := make([]string, 0)
+	for _, node := range program {
+		if function, ok := node.(*FunctionNode); ok {
+			names = append(names, function.name)
+		}
+	}
+	// Each module's helper lives in its own namespace
+	if strings.Join(names, " ") != "mathx/twice mathx/helper shapes/helper shapes/area shapes/perimeter helper main" {
+		t.Errorf("Unexpected definitions %v", names)
+	}
+	expected := "6\n10\n10\n7\n"
+	if interpreted := captureStdout(t, func() { NewInterpreterScope(nil).Run(program) }); interpreted != expected {
+		t.Errorf("Expected the interpreter to print %q, got %q", expected, interpreted)
+	}
+	if _, err := exec.LookPath("lli"); err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	program, err = loadModules(dir, filepath.Join(dir, "vendor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, stdout, stderr := runModule(t, "lli", compileModule(program)); stdout != expected {
+		t.Errorf("Expected the compiled program to print %q, got %q (%s)", expected, stdout, stderr)
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	type TestCase struct {
+		files   map[string]string
+		file    string
+		message string
+	}
+	testCases := []TestCase{
+		{
+			files:   map[string]string{"main.lisp": "(require a) (def main() 0)", "a.lisp": "(require b)", "b.lisp": "(require a)"},
+			file:    "b.lisp",
+			message: "import cycle b.lisp -> a.lisp -> b.lisp",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require a) (def main() 0)", "a.lisp": "(require b)", "b.lisp": "(require c)", "c.lisp": "(require b)"},
+			file:    "c.lisp",
+			message: "import cycle c.lisp -> b.lisp -> c.lisp",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require a) (def main() (a/secret))", "a.lisp": "(export open) (def open() 1) (def secret() 2)"},
+			file:    "main.lisp",
+			message: "secret is not exported by a",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require a) (require b) (def main() (f))", "a.lisp": "(def f() 1)", "b.lisp": "(def f() 2)"},
+			file:    "main.lisp",
+			message: "f is exported by both a and b",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require util) (def g() 1) (define k 2) (def main() (f))", "util.lisp": "(def f() (+ k (g)))"},
+			file:    "util.lisp",
+			message: "k is neither defined in util nor imported",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require a)", "a.lisp": "(export g) (def f() 1)"},
+			file:    "a.lisp",
+			message: "g is exported but not defined",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(require missing)"},
+			file:    "main.lisp",
+			message: "module missing not found in",
+		},
+		{
+			files:   map[string]string{"main.lisp": "(import \"a.lisp\")", "a.lisp": "(def f() (+ 1)"},
+			file:    "a.lisp",
+			message: "expected ')' got end of input",
+		},
+	}
+	for _, testCase := range testCases {
+		dir := writeModules(t, testCase.files)
+		_, err := loadModules(dir)
+		parseErr, ok := err.(*ParseError)
+		if !ok || !strings.HasPrefix(parseErr.Message, testCase.message) {
+			t.Errorf("%v: expected %q, got %v", testCase.files, testCase.message, err)
+			continue
+		}
+		if parseErr.Source == nil || filepath.Base(parseErr.Source.Path) != testCase.file {
+			t.Errorf("%v: expected the error in %s, got %v", testCase.files, testCase.file, parseErr.Source)
+		}
+	}
+	if _, err := NewParser("(require a)").Parse(); err == nil {
+		t.Errorf("Expected imports to need a loader")
+	}
+}
+
+func TestModuleDiagnosticsPointAtTheirFile(t *testing.T) {
+	dir := writeModules(t, map[string]string{"main.lisp": "(require a) (def main() (f))", "a.lisp": "(def f()\n  (g))"})
+	program, err := loadModules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnostics := Check(program)
+	if len(diagnostics) != 1 || diagnostics[0].Message != "g is not defined" {
+		t.Fatalf("Expected g to be undefined, got %v", diagnostics)
+	}
+	source := diagnostics[0].Span.Source
+	if line, column := Position(source.Input, diagnostics[0].Span.Start); filepath.Base(source.Path) != "a.lisp" || line != 2 || column != 3 {
+		t.Errorf("Expected the diagnostic at a.lisp:2:3, got %s:%d:%d", source.Path, line, column)
+	}
+}
+
+func TestSeparateCompilation(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	files := map[string]string{
+		"vendor/mathx.lisp": shapesModules["vendor/mathx.lisp"] + "\n(define offset (* 4611686018427387904 2))",
+		"lib/shapes.lisp":   shapesModules["lib/shapes.lisp"],
+		"main.lisp":         "(import \"lib/shapes.lisp\") (require mathx)\n(define total (+ offset (area 2 3)))\n(def main() (print (perimeter 1 2)) (print total) 0)",
+	}
+	dir := writeModules(t, files)
+	loader := NewLoader([]string{filepath.Join(dir, "vendor")})
+	loader.Prelude = false
+	program, err := loader.Load(filepath.Join(dir, "main.lisp"), files["main.lisp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := loader.Units()
+	if len(units) != 3 || units[0].Name != "mathx" || units[1].Name != "shapes" || !units[2].Main {
+		t.Fatalf("Expected the units mathx, shapes and the program, got %v", units)
+	}
+	arguments := []string{"-extra-object=" + buildRuntimeObject(t)}
+	var main string
+	for _, unit := range units {
+		asm := CodegenUnit(program, units, unit)
+		if unit.Name == "shapes" && !strings.Contains(asm, `declare i64 @"mathx/twice"(i64)`) {
+			t.Errorf("Expected shapes to declare mathx/twice, got\n%s", asm)
+		}
+		path := filepath.Join(t.TempDir(), unit.Name+".ll")
+		if err := os.WriteFile(path, []byte(asm), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if unit.Main {
+			main = path
+		} else {
+			arguments = append(arguments, "-extra-module="+path)
+		}
+	}
+	var stdout, stderr strings.Builder
+	cmd := exec.Command(lli, append(arguments, main)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if expected := "6\n9223372036854775814\n"; stdout.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, stdout.String())
+	}
+}
+
+func TestUnitHashes(t *testing.T) {
+	hashes := func(files map[string]string) map[string]string {
+		loader := NewLoader(nil)
+		loader.Prelude = false
+		dir := writeModules(t, files)
+		if _, err := loader.Load(filepath.Join(dir, "main.lisp"), files["main.lisp"]); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]string)
+		for _, unit := range loader.Units() {
+			result[unit.Name] = unit.Hash
+		}
+		return result
+	}
+	files := map[string]string{"main.lisp": "(require a) (def main() (f))", "a.lisp": "(require b) (def f() (g))", "b.lisp": "(def g() 1)"}
+	before := hashes(files)
+	files["main.lisp"] = "(require a) (def main() (+ (f) 1))"
+	after := hashes(files)
+	if before["a"] != after["a"] || before["b"] != after["b"] || before[""] == after[""] {
+		t.Errorf("Expected only the program's hash to change, got %v and %v", before, after)
+	}
+	files["b.lisp"] = "(def g() 2)"
+	changed := hashes(files)
+	if changed["a"] == after["a"] || changed[""] == after[""] {
+		t.Errorf("Expected a change to b to reach the units importing it, got %v and %v", after, changed)
+	}
+}
@@ -0,0 +1,391 @@
+package core
+
+import "fmt"
+
+// OptimizationLevel is how hard compile works on the program before
+// generating code, set by -O0, -O1 and -O2:
+//   - 0 leaves the program as it is
+//   - 1 folds constants, drops the branches of ifs whose condition folds and
+//     removes functions main can't reach
+//   - 2 also inlines small functions that don't call other functions
+var OptimizationLevel = 1
+
+// maxInlineSize is the most nodes the body of an inlined function can have
+const maxInlineSize = 24
+
+// Optimize rewrites the program compile mode runs at the given level. The
+// units' programs are rewritten along with it.
+func Optimize(program []ASTNode, units []*Unit, level int) []ASTNode {
+	if level < 1 {
+		return program
+	}
+	functions := make(map[string]*FunctionNode)
+	for _, node := range program {
+		if function, ok := node.(*FunctionNode); ok {
+			functions[function.name] = function
+		}
+	}
+	o := &optimizer{inline: make(map[string]*FunctionNode)}
+	if level >= 2 {
+		for name, function := range functions {
+			if inlinable(function, functions) {
+				o.inline[name] = function
+			}
+		}
+	}
+	for indx, node := range program {
+		program[indx] = o.optimize(node)
+	}
+	reachable := reachableFunctions(program, functions)
+	if reachable == nil {
+		return program
+	}
+	keep := func(nodes []ASTNode) []ASTNode {
+		kept := make([]ASTNode, 0, len(nodes))
+		for _, node := range nodes {
+			if function, ok := node.(*FunctionNode); ok && !reachable[function.name] {
+				continue
+			}
+			kept = append(kept, node)
+		}
+		return kept
+	}
+	for _, unit := range units {
+		unit.Program = keep(unit.Program)
+	}
+	return keep(program)
+}
+
+type optimizer struct {
+	// inline has the functions whose calls are replaced by their body
+	inline map[string]*FunctionNode
+}
+
+func (o *optimizer) optimizeAll(nodes []ASTNode) {
+	for indx, node := range nodes {
+		nodes[indx] = o.optimize(node)
+	}
+}
+
+func (o *optimizer) optimizeBindings(bindings []Binding) {
+	for indx := range bindings {
+		bindings[indx].init = o.optimize(bindings[indx].init)
+		if bindings[indx].step != nil {
+			bindings[indx].step = o.optimize(bindings[indx].step)
+		}
+	}
+}
+
+// optimize rewrites node's children in place and returns what node is
+// replaced with, itself unless it folds away
+func (o *optimizer) optimize(node ASTNode) ASTNode {
+	switch node := node.(type) {
+	case *SExpr:
+		o.optimizeAll(node.arguments)
+		if function, ok := o.inline[node.operand]; ok {
+			return inlineCall(node, function)
+		}
+		if !Includes(arithmeticOps, node.operand) && !Includes(numericOps, node.operand) {
+			return node
+		}
+		value, ok := constantValue(node)
+		if !ok {
+			return node
+		}
+		var folded ASTNode = newIntegerNode(value)
+		if flonum, ok := value.(Flonum); ok {
+			folded = newFloatNode(flonum)
+		}
+		folded.(spanned).setSpan(node.Span)
+		return folded
+	case *FunctionNode:
+		o.optimizeAll(node.body)
+	case *DefineNode:
+		node.value = o.optimize(node.value)
+	case *SetNode:
+		node.value = o.optimize(node.value)
+	case *ReferenceNode:
+		node.value = o.optimize(node.value)
+	case *IfNode:
+		o.optimize(node.condition)
+		node.trueExpr = o.optimize(node.trueExpr)
+		if node.falseExpr != nil {
+			node.falseExpr = o.optimize(node.falseExpr)
+		}
+		if holds, ok := constantCondition(node.condition); ok {
+			if holds {
+				return node.trueExpr
+			}
+			if node.falseExpr != nil {
+				return node.falseExpr
+			}
+			zero := newIntegerNode(Fixnum(0))
+			zero.setSpan(node.Span)
+			return zero
+		}
+	case *WhileNode:
+		o.optimize(node.condition)
+		o.optimizeAll(node.body)
+	case *DoNode:
+		o.optimizeBindings(node.bindings)
+		o.optimize(node.test)
+		o.optimizeAll(node.result)
+		o.optimizeAll(node.body)
+	case *LetNode:
+		o.optimizeBindings(node.bindings)
+		o.optimizeAll(node.body)
+	case *ErrorNode:
+		o.optimizeAll(node.irritants)
+	case *CatchNode:
+		o.optimizeAll(node.body)
+		o.optimizeAll(node.handler)
+	case *WindNode:
+		node.before = o.optimize(node.before)
+		node.body = o.optimize(node.body)
+		node.after = o.optimize(node.after)
+	}
+	return node
+}
+
+// constantCondition is the outcome of a comparison of constants
+func constantCondition(condition *SExpr) (holds bool, ok bool) {
+	if !Includes(comparisionOps, condition.operand) || len(condition.arguments) != 2 {
+		return false, false
+	}
+	left, leftOk := constantValue(condition.arguments[0])
+	right, rightOk := constantValue(condition.arguments[1])
+	if !leftOk || !rightOk {
+		return false, false
+	}
+	return compareNumbers(condition.operand, left, right), true
+}
+
+// inlinable is whether calls to function can be replaced by its body: it is
+// small, passes values tagged, calls no other Lisp function (so it can't be
+// recursive) and refers to nothing but its parameters, which a let binds at
+// the call
+func inlinable(function *FunctionNode, functions map[string]*FunctionNode) bool {
+	if function.name == "main" || function.returnType != nil {
+		return false
+	}
+	for _, annotation := range function.parameterTypes {
+		if annotation != nil {
+			return false
+		}
+	}
+	size := 0
+	for _, expr := range function.body {
+		size += nodeCount(expr)
+	}
+	if size > maxInlineSize {
+		return false
+	}
+	parameters := make(map[string]bool)
+	for _, parameter := range function.arguments {
+		parameters[parameter] = true
+	}
+	selfContained := true
+	for _, expr := range function.body {
+		renameFree(expr, parameters, func(name string, node ASTNode) string {
+			if _, ok := node.(*SExpr); ok && functions[name] == nil {
+				return name
+			}
+			selfContained = false
+			return name
+		})
+	}
+	return selfContained
+}
+
+// inlineCall is a copy of function's body with let binding its parameters
+// to the arguments of call, every call site gets its own nodes to rewrite
+func inlineCall(call *SExpr, function *FunctionNode) ASTNode {
+	let := &LetNode{Span: call.Span, bindings: make([]Binding, len(function.arguments)), body: copyNodes(function.body)}
+	for indx, parameter := range function.arguments {
+		let.bindings[indx] = Binding{name: parameter, init: call.arguments[indx]}
+	}
+	return let
+}
+
+func copyNodes(nodes []ASTNode) []ASTNode {
+	copied := make([]ASTNode, len(nodes))
+	for indx, node := range nodes {
+		copied[indx] = copyNode(node)
+	}
+	return copied
+}
+
+func copyBindings(bindings []Binding) []Binding {
+	copied := make([]Binding, len(bindings))
+	for indx, binding := range bindings {
+		copied[indx] = Binding{name: binding.name, init: copyNode(binding.init), step: copyNode(binding.step)}
+	}
+	return copied
+}
+
+// copyNode is a deep copy of the expression node, nil for nil
+func copyNode(node ASTNode) ASTNode {
+	switch node := node.(type) {
+	case nil:
+		return nil
+	case *IntegerNode:
+		copied := *node
+		return &copied
+	case *FloatNode:
+		copied := *node
+		return &copied
+	case *StringNode:
+		copied := *node
+		return &copied
+	case *IdentifierNode:
+		copied := *node
+		return &copied
+	case *QuoteNode:
+		copied := *node
+		return &copied
+	case *SExpr:
+		copied := *node
+		copied.arguments = copyNodes(node.arguments)
+		return &copied
+	case *SetNode:
+		copied := *node
+		copied.value = copyNode(node.value)
+		return &copied
+	case *ReferenceNode:
+		copied := *node
+		copied.value = copyNode(node.value)
+		return &copied
+	case *IfNode:
+		copied := *node
+		copied.condition = copyNode(node.condition).(*SExpr)
+		copied.trueExpr = copyNode(node.trueExpr)
+		copied.falseExpr = copyNode(node.falseExpr)
+		return &copied
+	case *WhileNode:
+		copied := *node
+		copied.condition = copyNode(node.condition).(*SExpr)
+		copied.body = copyNodes(node.body)
+		return &copied
+	case *DoNode:
+		copied := *node
+		copied.bindings = copyBindings(node.bindings)
+		copied.test = copyNode(node.test).(*SExpr)
+		copied.result = copyNodes(node.result)
+		copied.body = copyNodes(node.body)
+		return &copied
+	case *LetNode:
+		copied := *node
+		copied.bindings = copyBindings(node.bindings)
+		copied.body = copyNodes(node.body)
+		return &copied
+	case *ErrorNode:
+		copied := *node
+		copied.irritants = copyNodes(node.irritants)
+		return &copied
+	case *CatchNode:
+		copied := *node
+		copied.body = copyNodes(node.body)
+		copied.handler = copyNodes(node.handler)
+		return &copied
+	case *WindNode:
+		copied := *node
+		copied.before = copyNode(node.before)
+		copied.body = copyNode(node.body)
+		copied.after = copyNode(node.after)
+		return &copied
+	case *QuasiquoteNode:
+		copied := *node
+		copied.template = copyTemplate(node.template)
+		return &copied
+	}
+	panic(fmt.Sprintf("Error: can not copy %T", node))
+}
+
+// copyTemplate copies the lists of a quasiquote template and the
+// expressions of its holes, the data in it is immutable
+func copyTemplate(template Value) Value {
+	switch template := template.(type) {
+	case *unquote:
+		return &unquote{expr: copyNode(template.expr), splice: template.splice}
+	case List:
+		copied := make(List, len(template))
+		for indx, item := range template {
+			copied[indx] = copyTemplate(item)
+		}
+		return copied
+	}
+	return template
+}
+
+// nodeCount is the number of nodes in node
+func nodeCount(node ASTNode) int {
+	count := 1
+	countAll := func(nodes []ASTNode) {
+		for _, node := range nodes {
+			count += nodeCount(node)
+		}
+	}
+	countBindings := func(bindings []Binding) {
+		for _, binding := range bindings {
+			count += nodeCount(binding.init)
+			if binding.step != nil {
+				count += nodeCount(binding.step)
+			}
+		}
+	}
+	switch node := node.(type) {
+	case *SExpr:
+		countAll(node.arguments)
+	case *SetNode:
+		count += nodeCount(node.value)
+	case *ReferenceNode:
+		count += nodeCount(node.value)
+	case *IfNode:
+		countAll([]ASTNode{node.condition, node.trueExpr})
+		if node.falseExpr != nil {
+			count += nodeCount(node.falseExpr)
+		}
+	case *WhileNode:
+		countAll(append([]ASTNode{node.condition}, node.body...))
+	case *DoNode:
+		countBindings(node.bindings)
+		countAll(append(append([]ASTNode{node.test}, node.result...), node.body...))
+	case *LetNode:
+		countBindings(node.bindings)
+		countAll(node.body)
+	case *ErrorNode:
+		countAll(node.irritants)
+	case *CatchNode:
+		countAll(append(append([]ASTNode{}, node.body...), node.handler...))
+	case *WindNode:
+		countAll([]ASTNode{node.before, node.body, node.after})
+	}
+	return count
+}
+
+// reachableFunctions is the functions main and the globals' initial values
+// call, directly or not. It is nil for programs without a main.
+func reachableFunctions(program []ASTNode, functions map[string]*FunctionNode) map[string]bool {
+	if functions["main"] == nil {
+		return nil
+	}
+	reachable := make(map[string]bool)
+	var visit func(node ASTNode)
+	visit = func(node ASTNode) {
+		renameFree(node, nil, func(name string, _ ASTNode) string {
+			if function, ok := functions[name]; ok && !reachable[name] {
+				reachable[name] = true
+				visit(function)
+			}
+			return name
+		})
+	}
+	reachable["main"] = true
+	visit(functions["main"])
+	for _, node := range program {
+		if define, ok := node.(*DefineNode); ok {
+			visit(define)
+		}
+	}
+	return reachable
+}
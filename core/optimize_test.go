@@ -0,0 +1,99 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func optimizedModule(t *testing.T, input string, level int) string {
+	t.Helper()
+	program, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compileModule(Optimize(program, nil, level))
+}
+
+func TestOptimizedProgramsMatchInterpreter(t *testing.T) {
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found in PATH")
+	}
+	inputs := []string{
+		"(def main() (print (+ 1 2 (* 3 4))) (print (- 7)) (print (/ 7.0 2)) (print (* 4611686018427387904 4)) 0)",
+		"(def main() (print (if (< 1 2) 10 20)) (print (if (> 1 2) 10)) (print (if (= 2.0 2) 1 2)) 0)",
+		"(def main() (print (catch (/ 1 0) 99)) 0)",
+		"(def sq(x) (* x x)) (define k (sq 7)) (def main() (print (sq (+ k 1))) (print (sq 1.5)) 0)",
+		"(def clamp(x) (if (< x 0) 0 (if (> x 100) 100 x))) (def main() (print (clamp 150)) (print (clamp -3)) (print (clamp 42)) 0)",
+		"(def bump(x) (set! x (+ x 1)) x) (def main() (let ((x 10)) (print (bump (+ x 1))) (print x)) 0)",
+		"(def check(x) (if (< x 0) (error \"negative\" x) x)) (def main() (print (guard (e e) (check -4))) 0)",
+		"(def fib(n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))) (def main() (print (fib 15)) 0)",
+	}
+	for _, input := range inputs {
+		interpreted := captureStdout(t, func() { evalProgram(t, input) })
+		for level := 0; level <= 2; level++ {
+			_, stdout, stderr := runModule(t, lli, optimizedModule(t, input, level))
+			if stdout != interpreted {
+				t.Errorf("-O%d %s: interpreter printed %q, compiled code printed %q (%s)", level, input, interpreted, stdout, stderr)
+			}
+		}
+	}
+}
+
+func TestOptimizationPasses(t *testing.T) {
+	tests := []struct {
+		input   string
+		level   int
+		present []string
+		absent  []string
+	}{
+		{"(def main() (+ 1 2 (* 3 4)))", 1, []string{"add i64 31,0"}, []string{"@__lisp_add", "@__lisp_mul"}},
+		{"(def main() (+ 1 2))", 0, []string{"call i64 @__lisp_add("}, nil},
+		{"(def main() (if (< 1 2) 10 (print 20)))", 1, nil, []string{"br i1", "@lisp_print"}},
+		{"(def main() (/ 1 0))", 1, []string{"call i64 @__lisp_div("}, nil},
+		{"(def unused(x) x) (def main() 0)", 1, nil, []string{"@unused"}},
+		{"(def used(x) x) (define g (used 1)) (def main() g)", 1, []string{"define i64 @used"}, nil},
+		{"(def sq(x) (* x x)) (def main() (sq 3))", 1, []string{"call i64 @sq("}, nil},
+		{"(def sq(x) (* x x)) (def main() (sq 3))", 2, nil, []string{"@sq"}},
+		{"(def fib(n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))) (def main() (fib 3))", 2, []string{"call i64 @fib("}, nil},
+		{"(def sq(x) (* x x)) (def quad(x) (sq (sq x))) (def main() (quad 3))", 2, []string{"call i64 @quad("}, []string{"@sq"}},
+		{"(define k 3) (def addk(x) (+ x k)) (def main() (let ((k 1)) (addk 2)))", 2, []string{"call i64 @addk("}, nil},
+		{"(def half((x : float)) : float (/ x 2.0)) (def main() (half 3.0))", 2, []string{"call double @half("}, nil},
+	}
+	for _, test := range tests {
+		asm := strings.TrimSuffix(optimizedModule(t, test.input, test.level), RuntimeSupport())
+		for _, expected := range test.present {
+			if !strings.Contains(asm, expected) {
+				t.Errorf("-O%d %s: expected %q in\n%s", test.level, test.input, expected, asm)
+			}
+		}
+		for _, unexpected := range test.absent {
+			if strings.Contains(asm, unexpected) {
+				t.Errorf("-O%d %s: expected no %q in\n%s", test.level, test.input, unexpected, asm)
+			}
+		}
+	}
+}
+
+func TestInlinedCallsGetTheirOwnBody(t *testing.T) {
+	program, err := NewParser("(def sq(x) (* x x)) (def main() (+ (sq 2) (sq 3)))").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range Optimize(program, nil, 2) {
+		function, ok := node.(*FunctionNode)
+		if !ok || function.name != "main" {
+			continue
+		}
+		sum := function.body[0].(*SExpr)
+		first, second := sum.arguments[0].(*LetNode), sum.arguments[1].(*LetNode)
+		if first.body[0] == second.body[0] {
+			t.Fatal("Expected both calls of sq to get a copy of its body")
+		}
+		first.body[0].(*SExpr).operand = "-"
+		if second.body[0].(*SExpr).operand != "*" {
+			t.Error("Rewriting one inlined body changed the other")
+		}
+	}
+}
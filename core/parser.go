@@ -2,26 +2,55 @@ package core
 
 import (
 	"fmt"
-	"strconv"
-	"unicode"
+	"math/big"
 )
 
 // Lookup global variables
-var builtInOperations = []string{"+", "-", "*", "/", "%", "<", ">", "=", "&", "sys_write"}
+var builtInOperations = []string{"+", "-", "*", "/", "%", "<", ">", "=", "&", "sys_write", "modulo", "remainder", "print", "exact->inexact", "floor", "round", "sqrt"}
+
+// Arithmetic is lowered to calls to the helpers in runtime.go
 var operandFunctioanMap = map[string]string{
-	"+": "add",
-	"-": "sub",
-	"*": "mul",
-	"/": "udiv",
-	"%": "urem",
+	"+":         "add",
+	"-":         "sub",
+	"*":         "mul",
+	"/":         "div",
+	"%":         "rem",
+	"remainder": "rem",
+	"modulo":    "mod",
 }
 var whiteSpaceChars = []rune{'\n', '\r', '\t', ' '}
 
-// global variables
+// Codegen state, generating code is process wide and not safe for
+// concurrent use. The interpreter and the parser keep theirs in the scope
+// and the Parser.
 var generateNextSymbol = nextSymbolGenerator()
 var generateNextIfLabel = ifLabelGenerator()
-var basicBlockQueue = []string{}
+var generateNextLoopLabel = loopLabelGenerator()
+var generateNextConstant = constantGenerator()
+
+// maxNesting is how deeply expressions and quoted data can nest, deeper
+// input would overflow the Go stack of the recursive reader and the passes
+// after it
+const maxNesting = 10000
+
+var globalConstants = ""
+var globalInitializers = []string{}
+var currentBlock = "entry"
+
+// unwindTarget is the block a failed call branches to, the enclosing handler
+// or the function's unwind block, which returns to the caller
+var unwindTarget = "unwind"
+var unwindUsed = false
+var generateNextErrorLabel = errorLabelGenerator()
+var functionAllocas = ""
 var globalFunctionStore = &FunctionStore{store: make(map[string]*FunctionNode)}
+var globalExterns = make(map[string]*ExternNode)
+
+// declaredExterns are the C functions the module being generated declares
+var declaredExterns = make(map[string]bool)
+
+// CheckOverflow makes signed integer overflow an error in both engines instead of wrapping around
+var CheckOverflow = false
 
 func Includes[T comparable](arr []T, target T) bool {
 	for _, elem := range arr {
@@ -48,12 +77,49 @@ func ifLabelGenerator() func() [3]string {
 	}
 }
 
+func loopLabelGenerator() func() [3]string {
+	count := 1
+	return func() [3]string {
+		count += 1
+		return [3]string{fmt.Sprintf("loopcond%d", count-1), fmt.Sprintf("loopbody%d", count-1), fmt.Sprintf("loopend%d", count-1)}
+	}
+}
+
+func errorLabelGenerator() func() [3]string {
+	count := 1
+	return func() [3]string {
+		count += 1
+		return [3]string{fmt.Sprintf("noerror%d", count-1), fmt.Sprintf("handler%d", count-1), fmt.Sprintf("handled%d", count-1)}
+	}
+}
+
+func expansionGenerator() func() int {
+	count := 0
+	return func() int {
+		count += 1
+		return count
+	}
+}
+
+func constantGenerator() func() string {
+	count := 0
+	return func() string {
+		count += 1
+		return fmt.Sprintf("@.const%d", count)
+	}
+}
+
 func NewParser(input string) *Parser {
-	return &Parser{
-		input:        input,
-		currentIndex: 0,
-		currentChar:  input[0],
+	parser := &Parser{
+		input:         input,
+		currentIndex:  0,
+		macros:        make(map[string]*MacroNode),
+		nextExpansion: expansionGenerator(),
+	}
+	if len(input) > 0 {
+		parser.currentChar = input[0]
 	}
+	return parser
 }
 
 func newSExpr(operand string) *SExpr {
@@ -63,12 +129,18 @@ func newSExpr(operand string) *SExpr {
 	}
 }
 
-func newIntegerNode(value int) *IntegerNode {
+func newIntegerNode(value Value) *IntegerNode {
 	return &IntegerNode{
 		value: value,
 	}
 }
 
+func newFloatNode(value Flonum) *FloatNode {
+	return &FloatNode{
+		value: value,
+	}
+}
+
 func newFunctionNode(name string) *FunctionNode {
 	return &FunctionNode{
 		name:      name,
@@ -78,6 +150,13 @@ func newFunctionNode(name string) *FunctionNode {
 	}
 }
 
+func newDefineNode(name string, value ASTNode) *DefineNode {
+	return &DefineNode{
+		name:  name,
+		value: value,
+	}
+}
+
 func newIdentifierNode(name string) *IdentifierNode {
 	return &IdentifierNode{
 		name: name,
@@ -86,22 +165,45 @@ func newIdentifierNode(name string) *IdentifierNode {
 
 func newReferenceNode(value ASTNode) *ReferenceNode {
 	return &ReferenceNode{
-		value,
+		value: value,
 	}
 }
 
 func NewInterpreterScope(outer *InterpreterScope) *InterpreterScope {
-	return &InterpreterScope{inner: make(map[string]ASTNode), outer: outer}
+	scope := &InterpreterScope{inner: make(map[string]ASTNode), outer: outer}
+	if outer == nil {
+		scope.calls = &callStack{}
+	} else {
+		scope.budget = outer.budget
+		scope.expansion = outer.expansion
+		scope.calls = outer.calls
+		scope.allocate(1)
+	}
+	return scope
 }
 
 func NewCompilerScope(outer *CompilerScope) *CompilerScope {
 	return &CompilerScope{inner: make(map[string]string), outer: outer}
 }
 
+func (p *Parser) errorf(format string, args ...any) {
+	p.errorAt(p.currentIndex, format, args...)
+}
+
+func (p *Parser) errorAt(offset int, format string, args ...any) {
+	panic(&ParseError{Offset: offset, Message: fmt.Sprintf(format, args...), Source: p.source})
+}
+
+// skipWhitespace also skips comments, which run from ; to the end of the line
 func (p *Parser) skipWhitespace() {
-	for Includes(whiteSpaceChars, rune(p.currentChar)) && p.currentIndex < len(p.input)-1 {
-		p.currentIndex += 1
-		p.currentChar = p.input[p.currentIndex]
+	for !p.isEndOfInput() && (Includes(whiteSpaceChars, rune(p.currentChar)) || p.currentChar == ';') {
+		if p.currentChar == ';' {
+			for !p.isEndOfInput() && p.currentChar != '\n' {
+				p.nextChar()
+			}
+			continue
+		}
+		p.nextChar()
 	}
 }
 
@@ -112,211 +214,856 @@ func (p *Parser) isEndOfInput() bool {
 	return false
 }
 
+// nextChar advances the reader, at the end of input currentChar is set to 0 so
+// that loops waiting for a delimiter can not spin on the last character.
 func (p *Parser) nextChar() bool {
-	p.currentIndex += 1
+	if p.currentIndex < len(p.input) {
+		p.currentIndex += 1
+	}
 	if p.isEndOfInput() {
+		p.currentChar = 0
 		return false
 	}
 	p.currentChar = p.input[p.currentIndex]
 	return true
 }
 
-func (p *Parser) peekChar() (byte, bool) {
-	if p.currentIndex+1 >= len(p.input) {
-		return 0, false
+// expect asserts that the reader is positioned at char without consuming it
+func (p *Parser) expect(char byte) {
+	if p.isEndOfInput() {
+		p.errorf("expected %q got end of input", char)
+	}
+	if p.currentChar != char {
+		p.errorf("expected %q got %q", char, p.currentChar)
 	}
-	return p.input[p.currentIndex+1], true
+}
+
+func (p *Parser) isDelimiter() bool {
+	return p.isEndOfInput() || p.currentChar == ')' || p.currentChar == '(' || Includes(whiteSpaceChars, rune(p.currentChar))
+}
+
+func isIdentifierChar(char byte) bool {
+	return (char >= 'a' && char <= 'z') || Includes(builtInOperations, string(char)) || char == '_' || char == '!' || char == '?'
 }
 
 func (p *Parser) parseSExprArgs() []ASTNode {
 	parsedArgs := make([]ASTNode, 0)
-	for p.currentChar != ')' {
+	for !p.isEndOfInput() && p.currentChar != ')' {
 		arg := p.ParseExpression()
 		parsedArgs = append(parsedArgs, arg)
 		p.skipWhitespace()
 	}
+	p.expect(')')
 	return parsedArgs
 }
 
 func (p *Parser) parseFunctionBody() []ASTNode {
 	bodyExpressions := make([]ASTNode, 0)
-	p.nextChar() // To go from the closing parans of the arguments array
-	// Can either be at a whitespace or at a (, skip whitespace and assert
-	for p.currentChar != ')' {
+	// Can either be at a whitespace or at the start of an expression, skip whitespace and parse until the closing paren
+	p.skipWhitespace()
+	for !p.isEndOfInput() && p.currentChar != ')' {
+		bodyExpressions = append(bodyExpressions, p.ParseExpression())
 		p.skipWhitespace()
-		if p.currentChar == '(' {
-			if p.currentChar != '(' {
-				panic(fmt.Sprintf("Expected ( got %s", string(p.currentChar)))
-			}
-			bodyExpressions = append(bodyExpressions, p.ParseExpression())
-			p.skipWhitespace()
-		} else {
-			bodyExpressions = append(bodyExpressions, p.ParseExpression())
-		}
 	}
+	p.expect(')')
 	return bodyExpressions
 }
 
-func (p *Parser) parseFunctionArguments() []string {
+// parseFunctionArguments reads the parameter names and where they are, a
+// parameter is either a bare name or annotated with its type, (name : type).
+// Unannotated parameters have a nil annotation.
+func (p *Parser) parseFunctionArguments() ([]string, []*TypeAnnotation, []Span) {
 	argArray := make([]string, 0)
-	for p.currentChar != ')' {
+	annotations := make([]*TypeAnnotation, 0)
+	spans := make([]Span, 0)
+	p.skipWhitespace()
+	for !p.isEndOfInput() && p.currentChar != ')' {
+		var annotation *TypeAnnotation
+		span := Span{Start: p.currentIndex, Source: p.source}
+		annotated := p.currentChar == '('
+		if annotated {
+			p.nextChar()
+			p.skipWhitespace()
+		}
 		arg := p.readIdentifier()
+		if arg == "" {
+			p.errorf("expected argument name got %q", p.currentChar)
+		}
+		if annotated {
+			p.skipWhitespace()
+			annotation = p.parseAnnotation()
+			p.expect(')')
+			p.nextChar()
+		}
+		span.End = p.currentIndex
+		if p.expansion != nil {
+			span = *p.expansion
+		}
 		argArray = append(argArray, arg)
+		annotations = append(annotations, annotation)
+		spans = append(spans, span)
 		p.skipWhitespace()
 	}
-	return argArray
+	p.expect(')')
+	return argArray, annotations, spans
 }
 
-func (p *Parser) parseCallArguments() []ASTNode {
+// parseReturnType reads the optional ": type" after the parameter list
+func (p *Parser) parseReturnType() *TypeAnnotation {
+	p.nextChar() // To go from the closing parans of the arguments array
+	p.skipWhitespace()
+	if p.currentChar != ':' {
+		return nil
+	}
+	return p.parseAnnotation()
+}
+
+// parseAnnotation reads ": type" where a type is a name or a parameterised
+// type such as (list int)
+func (p *Parser) parseAnnotation() *TypeAnnotation {
+	p.expect(':')
 	p.nextChar()
+	p.skipWhitespace()
+	annotation := p.parseType()
+	p.skipWhitespace()
+	return annotation
+}
+
+func (p *Parser) parseType() *TypeAnnotation {
+	annotation := &TypeAnnotation{Span: Span{Start: p.currentIndex, Source: p.source}}
+	parameterised := p.currentChar == '('
+	if parameterised {
+		p.nextChar()
+		p.skipWhitespace()
+	}
+	annotation.name = p.readIdentifier()
+	if annotation.name == "" {
+		p.errorf("expected a type")
+	}
+	if parameterised {
+		p.skipWhitespace()
+		for !p.isEndOfInput() && p.currentChar != ')' {
+			annotation.args = append(annotation.args, p.parseType())
+			p.skipWhitespace()
+		}
+		p.expect(')')
+		p.nextChar()
+	}
+	annotation.End = p.currentIndex
+	if p.expansion != nil {
+		annotation.Span = *p.expansion
+	}
+	return annotation
+}
+
+// parseCondition reads the comparison that guards if, while and do
+func (p *Parser) parseCondition(form string) *SExpr {
+	p.skipWhitespace()
+	p.expect('(')
+	condition, ok := p.ParseExpression().(*SExpr)
+	if !ok {
+		p.errorf("%s condition should be an s expression", form)
+	}
+	p.skipWhitespace()
+	return condition
+}
+
+// parseBindings reads ((name init step)...), the step is only allowed in do
+func (p *Parser) parseBindings(form string) []Binding {
+	bindings := make([]Binding, 0)
+	p.skipWhitespace()
+	p.expect('(')
 	p.nextChar()
 	p.skipWhitespace()
-	evaluatedArgs := make([]ASTNode, 0)
-	for p.currentChar != ')' {
-		arg := p.ParseExpression()
-		if p.currentChar != ',' {
-			panic(fmt.Sprintf("Expected , got %s", string(p.currentChar)))
+	for !p.isEndOfInput() && p.currentChar != ')' {
+		p.expect('(')
+		p.nextChar()
+		p.skipWhitespace()
+		binding := Binding{name: p.readIdentifier()}
+		if binding.name == "" || !p.isDelimiter() {
+			p.errorf("expected variable name")
+		}
+		p.skipWhitespace()
+		binding.init = p.ParseExpression()
+		p.skipWhitespace()
+		if !p.isEndOfInput() && p.currentChar != ')' {
+			if form != "do" {
+				p.errorf("%s bindings take a name and a value", form)
+			}
+			binding.step = p.ParseExpression()
+			p.skipWhitespace()
+		}
+		p.expect(')')
+		p.nextChar()
+		p.skipWhitespace()
+		bindings = append(bindings, binding)
+	}
+	p.expect(')')
+	p.nextChar()
+	return bindings
+}
+
+func (p *Parser) peekChar() byte {
+	if p.currentIndex+1 >= len(p.input) {
+		return 0
+	}
+	return p.input[p.currentIndex+1]
+}
+
+func isDecimalDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+// radixDigit returns the value of char as a digit, or -1 when it is not one
+func radixDigit(char byte) int {
+	switch {
+	case char >= '0' && char <= '9':
+		return int(char - '0')
+	case char >= 'a' && char <= 'z':
+		return int(char-'a') + 10
+	case char >= 'A' && char <= 'Z':
+		return int(char-'A') + 10
+	}
+	return -1
+}
+
+// readDigits reads digits in the given base, single underscores may separate
+// digits (1_000_000) and are dropped from the result
+func (p *Parser) readDigits(base int) string {
+	digits := ""
+	separated := false
+	for !p.isEndOfInput() {
+		if p.currentChar == '_' {
+			if digits == "" || separated {
+				p.errorf("digit separator must sit between two digits")
+			}
+			separated = true
+			p.nextChar()
+			continue
 		}
-		evaluatedArgs = append(evaluatedArgs, arg)
+		digit := radixDigit(p.currentChar)
+		if digit < 0 || digit >= base {
+			break
+		}
+		digits += string(p.currentChar)
+		separated = false
+		p.nextChar()
+	}
+	if separated {
+		p.errorf("digit separator must sit between two digits")
+	}
+	return digits
+}
+
+func (p *Parser) readSign() string {
+	if p.currentChar == '-' || p.currentChar == '+' {
+		sign := string(p.currentChar)
+		p.nextChar()
+		return sign
 	}
-	return evaluatedArgs
+	return ""
+}
+
+// numberNode wraps up a literal, which has to be followed by a delimiter
+func (p *Parser) numberNode(value Value) ASTNode {
+	if !p.isDelimiter() {
+		p.errorf("expected a delimiter after number got %q", p.currentChar)
+	}
+	p.skipWhitespace()
+	if float, ok := value.(Flonum); ok {
+		return newFloatNode(float)
+	}
+	return newIntegerNode(value)
+}
+
+// parseNumber reads a decimal literal: an optional sign, digits, an optional
+// fraction (3.14) and an optional exponent (1e-9)
+func (p *Parser) parseNumber() ASTNode {
+	literal := p.readSign()
+	literal += p.readDigits(10)
+	if p.currentChar == '.' {
+		literal += "."
+		p.nextChar()
+		literal += p.readDigits(10)
+	}
+	if p.currentChar == 'e' || p.currentChar == 'E' {
+		literal += "e"
+		p.nextChar()
+		literal += p.readSign()
+		literal += p.readDigits(10)
+	}
+	value, ok := parseNumber(literal)
+	if !ok {
+		p.errorf("invalid number %s", literal)
+	}
+	return p.numberNode(value)
+}
+
+// parseRadixNumber reads #x1F, #b101, #o17 and #d10, the sign goes after the
+// prefix (#x-1F)
+func (p *Parser) parseRadixNumber() ASTNode {
+	p.nextChar()
+	bases := map[byte]int{'x': 16, 'b': 2, 'o': 8, 'd': 10}
+	base, ok := bases[p.currentChar]
+	if !ok {
+		p.errorf("expected one of #x #b #o #d got #%c", p.currentChar)
+	}
+	p.nextChar()
+	sign := p.readSign()
+	digits := p.readDigits(base)
+	if digits == "" {
+		p.errorf("expected base %d digits got %q", base, p.currentChar)
+	}
+	value, ok := new(big.Int).SetString(sign+digits, base)
+	if !ok {
+		p.errorf("invalid base %d number %s", base, digits)
+	}
+	return p.numberNode(normalizeBig(value))
 }
 
 func (p *Parser) readIdentifier() string {
 	identifier := ""
-	for unicode.IsLower(rune(p.currentChar)) || Includes(builtInOperations, string(p.currentChar)) || string(p.currentChar) == "_" {
+	// Variables a macro binds are renamed to name.N, only expansions can contain them
+	renamed := func() bool {
+		return p.expansion != nil && identifier != "" && (p.currentChar == '.' || isDecimalDigit(p.currentChar))
+	}
+	for !p.isEndOfInput() && (isIdentifierChar(p.currentChar) || renamed()) {
 		identifier += string(p.currentChar)
-		peekedChar, ok := p.peekChar()
-		if !ok {
-			break
+		p.nextChar()
+	}
+	return identifier
+}
+
+// readString reads a "double quoted" string, \n, \t, \" and \\ are the only
+// escapes
+func (p *Parser) readString() string {
+	p.expect('"')
+	p.nextChar()
+	value := ""
+	for !p.isEndOfInput() && p.currentChar != '"' {
+		if p.currentChar == '\\' {
+			p.nextChar()
+			if p.isEndOfInput() {
+				break
+			}
+			escaped, ok := stringEscapes[p.currentChar]
+			if !ok {
+				p.errorf("unknown escape \\%c", p.currentChar)
+			}
+			value += string(escaped)
+			p.nextChar()
+			continue
 		}
-		if peekedChar == ' ' {
+		value += string(p.currentChar)
+		p.nextChar()
+	}
+	p.expect('"')
+	p.nextChar()
+	return value
+}
+
+var stringEscapes = map[byte]byte{'n': '\n', 't': '\t', '"': '"', '\\': '\\'}
+
+// readCType reads the name of a C type, i32
+func (p *Parser) readCType() string {
+	name := ""
+	for !p.isEndOfInput() && (isIdentifierChar(p.currentChar) || isDecimalDigit(p.currentChar)) {
+		name += string(p.currentChar)
+		p.nextChar()
+	}
+	if name == "" || !p.isDelimiter() {
+		p.errorf("expected a C type")
+	}
+	return name
+}
+
+// parseExtern reads the rest of (extern name (types...) type)
+func (p *Parser) parseExtern() *ExternNode {
+	p.skipWhitespace()
+	extern := &ExternNode{name: p.readIdentifier()}
+	if extern.name == "" || !p.isDelimiter() {
+		p.errorf("expected the name of a C function")
+	}
+	p.skipWhitespace()
+	p.expect('(')
+	p.nextChar()
+	p.skipWhitespace()
+	for !p.isEndOfInput() && p.currentChar != ')' {
+		extern.parameters = append(extern.parameters, p.readCType())
+		p.skipWhitespace()
+	}
+	p.expect(')')
+	p.nextChar()
+	p.skipWhitespace()
+	extern.result = p.readCType()
+	p.skipWhitespace()
+	p.expect(')')
+	p.nextChar()
+	return extern
+}
+
+// readDatum reads quoted data. depth counts the quasiquotes being read, at
+// depth 1 an unquote is a hole holding an expression, at depth 0 everything
+// is plain data.
+func (p *Parser) readDatum(depth int) Value {
+	p.nest()
+	defer p.unnest()
+	p.skipWhitespace()
+	if p.isEndOfInput() {
+		p.errorf("unexpected end of input")
+	}
+	var datum Value
+	switch p.currentChar {
+	case '(':
+		p.nextChar()
+		list := List{}
+		p.skipWhitespace()
+		for !p.isEndOfInput() && p.currentChar != ')' {
+			list = append(list, p.readDatum(depth))
+		}
+		p.expect(')')
+		p.nextChar()
+		datum = list
+	case '\'':
+		p.nextChar()
+		datum = List{Symbol{name: "quote"}, p.readDatum(depth)}
+	case '`':
+		p.nextChar()
+		inner := depth
+		if depth > 0 {
+			inner++
+		}
+		datum = List{Symbol{name: "quasiquote"}, p.readDatum(inner)}
+	case ',':
+		p.nextChar()
+		splice := p.currentChar == '@'
+		name := "unquote"
+		if splice {
 			p.nextChar()
-			break
+			name = "unquote-splicing"
+		}
+		if depth == 1 {
+			return &unquote{expr: p.ParseExpression(), splice: splice}
 		}
+		inner := depth
+		if depth > 1 {
+			inner--
+		}
+		datum = List{Symbol{name: name}, p.readDatum(inner)}
+	case '"':
+		datum = String(p.readString())
+	case ':':
+		// Kept so that type annotations can be passed to macros
 		p.nextChar()
+		datum = Symbol{name: ":"}
+	default:
+		signed := (p.currentChar == '-' || p.currentChar == '+') && isDecimalDigit(p.peekChar())
+		if isDecimalDigit(p.currentChar) || signed || p.currentChar == '#' {
+			switch node := p.parseExpression().(type) {
+			case *IntegerNode:
+				return node.value
+			case *FloatNode:
+				return node.value
+			}
+		}
+		name := p.readIdentifier()
+		if name == "" {
+			p.errorf("unexpected character %q", p.currentChar)
+		}
+		if !p.isDelimiter() {
+			p.errorf("expected a delimiter after %s got %q", name, p.currentChar)
+		}
+		datum = Symbol{name: name}
 	}
-	return identifier
+	p.skipWhitespace()
+	return datum
 }
 
+// parseMacro reads (defmacro name (params... . rest) body...) and registers
+// the macro, the body is expanded straight away so it can use earlier macros
+func (p *Parser) parseMacro() ASTNode {
+	p.skipWhitespace()
+	macro := &MacroNode{name: p.readIdentifier()}
+	if macro.name == "" {
+		p.errorf("expected macro name")
+	}
+	if Includes(specialForms, macro.name) || Includes(builtInOperations, macro.name) {
+		p.errorf("%s is a builtin and can not be redefined", macro.name)
+	}
+	if existing := p.macros[macro.name]; existing != nil && !existing.prelude {
+		p.errorf("macro %s is already defined", macro.name)
+	}
+	p.skipWhitespace()
+	p.expect('(')
+	p.nextChar()
+	p.skipWhitespace()
+	for !p.isEndOfInput() && p.currentChar != ')' {
+		if p.currentChar == '.' {
+			p.nextChar()
+			p.skipWhitespace()
+			macro.rest = p.readIdentifier()
+			if macro.rest == "" {
+				p.errorf("expected a rest parameter after .")
+			}
+			p.skipWhitespace()
+			break
+		}
+		parameter := p.readIdentifier()
+		if parameter == "" || !p.isDelimiter() {
+			p.errorf("expected parameter name")
+		}
+		macro.parameters = append(macro.parameters, parameter)
+		p.skipWhitespace()
+	}
+	p.expect(')')
+	p.nextChar()
+	p.skipWhitespace()
+	macro.body = p.expandAll(p.parseSExprArgs())
+	p.nextChar()
+	p.macros[macro.name] = macro
+	return macro
+}
+
+// ParseExpression reads one expression and records where it is in the source
 func (p *Parser) ParseExpression() ASTNode {
-	var node ASTNode
-	for !p.isEndOfInput() {
+	p.nest()
+	defer p.unnest()
+	p.skipWhitespace()
+	start := p.currentIndex
+	node := p.parseExpression()
+	end := p.currentIndex
+	for end > start && Includes(whiteSpaceChars, rune(p.input[end-1])) {
+		end--
+	}
+	span := Span{Start: start, End: end, Source: p.source}
+	if p.expansion != nil {
+		span = *p.expansion
+	}
+	node.(spanned).setSpan(span)
+	return node
+}
+
+// nest and unnest track how deeply the expression being read is nested
+func (p *Parser) nest() {
+	p.nesting++
+	if p.nesting > maxNesting {
+		p.errorf("expressions are nested more than %d deep", maxNesting)
+	}
+}
+
+func (p *Parser) unnest() {
+	p.nesting--
+}
+
+func (p *Parser) parseExpression() ASTNode {
+	if p.isEndOfInput() {
+		p.errorf("unexpected end of input")
+	}
+	start := p.currentIndex
+	switch p.currentChar {
+	case '(':
+		p.nextChar()
 		p.skipWhitespace()
+		// At the end of this you should be at a non-( and non-space character
+		// An identifier is now read and then two subsequent s expressions are parsed
 		switch p.currentChar {
-		case '(':
-			p.nextChar()
-			p.skipWhitespace()
-			// At the end of this you should be at a non-( and non-space character
-			// An identifier is now read and then two subsequent s expressions are parsed
-			switch p.currentChar {
-			case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm',
-				'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '_', '+', '-', '*', '/', '%', '<', '>', '=':
-				identifier := p.readIdentifier()
-				if identifier == "def" {
-					// Implies this is a function defn
-					// skip the def keyword, go to the function name add it to the node
-					p.skipWhitespace()
-					functionNode := newFunctionNode(p.readIdentifier())
-					p.skipWhitespace()
-					if p.currentChar != '(' {
-						// Should start a () pair to store arguments
-						panic(fmt.Sprintf("Expected ( got %s", string(p.currentChar)))
-					}
-					p.nextChar()
-					// parse the arguments(a list of identifiers)
-					functionNode.arguments = p.parseFunctionArguments()
-					// parse the body(parse an s expression)
-					functionNode.body = p.parseFunctionBody()
-					p.nextChar()
-					return functionNode
+		case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm',
+			'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '_', '+', '-', '*', '/', '%', '<', '>', '=':
+			identifier := p.readIdentifier()
+			if identifier == "def" {
+				// Implies this is a function defn
+				// skip the def keyword, go to the function name add it to the node
+				p.skipWhitespace()
+				name := p.readIdentifier()
+				if name == "" {
+					p.errorf("expected function name")
 				}
-				if identifier == "if" {
-					p.skipWhitespace()
-					if p.currentChar != '(' {
-						panic(fmt.Sprintf("Expected ( got %s", string(p.currentChar)))
-					}
-					condition, ok := p.ParseExpression().(*SExpr)
-					if !ok {
-						panic("Error")
+				functionNode := newFunctionNode(name)
+				p.skipWhitespace()
+				// Should start a () pair to store arguments
+				p.expect('(')
+				p.nextChar()
+				// parse the arguments(a list of identifiers)
+				functionNode.arguments, functionNode.parameterTypes, functionNode.parameterSpans = p.parseFunctionArguments()
+				functionNode.returnType = p.parseReturnType()
+				// parse the body(parse an s expression)
+				functionNode.body = p.parseFunctionBody()
+				p.nextChar()
+				return functionNode
+			}
+			if identifier == "define" {
+				// Globals are only bound at top level, not inside functions or expressions
+				if start != p.formStart {
+					p.errorf("define is only allowed at top level")
+				}
+				p.skipWhitespace()
+				name := p.readIdentifier()
+				if name == "" || !p.isDelimiter() {
+					p.errorf("expected variable name")
+				}
+				p.skipWhitespace()
+				value := p.ParseExpression()
+				p.skipWhitespace()
+				p.expect(')')
+				p.nextChar()
+				return newDefineNode(name, value)
+			}
+			if identifier == "set!" {
+				p.skipWhitespace()
+				name := p.readIdentifier()
+				if name == "" || !p.isDelimiter() {
+					p.errorf("expected variable name")
+				}
+				p.skipWhitespace()
+				value := p.ParseExpression()
+				p.skipWhitespace()
+				p.expect(')')
+				p.nextChar()
+				return &SetNode{name: name, value: value}
+			}
+			if identifier == "while" {
+				condition := p.parseCondition("while")
+				body := p.parseSExprArgs()
+				p.nextChar()
+				return &WhileNode{condition: condition, body: body}
+			}
+			if identifier == "do" {
+				bindings := p.parseBindings("do")
+				p.skipWhitespace()
+				p.expect('(')
+				p.nextChar()
+				test := p.parseCondition("do")
+				result := p.parseSExprArgs()
+				p.nextChar()
+				p.skipWhitespace()
+				body := p.parseSExprArgs()
+				p.nextChar()
+				return &DoNode{bindings: bindings, test: test, result: result, body: body}
+			}
+			if identifier == "let" {
+				bindings := p.parseBindings("let")
+				p.skipWhitespace()
+				body := p.parseSExprArgs()
+				p.nextChar()
+				return &LetNode{bindings: bindings, body: body}
+			}
+			if identifier == "defmacro" {
+				if start != p.formStart {
+					p.errorf("defmacro is only allowed at top level")
+				}
+				return p.parseMacro()
+			}
+			if identifier == "import" || identifier == "require" {
+				if start != p.formStart {
+					p.errorf("%s is only allowed at top level", identifier)
+				}
+				p.skipWhitespace()
+				node := &ImportNode{required: identifier == "require"}
+				if node.required {
+					node.path = p.readIdentifier()
+				} else {
+					node.path = p.readString()
+				}
+				if node.path == "" {
+					p.errorf("expected the module to %s", identifier)
+				}
+				p.skipWhitespace()
+				p.expect(')')
+				p.nextChar()
+				if p.loader == nil {
+					p.errorAt(start, "modules can only be imported by programs read from a file")
+				}
+				node.module = p.loader.importModule(p, node, start)
+				return node
+			}
+			if identifier == "export" {
+				if start != p.formStart {
+					p.errorf("export is only allowed at top level")
+				}
+				node := &ExportNode{}
+				p.skipWhitespace()
+				for !p.isEndOfInput() && p.currentChar != ')' {
+					name := p.readIdentifier()
+					if name == "" || !p.isDelimiter() {
+						p.errorf("expected a name to export")
 					}
+					node.names = append(node.names, name)
 					p.skipWhitespace()
-					trueExpr := p.ParseExpression()
-					p.skipWhitespace()
-					var falseExpr ASTNode
-					if p.currentChar == '(' || unicode.IsDigit(rune(p.currentChar)) || unicode.IsLetter(rune(p.currentChar)) {
-						falseExpr = p.ParseExpression()
-					} else {
-						falseExpr = nil
-					}
-					if p.currentChar != ')' {
-						panic(fmt.Sprintf("Expected ) got %s", string(p.currentChar)))
-					}
-					p.nextChar()
-					return &IfNode{
-						condition,
-						trueExpr,
-						falseExpr,
-					}
 				}
-				sexpr := newSExpr(identifier)
+				p.expect(')')
+				p.nextChar()
+				return node
+			}
+			if identifier == "extern" || identifier == "defcfun" {
+				if start != p.formStart {
+					p.errorf("%s is only allowed at top level", identifier)
+				}
+				return p.parseExtern()
+			}
+			if identifier == "error" {
 				p.skipWhitespace()
-				sexpr.arguments = p.parseSExprArgs()
-				if p.currentChar != ')' {
-					panic(fmt.Sprintf("Should be a ) here, got %s", string(p.currentChar)))
+				if p.currentChar != '"' {
+					p.errorf("error expects a message string")
 				}
+				message := p.readString()
+				p.skipWhitespace()
+				irritants := p.parseSExprArgs()
 				p.nextChar()
-				return sexpr
-			default:
-				panic("Invalid operand " + string(p.currentChar))
+				return &ErrorNode{message: message, irritants: irritants}
 			}
-		case '1', '2', '3', '4', '5', '6', '7', '8', '9', '0':
-			value, err := strconv.Atoi(string(p.currentChar))
-			p.nextChar()
-			for unicode.IsNumber(rune(p.currentChar)) {
-				newValue, err := strconv.Atoi(string(p.currentChar))
-				if err != nil {
-					panic(err)
+			if identifier == "catch" {
+				p.skipWhitespace()
+				arguments := p.parseSExprArgs()
+				if len(arguments) != 2 {
+					p.errorAt(start, "catch expects an expression and a handler, got %d arguments", len(arguments))
 				}
-				value = value*10 + newValue
 				p.nextChar()
+				return &CatchNode{body: arguments[:1], handler: arguments[1:]}
 			}
-			if err != nil {
-				panic(err)
+			if identifier == "guard" {
+				p.skipWhitespace()
+				p.expect('(')
+				p.nextChar()
+				p.skipWhitespace()
+				variable := p.readIdentifier()
+				if variable == "" || !p.isDelimiter() {
+					p.errorf("expected the variable guard binds to the error")
+				}
+				p.skipWhitespace()
+				handler := p.parseSExprArgs()
+				p.nextChar()
+				p.skipWhitespace()
+				body := p.parseSExprArgs()
+				p.nextChar()
+				return &CatchNode{variable: variable, body: body, handler: handler}
 			}
-			// Reaches the non numeric character, has to be a space/) can put an asssert here
-			if p.currentChar != ' ' && p.currentChar != ')' {
-				panic(fmt.Sprintf("Should be a ' ' or ) here got %s", string(p.currentChar)))
+			if identifier == "dynamic-wind" {
+				p.skipWhitespace()
+				arguments := p.parseSExprArgs()
+				if len(arguments) != 3 {
+					p.errorAt(start, "dynamic-wind expects before, body and after expressions, got %d arguments", len(arguments))
+				}
+				p.nextChar()
+				return &WindNode{before: arguments[0], body: arguments[1], after: arguments[2]}
 			}
-			p.skipWhitespace()
-			// Should reach an identifier or an s expression or a number
-			node = newIntegerNode(value)
-			return node
-		case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm',
-			'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '_':
-			ident := p.readIdentifier()
-			if p.currentChar != ' ' && p.currentChar != ')' {
-				panic("Should be a ' ' or ) here")
+			if identifier == "quote" {
+				p.skipWhitespace()
+				datum := p.readDatum(0)
+				p.expect(')')
+				p.nextChar()
+				return &QuoteNode{datum: datum}
+			}
+			if identifier == "if" {
+				condition := p.parseCondition("if")
+				trueExpr := p.ParseExpression()
+				p.skipWhitespace()
+				var falseExpr ASTNode
+				if !p.isEndOfInput() && p.currentChar != ')' {
+					falseExpr = p.ParseExpression()
+					p.skipWhitespace()
+				}
+				p.expect(')')
+				p.nextChar()
+				return &IfNode{
+					condition: condition,
+					trueExpr:  trueExpr,
+					falseExpr: falseExpr,
+				}
+			}
+			if macro, ok := p.macros[identifier]; ok {
+				call := &MacroCallNode{macro: macro, topLevel: start == p.formStart}
+				p.skipWhitespace()
+				for !p.isEndOfInput() && p.currentChar != ')' {
+					call.arguments = append(call.arguments, p.readDatum(0))
+				}
+				p.expect(')')
+				p.nextChar()
+				return call
 			}
+			sexpr := newSExpr(identifier)
 			p.skipWhitespace()
-			return newIdentifierNode(ident)
-		case '&':
+			sexpr.arguments = p.parseSExprArgs()
 			p.nextChar()
-			p.skipWhitespace()
-			return newReferenceNode(p.ParseExpression())
+			return sexpr
 		default:
-			fmt.Println(string(p.currentChar))
-			panic("Should'nt hit here")
+			if p.isEndOfInput() {
+				p.errorf("unexpected end of input")
+			}
+			p.errorf("invalid operand %q", p.currentChar)
+		}
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9', '0':
+		return p.parseNumber()
+	case '-', '+':
+		// A sign directly followed by a digit is a signed literal, -5
+		if isDecimalDigit(p.peekChar()) {
+			return p.parseNumber()
 		}
+	case '#':
+		return p.parseRadixNumber()
+	case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm',
+		'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z', '_':
+		ident := p.readIdentifier()
+		if !p.isDelimiter() {
+			p.errorf("expected a delimiter after %s got %q", ident, p.currentChar)
+		}
+		p.skipWhitespace()
+		return newIdentifierNode(ident)
+	case '&':
+		p.nextChar()
+		p.skipWhitespace()
+		return newReferenceNode(p.ParseExpression())
+	case '"':
+		return &StringNode{value: p.readString()}
+	case '\'':
+		p.nextChar()
+		return &QuoteNode{datum: p.readDatum(0)}
+	case '`':
+		p.nextChar()
+		return &QuasiquoteNode{template: p.readDatum(1)}
+	case ',':
+		p.errorf("unquote outside of a quasiquote")
 	}
-	return node
+	p.errorf("unexpected character %q", p.currentChar)
+	return nil
 }
 
-func (p *Parser) Parse() []ASTNode {
-	astNodeArray := make([]ASTNode, 0)
+// Parse reads every top level expression in the input and expands the macro
+// calls in it. Malformed input and failed expansions are reported as a
+// *ParseError instead of a panic.
+func (p *Parser) Parse() (astNodeArray []ASTNode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			parseErr, ok := r.(*ParseError)
+			if !ok {
+				panic(r)
+			}
+			astNodeArray, err = nil, parseErr
+		}
+	}()
+	astNodeArray = make([]ASTNode, 0)
+	p.skipWhitespace()
 	for !p.isEndOfInput() {
+		p.formStart = p.currentIndex
 		astNodeArray = append(astNodeArray, p.ParseExpression())
 		p.skipWhitespace()
 	}
-	return astNodeArray
+	return p.withPrelude(p.expandProgram(astNodeArray)), nil
+}
+
+// spanned is implemented by every node through the embedded Span
+type spanned interface {
+	setSpan(span Span)
+	sourceSpan() Span
+}
+
+func (s *Span) setSpan(span Span) {
+	*s = span
+}
+
+func (s *Span) sourceSpan() Span {
+	return *s
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at offset %d: %s", e.Offset, e.Message)
 }
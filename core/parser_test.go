@@ -1,8 +1,10 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -12,20 +14,23 @@ func TestWithoutElse(t *testing.T) {
 		evaluated int
 	}
 	inputs := []TestCase{
-		{input: "(def is_small (x) (if (< x 5) 1))(def main() (is_small 3)", evaluated: 1},
+		{input: "(def is_small (x) (if (< x 5) 1))(def main() (is_small 3))", evaluated: 1},
 		{
-			input: "(def is_small (x) (if (< x 5) 1) 0)(def main() (is_small 7)", evaluated: 0,
+			input: "(def is_small (x) (if (< x 5) 1) 0)(def main() (is_small 7))", evaluated: 0,
 		},
 	}
 	for _, input := range inputs {
 		parser := NewParser(input.input)
 		scope := &InterpreterScope{inner: make(map[string]ASTNode), outer: nil}
-		var evaluated int
-		expressions := parser.Parse()
+		var evaluated Value
+		expressions, err := parser.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
 		for _, expression := range expressions {
 			evaluated = expression.Eval(scope)
 		}
-		if evaluated != input.evaluated {
+		if evaluated != Fixnum(input.evaluated) {
 			t.Errorf(fmt.Sprintf("Expected %d, got %d", input.evaluated, evaluated))
 		}
 	}
@@ -41,19 +46,22 @@ func TestFunctionEval(t *testing.T) {
 		{input: "(def plus_two(a) (+ a 2)) (def main() (plus_two 3) )", evaluated: 5},
 		{input: "(def add_two(a b) (+ a (+ b 2))) (def main() (add_two 1 2))", evaluated: 5},
 		{input: "(def main() (if (< 3 2) 1 0))", evaluated: 0},
-		{input: "(def is_small (x) (if (< x 5) 1 0))(def main() (is_small 3)", evaluated: 1},
-		{input: "(def is_small (x) (if (< x 5) 1 0))(def main() (is_small 6)", evaluated: 0},
+		{input: "(def is_small (x) (if (< x 5) 1 0))(def main() (is_small 3))", evaluated: 1},
+		{input: "(def is_small (x) (if (< x 5) 1 0))(def main() (is_small 6))", evaluated: 0},
 		{input: "(def fib (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))) (def main () (fib 8))", evaluated: 21},
 	}
 	for _, input := range inputs {
 		parser := NewParser(input.input)
 		scope := &InterpreterScope{inner: make(map[string]ASTNode), outer: nil}
-		var evaluated int
-		expressions := parser.Parse()
+		var evaluated Value
+		expressions, err := parser.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
 		for _, expression := range expressions {
 			evaluated = expression.Eval(scope)
 		}
-		if evaluated != input.evaluated {
+		if evaluated != Fixnum(input.evaluated) {
 			t.Errorf(fmt.Sprintf("Expected %d, got %d", input.evaluated, evaluated))
 		}
 	}
@@ -146,8 +154,294 @@ func TestParserSExpr(t *testing.T) {
 		scope := &InterpreterScope{inner: make(map[string]ASTNode), outer: nil}
 		evaled := parser.ParseExpression().Eval(scope)
 		output := testCase.output
-		if evaled != output {
+		if evaled != Fixnum(output) {
 			t.Errorf("Evaluation incorrect, expected %d, got %d\n", evaled, output)
 		}
 	}
 }
+
+func TestParserErrors(t *testing.T) {
+	inputs := []string{
+		"(",
+		")",
+		"(+ 1 2",
+		"(+ 1 2))",
+		"(def",
+		"(def main",
+		"(def main (1) 2)",
+		"(def main() (+ 1 2)",
+		"(if x 1 2)",
+		"(if (< 1 2) 1 2",
+		"()",
+		"(+ 1a)",
+		"A",
+		"(extern)",
+		"(extern f i32)",
+		"(extern f (i32))",
+		"(def main() (extern f () i32))",
+		"(f \"abc)",
+		"(f \"\\q\")",
+		"(error x)",
+		"(catch 1)",
+		"(catch 1 2 3)",
+		"(guard e 1)",
+		"(guard (1 e) 1)",
+		"(dynamic-wind 1 2)",
+	}
+	for _, input := range inputs {
+		_, err := NewParser(input).Parse()
+		if err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserNestingLimit(t *testing.T) {
+	inputs := []string{
+		strings.Repeat("(a ", 2_000_000),
+		strings.Repeat("'", 2_000_000) + "a",
+		"(def main() '" + strings.Repeat("(", 2_000_000) + ")",
+	}
+	for _, input := range inputs {
+		_, err := NewParser(input).Parse()
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || !strings.Contains(parseErr.Message, "nested more than") {
+			t.Errorf("Expected a nesting error for %.20q..., got %v", input, err)
+		}
+	}
+	nested := strings.Repeat("(+ 1 ", 1000) + "1" + strings.Repeat(")", 1000)
+	if _, err := NewParser("(def main() " + nested + ")").Parse(); err != nil {
+		t.Errorf("Expected 1000 nested calls to parse, got %v", err)
+	}
+}
+
+func TestParserEmptyInput(t *testing.T) {
+	for _, input := range []string{"", " ", "\n\t "} {
+		expressions, err := NewParser(input).Parse()
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", input, err)
+		}
+		if len(expressions) != 0 {
+			t.Errorf("Expected no expressions for %q, got %d", input, len(expressions))
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		"(def main() (+ 1 2))",
+		"(def fib (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))) (def main () (fib 8))",
+		"(def is_small (x) (if (< x 5) 1))(def main() (is_small 3))",
+		"(def main() (sys_write 1 &72 1))",
+		"(+ (/ 7 2) (* 2 3 4) )",
+		"(def main() (guard (e e) (catch (error \"bad\" 1) (dynamic-wind 1 2 3))))",
+		"(defmacro m () (while (< 0 1) 1))(m)",
+		"(defmacro m () (<))(m)",
+		"(defmacro m () (-))(m)",
+		strings.Repeat("(a ", 20_000),
+		strings.Repeat("'", 20_000) + "a",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		expressions, err := NewParser(input).Parse()
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("Expected a *ParseError, got %T", err)
+			}
+			return
+		}
+		for _, expression := range expressions {
+			if expression == nil {
+				t.Errorf("Parse returned a nil expression for %q", input)
+			}
+		}
+	})
+}
+
+func TestParserNumberLiterals(t *testing.T) {
+	type TestCase struct {
+		input  string
+		output string
+	}
+	testCases := []TestCase{
+		{input: "-5", output: "-5"},
+		{input: "+5", output: "5"},
+		{input: "-2.5", output: "-2.5"},
+		{input: "-1e-3", output: "-0.001"},
+		{input: "-123456789012345678901234567890", output: "-123456789012345678901234567890"},
+		{input: "#x1F", output: "31"},
+		{input: "#xff", output: "255"},
+		{input: "#x-1F", output: "-31"},
+		{input: "#b101", output: "5"},
+		{input: "#o17", output: "15"},
+		{input: "#d10", output: "10"},
+		{input: "#xFFFFFFFFFFFFFFFFFFFF", output: "1208925819614629174706175"},
+		{input: "1_000_000", output: "1000000"},
+		{input: "#b1111_0000", output: "240"},
+		{input: "1_000.000_5", output: "1000.0005"},
+		{input: "(+ -1 -2)", output: "-3"},
+		{input: "(- -5)", output: "5"},
+	}
+	for _, testCase := range testCases {
+		expressions, err := NewParser(testCase.input).Parse()
+		if err != nil {
+			t.Errorf("%s: %s", testCase.input, err)
+			continue
+		}
+		scope := NewInterpreterScope(nil)
+		if evaled := expressions[0].Eval(scope); evaled.String() != testCase.output {
+			t.Errorf("%s: expected %s, got %s", testCase.input, testCase.output, evaled)
+		}
+	}
+	for _, input := range []string{"-", "(+ 1 -)", "#", "#z10", "#x", "#b102", "1__0", "1_", "_1", "1._5", "- 5"} {
+		if _, err := NewParser(input).Parse(); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserDefine(t *testing.T) {
+	expressions, err := NewParser("(define x (+ 1 2))\n(define y x)").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expressions) != 2 {
+		t.Fatalf("Expected 2 expressions, got %d", len(expressions))
+	}
+	define, ok := expressions[0].(*DefineNode)
+	if !ok || define.name != "x" {
+		t.Fatalf("Expected a define of x, got %#v", expressions[0])
+	}
+	if _, ok := define.value.(*SExpr); !ok {
+		t.Errorf("Expected the value of x to be an s expression, got %#v", define.value)
+	}
+	for _, input := range []string{"(define)", "(define 1 2)", "(define x)", "(define x 1 2)", "(def main() (define x 1) x)", "(+ (define x 1) 2)"} {
+		if _, err := NewParser(input).Parse(); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserLoops(t *testing.T) {
+	expressions, err := NewParser("(set! x (+ x 1)) (while (< x 10) (set! x (+ x 1)) x) (do ((i 0 (+ i 1)) (j 5)) ((= i j) i j) (print i))").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set, ok := expressions[0].(*SetNode); !ok || set.name != "x" {
+		t.Errorf("Expected a set! of x, got %#v", expressions[0])
+	}
+	if while, ok := expressions[1].(*WhileNode); !ok || while.condition.operand != "<" || len(while.body) != 2 {
+		t.Errorf("Expected a while loop with two body expressions, got %#v", expressions[1])
+	}
+	do, ok := expressions[2].(*DoNode)
+	if !ok {
+		t.Fatalf("Expected a do loop, got %#v", expressions[2])
+	}
+	if len(do.bindings) != 2 || do.bindings[0].step == nil || do.bindings[1].step != nil {
+		t.Errorf("Expected a stepped and an unstepped binding, got %#v", do.bindings)
+	}
+	if do.test.operand != "=" || len(do.result) != 2 || len(do.body) != 1 {
+		t.Errorf("Unexpected do loop %#v", do)
+	}
+	for _, input := range []string{"(set! 1 2)", "(set! x)", "(set! x 1 2)", "(while x)", "(while (< 1 2)", "(do (i 0) ((= i 1)))", "(do ((i)) ((= i 1)))", "(do ((i 0 1 2)) ((= i 1)))", "(do ((i 0)) (= i 1))", "(do ((i 0)))", "(let ((x 1 2)) x)", "(let (x 1) x)", "(let ((x 1)) x"} {
+		if _, err := NewParser(input).Parse(); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserTypeAnnotations(t *testing.T) {
+	expressions, err := NewParser("(def scale(v (k : float) (xs : (list int))) : float (* k 2.0))").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	function := expressions[0].(*FunctionNode)
+	if fmt.Sprint(function.arguments) != "[v k xs]" {
+		t.Errorf("Expected arguments v k xs, got %v", function.arguments)
+	}
+	if function.parameterTypes[0] != nil || function.parameterTypes[1].name != "float" {
+		t.Errorf("Expected v unannotated and k a float, got %v", function.parameterTypes)
+	}
+	if list := function.parameterTypes[2]; list.name != "list" || len(list.args) != 1 || list.args[0].name != "int" {
+		t.Errorf("Expected xs to be a list of int, got %#v", list)
+	}
+	if function.returnType == nil || function.returnType.name != "float" {
+		t.Errorf("Expected a float return type, got %#v", function.returnType)
+	}
+	for _, input := range []string{"(def f((a int)) a)", "(def f((a :)) a)", "(def f((a : int) a)", "(def f(a) : 1)", "(def f(a) :)", "(def f((1 : int)) 1)"} {
+		if _, err := NewParser(input).Parse(); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserQuote(t *testing.T) {
+	expressions, err := NewParser("'(a 1 (b -2)) `(a ,b ,@(c) `(d ,e))").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote, ok := expressions[0].(*QuoteNode); !ok || quote.datum.String() != "(a 1 (b -2))" {
+		t.Errorf("Expected a quoted list, got %#v", expressions[0])
+	}
+	quasiquote, ok := expressions[1].(*QuasiquoteNode)
+	if !ok {
+		t.Fatalf("Expected a quasiquote, got %#v", expressions[1])
+	}
+	// The nested quasiquote keeps its unquote as data
+	holes := templateHoles(quasiquote.template, nil)
+	if len(holes) != 2 || holes[0].splice || !holes[1].splice {
+		t.Errorf("Expected a hole and a splice, got %v", holes)
+	}
+	for _, input := range []string{",x", "'(a", "(defmacro)", "(defmacro if (x) x)", "(defmacro m (. ) 1)", "(def f() (defmacro m () 1))", "(defmacro m () 1) (defmacro m () 2)"} {
+		if _, err := NewParser(input).Parse(); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParserExtern(t *testing.T) {
+	expressions, err := NewParser("(extern puts (ptr) i32) (defcfun pow (double double) double) (puts \"a\\tb\\n\\\"c\\\\\")").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extern, ok := expressions[0].(*ExternNode); !ok || extern.name != "puts" || fmt.Sprint(extern.parameters) != "[ptr]" || extern.result != "i32" {
+		t.Errorf("Expected an extern for puts, got %#v", expressions[0])
+	}
+	if extern, ok := expressions[1].(*ExternNode); !ok || extern.name != "pow" || fmt.Sprint(extern.parameters) != "[double double]" {
+		t.Errorf("Expected an extern for pow, got %#v", expressions[1])
+	}
+	call := expressions[2].(*SExpr)
+	if str, ok := call.arguments[0].(*StringNode); !ok || str.value != "a\tb\n\"c\\" {
+		t.Errorf("Expected an escaped string, got %#v", call.arguments[0])
+	}
+}
+
+func TestMacroExpansionErrors(t *testing.T) {
+	type TestCase struct {
+		input   string
+		message string
+	}
+	testCases := []TestCase{
+		{input: "(defmacro twice (x) `(+ ,x ,x)) (def main() (twice))", message: "twice expects 1 arguments, got 0"},
+		{input: "(defmacro first (. xs) (car xs)) (def main() (first))", message: "error expanding first: Error: car of an empty list"},
+		{input: "(defmacro forever () `(forever)) (def main() (forever))", message: "expansion of forever is nested too deeply"},
+		{input: "(defmacro broken () '(let x)) (def main() (broken))", message: "in expansion of broken, (let x): expected '(' got 'x'"},
+		{input: "(defmacro spin () (while (< 0 1) 1)) (def main() (spin))", message: "error expanding spin: steps limit of 1000000 exceeded"},
+		{input: "(defmacro less () (<)) (def main() (less))", message: "error expanding less: Error: comparison < can only be used as a condition"},
+		{input: "(defmacro minus () (-)) (def main() (minus))", message: "error expanding minus: Error: - expects at least one argument"},
+	}
+	for _, testCase := range testCases {
+		_, err := NewParser(testCase.input).Parse()
+		parseErr, ok := err.(*ParseError)
+		if !ok || parseErr.Message != testCase.message {
+			t.Errorf("%s: expected %q, got %v", testCase.input, testCase.message, err)
+			continue
+		}
+		// Errors are reported at the call the expansion came from
+		if call := strings.Index(testCase.input, "(def main() ") + len("(def main() "); parseErr.Offset != call {
+			t.Errorf("%s: expected the error at %d, got %d", testCase.input, call, parseErr.Offset)
+		}
+	}
+}
@@ -1,47 +1,233 @@
 package core
 
+// Span is the byte range of a node in the source, End is exclusive. Source
+// is the file the node was read from, nil when the parser wasn't given one.
+type Span struct {
+	Start  int
+	End    int
+	Source *SourceFile
+}
+
+// SourceFile is a file a program was read from
+type SourceFile struct {
+	Path  string
+	Input string
+}
+
 type ASTNode interface {
-	Eval(scope *InterpreterScope) int
+	Eval(scope *InterpreterScope) Value
 	Codegen(asm *string, symbol string, scope *CompilerScope)
 }
 
 type IntegerNode struct {
-	value int
+	Span
+	value Value
+}
+
+type FloatNode struct {
+	Span
+	value Flonum
 }
 
 type SExpr struct {
+	Span
 	operand   string
 	arguments []ASTNode
 }
 
 type FunctionNode struct {
-	name      string
-	arguments []string
+	Span
+	name           string
+	arguments      []string
+	parameterTypes []*TypeAnnotation
+	// parameterSpans is where each parameter is written
+	parameterSpans []Span
+	returnType     *TypeAnnotation
+	body           []ASTNode
+	scope          *InterpreterScope
+}
+
+// TypeAnnotation is a type written in the source, int or (list float)
+type TypeAnnotation struct {
+	Span
+	name string
+	args []*TypeAnnotation
+}
+
+// DefineNode binds a global variable, (define name expr)
+type DefineNode struct {
+	Span
+	name  string
+	value ASTNode
+}
+
+// SetNode assigns to an existing local or global binding, (set! name expr)
+type SetNode struct {
+	Span
+	name  string
+	value ASTNode
+}
+
+// WhileNode runs body for as long as condition holds, (while (cond) body...)
+type WhileNode struct {
+	Span
+	condition *SExpr
 	body      []ASTNode
-	scope     *InterpreterScope
+}
+
+// DoNode is the scheme do loop,
+// (do ((name init step)...) (test result...) body...)
+// the loop ends once test holds and evaluates to the last result expression
+type DoNode struct {
+	Span
+	bindings []Binding
+	test     *SExpr
+	result   []ASTNode
+	body     []ASTNode
+}
+
+// LetNode binds local variables for its body, (let ((name value)...) body...)
+// the values are all evaluated before any name is bound
+type LetNode struct {
+	Span
+	bindings []Binding
+	body     []ASTNode
+}
+
+// Binding is a variable introduced by let or do, only do bindings have a step
+type Binding struct {
+	name string
+	init ASTNode
+	step ASTNode
 }
 
 type IdentifierNode struct {
+	Span
 	name string
 }
 
 type IfNode struct {
+	Span
 	condition *SExpr
 	trueExpr  ASTNode
 	falseExpr ASTNode
 }
 
 type ReferenceNode struct {
+	Span
 	value ASTNode
 }
 
+// QuoteNode is a literal datum, 'x or (quote x)
+type QuoteNode struct {
+	Span
+	datum Value
+}
+
+// QuasiquoteNode is a template, `(a ,b ,@c), the unquoted holes are
+// expressions filled in when it is evaluated
+type QuasiquoteNode struct {
+	Span
+	template Value
+}
+
+// unquote is a hole in a quasiquote template, ,expr or ,@expr
+type unquote struct {
+	expr   ASTNode
+	splice bool
+}
+
+// MacroNode is (defmacro name (params... . rest) body...), the body runs in
+// the interpreter while the program is expanded
+type MacroNode struct {
+	Span
+	name       string
+	parameters []string
+	rest       string
+	body       []ASTNode
+	// prelude macros can be redefined by the program
+	prelude bool
+}
+
+// MacroCallNode is a use of a macro, the arguments are read as data and the
+// call is replaced by its expansion before either engine sees it
+type MacroCallNode struct {
+	Span
+	macro     *MacroNode
+	arguments []Value
+	topLevel  bool
+}
+
+// ImportNode is (import "path/to/lib.lisp") or (require lib), the module is
+// read as soon as the import is parsed
+type ImportNode struct {
+	Span
+	path     string
+	required bool
+	module   *module
+}
+
+// ExportNode lists the names a module lets its importers use, (export f g)
+type ExportNode struct {
+	Span
+	names []string
+}
+
+// ExternNode declares a C function compiled programs call directly,
+// (extern puts (ptr) i32). (defcfun ...) is the same form.
+type ExternNode struct {
+	Span
+	name       string
+	parameters []string
+	result     string
+}
+
+// StringNode is a "string" literal, strings can only be passed to foreign
+// functions
+type StringNode struct {
+	Span
+	value string
+}
+
+// ErrorNode is (error "message" irritants...), it raises an error the
+// enclosing catch, guard or dynamic-wind can handle
+type ErrorNode struct {
+	Span
+	message   string
+	irritants []ASTNode
+}
+
+// CatchNode is (catch expr handler) and (guard (variable handler...)
+// body...), the handler runs instead of the rest of the body if the body
+// raises an error. A guard binds variable to the error's first irritant.
+type CatchNode struct {
+	Span
+	variable string
+	body     []ASTNode
+	handler  []ASTNode
+}
+
+// WindNode is (dynamic-wind before body after), after runs whether or not
+// the body raises an error
+type WindNode struct {
+	Span
+	before ASTNode
+	body   ASTNode
+	after  ASTNode
+}
+
 type FunctionStore struct {
 	store map[string]*FunctionNode
 }
 
 type InterpreterScope struct {
-	inner map[string]ASTNode
-	outer *InterpreterScope
+	inner  map[string]ASTNode
+	outer  *InterpreterScope
+	budget *budget
+	calls  *callStack
+	// expansion is the expansion whose macro the scope belongs to, quote
+	// and quasiquote mark the symbols they produce with it
+	expansion int
 }
 
 type CompilerScope struct {
@@ -53,5 +239,36 @@ type Parser struct {
 	input        string
 	currentIndex int
 	currentChar  byte
+	formStart    int
 	AST          *ASTNode
+	macros       map[string]*MacroNode
+	// expansion is the span of the macro call whose expansion is being read,
+	// nodes read from an expansion are reported at the call
+	expansion *Span
+	depth     int
+	// nesting is how many expressions and data the one being read is in
+	nesting int
+	// prelude holds the definitions UsePrelude read
+	prelude []ASTNode
+	source  *SourceFile
+	// loader reads imported modules, imports are an error without one
+	loader *Loader
+	module *module
+	// budget bounds the macros the parser runs, like the program they are in
+	budget *budget
+	// nextExpansion numbers expansions, the parsers of one program share it
+	// so the names expansions bind are unique within it
+	nextExpansion func() int
+}
+
+type ParseError struct {
+	Offset  int
+	Message string
+	Source  *SourceFile
+}
+
+// Diagnostic is a problem found by Check, it points at the offending node
+type Diagnostic struct {
+	Span    Span
+	Message string
 }
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"lisp-compiler/stdlib"
+)
+
+// UsePrelude reads the standard prelude ahead of the program. Its macros can
+// be used by the program and Parse puts its definitions in front of the
+// program's, leaving out any the program defines itself.
+func (p *Parser) UsePrelude() error {
+	prelude := NewParser(stdlib.Prelude)
+	prelude.macros = p.macros
+	prelude.nextExpansion = p.nextExpansion
+	prelude.source = &SourceFile{Path: "stdlib/prelude.lisp", Input: stdlib.Prelude}
+	definitions, err := prelude.Parse()
+	if err != nil {
+		return err
+	}
+	for _, macro := range p.macros {
+		macro.prelude = true
+	}
+	p.prelude = definitions
+	return nil
+}
+
+func (p *Parser) withPrelude(program []ASTNode) []ASTNode {
+	if len(p.prelude) == 0 {
+		return program
+	}
+	defined := make(map[string]bool)
+	for _, node := range program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			defined[node.name] = true
+		case *DefineNode:
+			defined[node.name] = true
+		case *ExternNode:
+			defined[node.name] = true
+		}
+	}
+	combined := make([]ASTNode, 0, len(p.prelude)+len(program))
+	for _, node := range p.prelude {
+		function, ok := node.(*FunctionNode)
+		if ok && defined[function.name] {
+			continue
+		}
+		combined = append(combined, node)
+	}
+	return append(combined, program...)
+}
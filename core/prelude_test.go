@@ -0,0 +1,83 @@
+package core
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func parseWithPrelude(t *testing.T, input string) []ASTNode {
+	t.Helper()
+	parser := NewParser(input)
+	if err := parser.UsePrelude(); err != nil {
+		t.Fatal(err)
+	}
+	expressions, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expressions
+}
+
+func TestPreludeIsWellFormed(t *testing.T) {
+	expressions := parseWithPrelude(t, "")
+	if len(expressions) == 0 {
+		t.Fatal("Expected the prelude to define functions")
+	}
+	if diagnostics := Check(expressions); len(diagnostics) != 0 {
+		t.Errorf("Unexpected diagnostics in the prelude %v", diagnostics)
+	}
+	if _, diagnostics := InferTypes(expressions); len(diagnostics) != 0 {
+		t.Errorf("Unexpected type errors in the prelude %v", diagnostics)
+	}
+}
+
+// Every case runs in the interpreter and through llvm, both have to print
+// the expected output
+func TestPrelude(t *testing.T) {
+	type TestCase struct {
+		input  string
+		output string
+	}
+	testCases := []TestCase{
+		{input: "(def main() (print (abs -3)) (print (max 2 7)) (print (min 2.5 1.5)) (print (square 9)) 0)", output: "3\n7\n1.5\n81\n"},
+		{input: "(def main() (print (gcd 12 -18)) (print (lcm 4 6)) (print (expt 3 4)) (print (even? 10)) (print (odd? 10)) 0)", output: "6\n12\n81\n1\n0\n"},
+		{input: "(def main() (print (sum)) (print (sum 1 2 3)) (print (product 2 3 4)) (print (maximum 4 9 2)) (print (minimum 4 9 2)) 0)", output: "0\n6\n24\n9\n2\n"},
+		{input: "(def sign(x) (cond ((< x 0) -1) ((= x 0) 0) (else 1))) (def main() (print (sign -4)) (print (sign 0)) (print (sign 4)) 0)", output: "-1\n0\n1\n"},
+		{input: "(def main() (let ((n 0) (limit 3)) (dotimes (i 4) (inc! n) (when (< i limit) (dec! n))) (print n)) 0)", output: "1\n"},
+		{input: "(def main() (let ((a 1) (tmp 2)) (swap! a tmp) (print a) (print tmp)) (unless (< 1 0) (print 5)) 0)", output: "2\n1\n5\n"},
+		{input: "(def main() (write_char 104) (write_char 105) (space) (write_char 33) (newline) 0)", output: "hi !\n"},
+		{input: "(def main() (print 1) (write_char 65) (newline) (print 2) 0)", output: "1\nA\n2\n"},
+	}
+	_, lliErr := exec.LookPath("lli")
+	for _, testCase := range testCases {
+		interpreted := captureStdout(t, func() { NewInterpreterScope(nil).Run(parseWithPrelude(t, testCase.input)) })
+		if interpreted != testCase.output {
+			t.Errorf("%s: expected the interpreter to print %q, got %q", testCase.input, testCase.output, interpreted)
+		}
+		if lliErr != nil {
+			continue
+		}
+		_, stdout, stderr := runModule(t, "lli", compileModule(parseWithPrelude(t, testCase.input)))
+		if stdout != testCase.output {
+			t.Errorf("%s: expected the compiled code to print %q, got %q (%s)", testCase.input, testCase.output, stdout, stderr)
+		}
+	}
+}
+
+func TestPreludeCanBeRedefined(t *testing.T) {
+	input := "(defmacro when (test . body) `(if ,test 42)) (def abs(x) 7) (def main() (+ (when (< 1 2) 0) (abs -1)))"
+	if evaluated := NewInterpreterScope(nil).Run(parseWithPrelude(t, input)); evaluated.String() != "49" {
+		t.Errorf("Expected the program's definitions to win, got %s", evaluated)
+	}
+	if diagnostics := Check(parseWithPrelude(t, input)); len(diagnostics) != 0 {
+		t.Errorf("Unexpected diagnostics %v", diagnostics)
+	}
+	// Without the prelude none of it is defined
+	expressions, err := NewParser("(def main() (gcd 4 6))").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Check(expressions); len(diagnostics) != 1 {
+		t.Errorf("Expected gcd to be undefined without the prelude, got %v", diagnostics)
+	}
+}
@@ -0,0 +1,396 @@
+package core
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// RuntimeCSource is the C half of the runtime (bignums, printing, errors), it
+// is compiled and linked next to the generated module.
+//
+//go:embed runtime/lisp_runtime.c
+var RuntimeCSource string
+
+// Compiled values are tagged i64 words, fixnums have the low bit set and hold a
+// 63 bit integer, anything else is a pointer to an object owned by the C runtime.
+const (
+	fixnumMax = 1<<62 - 1
+	fixnumMin = -1 << 62
+)
+
+// The arithmetic helpers handle fixnums and flonums inline and fall back to the
+// C runtime for bignums and overflow. They live in their own functions so every
+// arithmetic expression compiles to a single call.
+var runtimeSupport = `
+declare i64 @lisp_add(i64, i64)
+declare i64 @lisp_sub(i64, i64)
+declare i64 @lisp_mul(i64, i64)
+declare i64 @lisp_div(i64, i64)
+declare i64 @lisp_rem(i64, i64)
+declare i64 @lisp_mod(i64, i64)
+declare i64 @lisp_compare(i64, i64)
+declare i64 @lisp_big_from_string(i8*)
+declare i64 @lisp_box_double(double)
+declare double @lisp_to_double(i64)
+declare i64 @lisp_print(i64)
+declare i64 @lisp_exit_code(i64)
+declare i64 @lisp_to_int64(i64)
+declare i64 @lisp_from_int64(i64)
+declare void @lisp_raise(i8*, i64, ...)
+declare void @lisp_enter_handler()
+declare void @lisp_leave_handler()
+declare i64 @lisp_catch()
+declare i8* @lisp_suspend_error()
+declare void @lisp_resume_error(i8*)
+@lisp_error_pending = external global i8
+declare {i64, i1} @llvm.sadd.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.ssub.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.smul.with.overflow.i64(i64, i64)
+declare double @llvm.sqrt.f64(double)
+declare double @llvm.floor.f64(double)
+declare double @llvm.roundeven.f64(double)
+
+define internal i1 @__lisp_fixnums(i64 %a, i64 %b) alwaysinline {
+entry:
+	%tags = and i64 %a, %b
+	%tag = and i64 %tags, 1
+	%fixnums = icmp ne i64 %tag, 0
+	ret i1 %fixnums
+}
+
+define internal i1 @__lisp_is_flonum(i64 %a) {
+entry:
+	%tag = and i64 %a, 1
+	%fixnum = icmp ne i64 %tag, 0
+	br i1 %fixnum, label %exact, label %object
+exact:
+	ret i1 false
+object:
+	%pointer = inttoptr i64 %a to i64*
+	%kind = load i64, i64* %pointer
+	%flonum = icmp eq i64 %kind, 2
+	ret i1 %flonum
+}
+
+define internal i1 @__lisp_flonums(i64 %a, i64 %b) {
+entry:
+	%left = call i1 @__lisp_is_flonum(i64 %a)
+	%right = call i1 @__lisp_is_flonum(i64 %b)
+	%either = or i1 %left, %right
+	ret i1 %either
+}
+
+define internal i64 @__lisp_exact_to_inexact(i64 %a) {
+entry:
+	%x = call double @lisp_to_double(i64 %a)
+	%boxed = call i64 @lisp_box_double(double %x)
+	ret i64 %boxed
+}
+
+define internal i64 @__lisp_sqrt(i64 %a) {
+entry:
+	%x = call double @lisp_to_double(i64 %a)
+	%root = call double @llvm.sqrt.f64(double %x)
+	%boxed = call i64 @lisp_box_double(double %root)
+	ret i64 %boxed
+}
+`
+
+// numericTemplate is shared by the binary operators: %[2]s is the fixnum
+// block, which leaves the tagged result in %%value or branches to %%slow, and
+// %[3]s computes %%real from the doubles %%x and %%y.
+var numericTemplate = `
+define internal i64 @__lisp_%[1]s(i64 %%a, i64 %%b) {
+entry:
+	%%fixnums = call i1 @__lisp_fixnums(i64 %%a, i64 %%b)
+	br i1 %%fixnums, label %%fast, label %%inexact
+fast:
+%[2]s	ret i64 %%value
+inexact:
+	%%flonums = call i1 @__lisp_flonums(i64 %%a, i64 %%b)
+	br i1 %%flonums, label %%float, label %%slow
+float:
+	%%x = call double @lisp_to_double(i64 %%a)
+	%%y = call double @lisp_to_double(i64 %%b)
+%[3]s	%%boxed = call i64 @lisp_box_double(double %%real)
+	ret i64 %%boxed
+slow:
+	%%promoted = call i64 @lisp_%[1]s(i64 %%a, i64 %%b)
+	ret i64 %%promoted
+}
+`
+
+// Fixnums are 2n+1, so (a-1)+b, a-(b-1) and (a>>1)*(b-1)+1 stay tagged and
+// the overflow intrinsics catch results outside the 63 bit range.
+var fixnumPaths = map[string]string{
+	"add": `	%untagged = sub i64 %a, 1
+	%result = call {i64, i1} @llvm.sadd.with.overflow.i64(i64 %untagged, i64 %b)
+	%overflow = extractvalue {i64, i1} %result, 1
+	br i1 %overflow, label %slow, label %done
+done:
+	%value = extractvalue {i64, i1} %result, 0
+`,
+	"sub": `	%untagged = sub i64 %b, 1
+	%result = call {i64, i1} @llvm.ssub.with.overflow.i64(i64 %a, i64 %untagged)
+	%overflow = extractvalue {i64, i1} %result, 1
+	br i1 %overflow, label %slow, label %done
+done:
+	%value = extractvalue {i64, i1} %result, 0
+`,
+	"mul": `	%left = ashr i64 %a, 1
+	%right = sub i64 %b, 1
+	%result = call {i64, i1} @llvm.smul.with.overflow.i64(i64 %left, i64 %right)
+	%overflow = extractvalue {i64, i1} %result, 1
+	br i1 %overflow, label %slow, label %done
+done:
+	%product = extractvalue {i64, i1} %result, 0
+	%value = or i64 %product, 1
+`,
+}
+
+// Zero and -1 divisors go to the C runtime, which reports division by zero and
+// promotes the most negative fixnum divided by -1.
+var divisionPathTemplate = `	%%is_zero = icmp eq i64 %%b, 1
+	%%is_minus_one = icmp eq i64 %%b, -1
+	%%special = or i1 %%is_zero, %%is_minus_one
+	br i1 %%special, label %%slow, label %%divide
+divide:
+	%%left = ashr i64 %%a, 1
+	%%right = ashr i64 %%b, 1
+	%%result = %s i64 %%left, %%right
+%s	%%shifted = shl i64 %%untagged, 1
+	%%value = or i64 %%shifted, 1
+`
+
+// modulo takes the sign of the divisor, so a remainder with the wrong sign is
+// moved back into range
+var moduloAdjustment = `	%is_nonzero = icmp ne i64 %result, 0
+	%sign = xor i64 %result, %right
+	%signs_differ = icmp slt i64 %sign, 0
+	%adjust = and i1 %is_nonzero, %signs_differ
+	%adjusted = add i64 %result, %right
+	%untagged = select i1 %adjust, i64 %adjusted, i64 %result
+`
+
+var floatModuloAdjustment = `	%truncated = frem double %x, %y
+	%float_is_nonzero = fcmp une double %truncated, 0.0
+	%float_negative = fcmp olt double %truncated, 0.0
+	%float_divisor_negative = fcmp olt double %y, 0.0
+	%float_signs_differ = xor i1 %float_negative, %float_divisor_negative
+	%float_adjust = and i1 %float_is_nonzero, %float_signs_differ
+	%float_adjusted = fadd double %truncated, %y
+	%real = select i1 %float_adjust, double %float_adjusted, double %truncated
+`
+
+var comparisonTemplate = `
+define internal i1 @__lisp_%[1]s(i64 %%a, i64 %%b) {
+entry:
+	%%fixnums = call i1 @__lisp_fixnums(i64 %%a, i64 %%b)
+	br i1 %%fixnums, label %%fast, label %%inexact
+fast:
+	%%inline = icmp %[2]s i64 %%a, %%b
+	ret i1 %%inline
+inexact:
+	%%flonums = call i1 @__lisp_flonums(i64 %%a, i64 %%b)
+	br i1 %%flonums, label %%float, label %%slow
+float:
+	%%x = call double @lisp_to_double(i64 %%a)
+	%%y = call double @lisp_to_double(i64 %%b)
+	%%real = fcmp %[3]s double %%x, %%y
+	ret i1 %%real
+slow:
+	%%comparison = call i64 @lisp_compare(i64 %%a, i64 %%b)
+	%%result = icmp %[2]s i64 %%comparison, 0
+	ret i1 %%result
+}
+`
+
+// floor and round leave exact integers alone
+var roundingTemplate = `
+define internal i64 @__lisp_%[1]s(i64 %%a) {
+entry:
+	%%flonum = call i1 @__lisp_is_flonum(i64 %%a)
+	br i1 %%flonum, label %%float, label %%exact
+exact:
+	ret i64 %%a
+float:
+	%%x = call double @lisp_to_double(i64 %%a)
+	%%rounded = call double @llvm.%[2]s.f64(double %%x)
+	%%boxed = call i64 @lisp_box_double(double %%rounded)
+	ret i64 %%boxed
+}
+`
+
+// Flonums flip their sign bit so (- 0.0) is -0.0, exact numbers are 0 - a
+var negateHelper = `
+define internal i64 @__lisp_negate(i64 %a) {
+entry:
+	%flonum = call i1 @__lisp_is_flonum(i64 %a)
+	br i1 %flonum, label %float, label %exact
+exact:
+	%negated = call i64 @__lisp_sub(i64 1, i64 %a)
+	ret i64 %negated
+float:
+	%x = call double @lisp_to_double(i64 %a)
+	%y = fneg double %x
+	%boxed = call i64 @lisp_box_double(double %y)
+	ret i64 %boxed
+}
+`
+
+var comparisonHelpers = map[string]string{
+	"<": "lt",
+	">": "gt",
+	"=": "eq",
+}
+
+// Integer and float predicates for each comparision helper
+var comparisonInstructions = map[string][2]string{
+	"lt": {"slt", "olt"},
+	"gt": {"sgt", "ogt"},
+	"eq": {"eq", "oeq"},
+}
+
+// Arithmetic on operands the types say are flonums skips the helpers
+var floatInstructions = map[string]string{
+	"+":         "fadd",
+	"-":         "fsub",
+	"*":         "fmul",
+	"/":         "fdiv",
+	"%":         "frem",
+	"remainder": "frem",
+}
+
+var floatIntrinsics = map[string]string{
+	"floor": "llvm.floor.f64",
+	"round": "llvm.roundeven.f64",
+	"sqrt":  "llvm.sqrt.f64",
+}
+
+// Builtins taking a single argument and the function implementing them
+var unaryHelpers = map[string]string{
+	"print":          "lisp_print",
+	"exact->inexact": "__lisp_exact_to_inexact",
+	"floor":          "__lisp_floor",
+	"round":          "__lisp_round",
+	"sqrt":           "__lisp_sqrt",
+}
+
+// RuntimeSupport returns the helper functions and constants generated code
+// depends on, it has to be appended once to the module.
+func RuntimeSupport() string {
+	return overflowFlag() + runtimeHelpers() + initFunction("internal void @__init", nil) + takeConstants()
+}
+
+// overflowFlag is read by the C runtime, a program defines it exactly once
+func overflowFlag() string {
+	return fmt.Sprintf("\n@lisp_check_overflow = global i8 %d\n", boolToInt(CheckOverflow))
+}
+
+// runtimeHelpers are internal, every module compiled on its own gets a copy
+func runtimeHelpers() string {
+	support := runtimeSupport
+	support += fmt.Sprintf(numericTemplate, "add", fixnumPaths["add"], "	%real = fadd double %x, %y\n")
+	support += fmt.Sprintf(numericTemplate, "sub", fixnumPaths["sub"], "	%real = fsub double %x, %y\n")
+	support += fmt.Sprintf(numericTemplate, "mul", fixnumPaths["mul"], "	%real = fmul double %x, %y\n")
+	support += fmt.Sprintf(numericTemplate, "div", fmt.Sprintf(divisionPathTemplate, "sdiv", "	%untagged = add i64 %result, 0\n"), "	%real = fdiv double %x, %y\n")
+	support += fmt.Sprintf(numericTemplate, "rem", fmt.Sprintf(divisionPathTemplate, "srem", "	%untagged = add i64 %result, 0\n"), "	%real = frem double %x, %y\n")
+	support += fmt.Sprintf(numericTemplate, "mod", fmt.Sprintf(divisionPathTemplate, "srem", moduloAdjustment), floatModuloAdjustment)
+	for _, helper := range []string{"lt", "gt", "eq"} {
+		support += fmt.Sprintf(comparisonTemplate, helper, comparisonInstructions[helper][0], comparisonInstructions[helper][1])
+	}
+	support += negateHelper
+	support += fmt.Sprintf(roundingTemplate, "floor", "floor")
+	support += fmt.Sprintf(roundingTemplate, "round", "roundeven")
+	return support
+}
+
+func takeConstants() string {
+	constants := globalConstants
+	globalConstants = ""
+	return constants
+}
+
+// initFunction defines the function storing the globals that could not be
+// initialised statically, in declaration order. The units in imported are
+// initialised first.
+func initFunction(definition string, imported []string) string {
+	init := ""
+	for _, name := range imported {
+		init += fmt.Sprintf("\ndeclare void %s()\n", name)
+	}
+	init += fmt.Sprintf(`
+define %s(){
+entry:
+`, definition)
+	for _, name := range imported {
+		init += fmt.Sprintf("	call void %s()\n", name)
+	}
+	for indx, name := range globalInitializers {
+		init += fmt.Sprintf(`	%%init%d = call i64 @"global.%s.init"()
+	store i64 %%init%d, i64* %s, align 4
+`, indx, name, indx, llvmGlobalName(name))
+	}
+	globalInitializers = nil
+	return init + "	ret void\n}\n"
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func arithmeticInstruction(operand string, result string, left string, right string) string {
+	return fmt.Sprintf(`
+	%s = call i64 @__lisp_%s(i64 %s,i64 %s)
+		`, result, operandFunctioanMap[operand], left, right)
+}
+
+// integerConstant loads an integer literal into symbol, literals outside the
+// fixnum range are rebuilt by the runtime from their digits.
+func integerConstant(value Value, symbol string) string {
+	integer := toBig(value)
+	if integer.Cmp(big.NewInt(fixnumMin)) >= 0 && integer.Cmp(big.NewInt(fixnumMax)) <= 0 {
+		return fmt.Sprintf(`
+	%s = add i64 %d,0
+	`, symbol, integer.Int64()<<1|1)
+	}
+	digits := integer.String()
+	name := generateNextConstant()
+	globalConstants += fmt.Sprintf("%s = private unnamed_addr constant [%d x i8] c\"%s\\00\"\n", name, len(digits)+1, digits)
+	return fmt.Sprintf(`
+	%s = call i64 @lisp_big_from_string(i8* getelementptr inbounds ([%d x i8], [%d x i8]* %s, i64 0, i64 0))
+	`, symbol, len(digits)+1, len(digits)+1, name)
+}
+
+// floatConstant points symbol at a statically allocated flonum, laid out like
+// the flonum struct in the C runtime
+func floatConstant(value Flonum, symbol string) string {
+	return fmt.Sprintf(`
+	%s = add i64 %s,0
+	`, symbol, flonumAddress(value))
+}
+
+func flonumAddress(value Flonum) string {
+	name := generateNextConstant()
+	globalConstants += fmt.Sprintf("%s = private unnamed_addr constant {i64, double} {i64 2, double 0x%016X}, align 8\n", name, math.Float64bits(float64(value)))
+	return fmt.Sprintf("ptrtoint ({i64, double}* %s to i64)", name)
+}
+
+// staticInitializer is the constant a global holding value starts out with,
+// bignums are heap allocated so they can't have one
+func staticInitializer(value Value) (string, bool) {
+	switch value := value.(type) {
+	case Fixnum:
+		if value >= fixnumMin && value <= fixnumMax {
+			return fmt.Sprintf("%d", int64(value)<<1|1), true
+		}
+	case Flonum:
+		return flonumAddress(value), true
+	}
+	return "", false
+}
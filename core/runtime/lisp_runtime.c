@@ -0,0 +1,541 @@
+// Runtime support linked into every compiled program.
+//
+// Values are 64 bit words. Fixnums have the low bit set and carry a 63 bit
+// integer in the remaining bits, every other value is a pointer to a heap
+// object. Objects are never freed.
+#include <math.h>
+#include <stdarg.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+typedef int64_t value;
+
+#define IS_FIXNUM(v) ((v) & 1)
+#define FIXNUM_VALUE(v) ((v) >> 1)
+#define MAKE_FIXNUM(n) ((value)(((uint64_t)(n) << 1) | 1))
+#define FIXNUM_MAX (((int64_t)1 << 62) - 1)
+#define FIXNUM_MIN (-((int64_t)1 << 62))
+
+// Set by the generated module when compiling with --check-overflow
+extern char lisp_check_overflow;
+
+enum object_tag {
+	TAG_BIGNUM = 1,
+	TAG_FLONUM = 2,
+};
+
+typedef struct {
+	int64_t tag;
+	double value;
+} flonum;
+
+// Sign and magnitude, the magnitude is little endian and has no leading zero
+// limbs. A bignum returned to compiled code never fits in a fixnum.
+typedef struct {
+	int64_t tag;
+	int64_t negative;
+	int64_t length;
+	uint32_t limbs[];
+} bignum;
+
+static void fail(const char *message) {
+	fflush(stdout);
+	fprintf(stderr, "runtime error: %s\n", message);
+	fflush(stderr);
+	__builtin_trap();
+}
+
+void lisp_write_value(value v, FILE *out);
+
+// An error raised while no catch, guard or dynamic-wind is active stops the
+// program. Inside one it sets lisp_error_pending and returns, the generated
+// code checks the flag after every call that can fail and unwinds to the
+// handler.
+int64_t lisp_handlers;
+char lisp_error_pending;
+
+typedef struct {
+	const char *message;
+	int64_t count;
+	value *irritants;
+} error_state;
+
+static error_state current_error;
+
+static void report(error_state *error) {
+	fflush(stdout);
+	fprintf(stderr, "runtime error: %s", error->message);
+	for (int64_t i = 0; i < error->count; i++) {
+		fputc(' ', stderr);
+		lisp_write_value(error->irritants[i], stderr);
+	}
+	fputc('\n', stderr);
+	fflush(stderr);
+	__builtin_trap();
+}
+
+static void raise_error(error_state error) {
+	current_error = error;
+	if (lisp_handlers == 0) {
+		report(&current_error);
+	}
+	lisp_error_pending = 1;
+}
+
+void lisp_error(const char *message) {
+	raise_error((error_state){message, 0, NULL});
+}
+
+// (error "message" irritants...)
+void lisp_raise(const char *message, int64_t count, ...) {
+	value *irritants = malloc((count + 1) * sizeof(value));
+	if (irritants == NULL) {
+		fail("out of memory");
+	}
+	va_list arguments;
+	va_start(arguments, count);
+	for (int64_t i = 0; i < count; i++) {
+		irritants[i] = va_arg(arguments, value);
+	}
+	va_end(arguments);
+	raise_error((error_state){message, count, irritants});
+}
+
+void lisp_enter_handler(void) {
+	lisp_handlers++;
+}
+
+void lisp_leave_handler(void) {
+	lisp_handlers--;
+}
+
+// The handler of a catch or guard runs with the error cleared, a guard's
+// variable is the first irritant
+value lisp_catch(void) {
+	lisp_handlers--;
+	lisp_error_pending = 0;
+	return current_error.count > 0 ? current_error.irritants[0] : MAKE_FIXNUM(0);
+}
+
+// dynamic-wind runs its after expression with the error put aside and raises
+// it again once it is done
+void *lisp_suspend_error(void) {
+	error_state *saved = malloc(sizeof(error_state));
+	if (saved == NULL) {
+		fail("out of memory");
+	}
+	*saved = current_error;
+	lisp_handlers--;
+	lisp_error_pending = 0;
+	return saved;
+}
+
+void lisp_resume_error(void *saved) {
+	raise_error(*(error_state *)saved);
+}
+
+static bignum *big_alloc(int64_t length) {
+	bignum *b = calloc(1, sizeof(bignum) + (length + 1) * sizeof(uint32_t));
+	if (b == NULL) {
+		fail("out of memory");
+	}
+	b->tag = TAG_BIGNUM;
+	b->length = length;
+	return b;
+}
+
+static bignum *big_trim(bignum *b) {
+	while (b->length > 0 && b->limbs[b->length - 1] == 0) {
+		b->length--;
+	}
+	if (b->length == 0) {
+		b->negative = 0;
+	}
+	return b;
+}
+
+static bignum *big_from_int64(int64_t n) {
+	bignum *b = big_alloc(2);
+	uint64_t magnitude = n < 0 ? -(uint64_t)n : (uint64_t)n;
+	b->negative = n < 0;
+	b->limbs[0] = (uint32_t)magnitude;
+	b->limbs[1] = (uint32_t)(magnitude >> 32);
+	return big_trim(b);
+}
+
+static bignum *to_bignum(value v) {
+	if (IS_FIXNUM(v)) {
+		return big_from_int64(FIXNUM_VALUE(v));
+	}
+	bignum *b = (bignum *)v;
+	if (b->tag != TAG_BIGNUM) {
+		lisp_error("expected an integer");
+		return big_from_int64(0);
+	}
+	return b;
+}
+
+static uint64_t big_low_magnitude(const bignum *b) {
+	uint64_t magnitude = 0;
+	if (b->length > 0) {
+		magnitude = b->limbs[0];
+	}
+	if (b->length > 1) {
+		magnitude |= (uint64_t)b->limbs[1] << 32;
+	}
+	return magnitude;
+}
+
+// Whether b is a machine integer, this is the range --check-overflow guards
+static int big_fits_int64(const bignum *b) {
+	if (b->length > 2) {
+		return 0;
+	}
+	uint64_t magnitude = big_low_magnitude(b);
+	return b->negative ? magnitude <= (uint64_t)1 << 63 : magnitude < (uint64_t)1 << 63;
+}
+
+static value big_normalize(bignum *b) {
+	big_trim(b);
+	if (b->length <= 2) {
+		uint64_t magnitude = big_low_magnitude(b);
+		if (!b->negative && magnitude <= (uint64_t)FIXNUM_MAX) {
+			return MAKE_FIXNUM(magnitude);
+		}
+		if (b->negative && magnitude <= (uint64_t)1 << 62) {
+			return MAKE_FIXNUM(-(int64_t)magnitude);
+		}
+	}
+	return (value)b;
+}
+
+static int mag_compare(const bignum *a, const bignum *b) {
+	if (a->length != b->length) {
+		return a->length < b->length ? -1 : 1;
+	}
+	for (int64_t i = a->length - 1; i >= 0; i--) {
+		if (a->limbs[i] != b->limbs[i]) {
+			return a->limbs[i] < b->limbs[i] ? -1 : 1;
+		}
+	}
+	return 0;
+}
+
+static bignum *mag_add(const bignum *a, const bignum *b) {
+	int64_t length = a->length > b->length ? a->length : b->length;
+	bignum *r = big_alloc(length + 1);
+	uint64_t carry = 0;
+	for (int64_t i = 0; i < length; i++) {
+		uint64_t sum = carry;
+		sum += i < a->length ? a->limbs[i] : 0;
+		sum += i < b->length ? b->limbs[i] : 0;
+		r->limbs[i] = (uint32_t)sum;
+		carry = sum >> 32;
+	}
+	r->limbs[length] = (uint32_t)carry;
+	return r;
+}
+
+// |a| - |b|, the caller guarantees |a| >= |b|
+static bignum *mag_sub(const bignum *a, const bignum *b) {
+	bignum *r = big_alloc(a->length);
+	int64_t borrow = 0;
+	for (int64_t i = 0; i < a->length; i++) {
+		int64_t difference = (int64_t)a->limbs[i] - borrow - (i < b->length ? b->limbs[i] : 0);
+		borrow = difference < 0;
+		r->limbs[i] = (uint32_t)(difference + (borrow ? (int64_t)1 << 32 : 0));
+	}
+	return r;
+}
+
+static bignum *big_add(const bignum *a, const bignum *b) {
+	bignum *r;
+	if (a->negative == b->negative) {
+		r = mag_add(a, b);
+		r->negative = a->negative;
+	} else if (mag_compare(a, b) >= 0) {
+		r = mag_sub(a, b);
+		r->negative = a->negative;
+	} else {
+		r = mag_sub(b, a);
+		r->negative = b->negative;
+	}
+	return big_trim(r);
+}
+
+static bignum *big_negate(const bignum *a) {
+	bignum *r = big_alloc(a->length);
+	memcpy(r->limbs, a->limbs, a->length * sizeof(uint32_t));
+	r->negative = !a->negative;
+	return big_trim(r);
+}
+
+static bignum *big_mul(const bignum *a, const bignum *b) {
+	bignum *r = big_alloc(a->length + b->length);
+	for (int64_t i = 0; i < a->length; i++) {
+		uint64_t carry = 0;
+		for (int64_t j = 0; j < b->length; j++) {
+			uint64_t product = (uint64_t)a->limbs[i] * b->limbs[j] + r->limbs[i + j] + carry;
+			r->limbs[i + j] = (uint32_t)product;
+			carry = product >> 32;
+		}
+		r->limbs[i + b->length] = (uint32_t)carry;
+	}
+	r->negative = a->negative != b->negative;
+	return big_trim(r);
+}
+
+// Truncating division of the magnitudes by shifting in one bit at a time
+static void big_divmod(const bignum *a, const bignum *b, bignum **quotient, bignum **remainder) {
+	if (b->length == 0) {
+		lisp_error("division by zero");
+		*quotient = big_from_int64(0);
+		*remainder = big_from_int64(0);
+		return;
+	}
+	bignum *q = big_alloc(a->length);
+	bignum *r = big_alloc(b->length + 1);
+	r->length = 0;
+	for (int64_t bit = a->length * 32 - 1; bit >= 0; bit--) {
+		uint32_t carry = (a->limbs[bit / 32] >> (bit % 32)) & 1;
+		for (int64_t i = 0; i < r->length; i++) {
+			uint32_t next = r->limbs[i] >> 31;
+			r->limbs[i] = (r->limbs[i] << 1) | carry;
+			carry = next;
+		}
+		if (carry) {
+			r->limbs[r->length++] = carry;
+		}
+		if (mag_compare(r, b) >= 0) {
+			bignum *difference = big_trim(mag_sub(r, b));
+			memcpy(r->limbs, difference->limbs, difference->length * sizeof(uint32_t));
+			r->length = difference->length;
+			free(difference);
+			q->limbs[bit / 32] |= (uint32_t)1 << (bit % 32);
+		}
+	}
+	q->negative = a->negative != b->negative;
+	r->negative = a->negative;
+	*quotient = big_trim(q);
+	*remainder = big_trim(r);
+}
+
+static value finish(value a, value b, bignum *result) {
+	if (lisp_check_overflow && !big_fits_int64(result) && big_fits_int64(to_bignum(a)) && big_fits_int64(to_bignum(b))) {
+		lisp_error("integer overflow");
+		return MAKE_FIXNUM(0);
+	}
+	return big_normalize(result);
+}
+
+value lisp_add(value a, value b) {
+	return finish(a, b, big_add(to_bignum(a), to_bignum(b)));
+}
+
+value lisp_sub(value a, value b) {
+	return finish(a, b, big_add(to_bignum(a), big_negate(to_bignum(b))));
+}
+
+value lisp_mul(value a, value b) {
+	return finish(a, b, big_mul(to_bignum(a), to_bignum(b)));
+}
+
+value lisp_div(value a, value b) {
+	bignum *quotient, *remainder;
+	big_divmod(to_bignum(a), to_bignum(b), &quotient, &remainder);
+	return finish(a, b, quotient);
+}
+
+value lisp_rem(value a, value b) {
+	bignum *quotient, *remainder;
+	big_divmod(to_bignum(a), to_bignum(b), &quotient, &remainder);
+	return big_normalize(remainder);
+}
+
+value lisp_mod(value a, value b) {
+	bignum *quotient, *remainder;
+	bignum *divisor = to_bignum(b);
+	big_divmod(to_bignum(a), divisor, &quotient, &remainder);
+	if (remainder->length != 0 && remainder->negative != divisor->negative) {
+		remainder = big_add(remainder, divisor);
+	}
+	return big_normalize(remainder);
+}
+
+int64_t lisp_compare(value a, value b) {
+	if (IS_FIXNUM(a) && IS_FIXNUM(b)) {
+		return a < b ? -1 : a > b;
+	}
+	bignum *x = to_bignum(a);
+	bignum *y = to_bignum(b);
+	if (x->negative != y->negative) {
+		return x->negative ? -1 : 1;
+	}
+	int comparison = mag_compare(x, y);
+	return x->negative ? -comparison : comparison;
+}
+
+value lisp_big_from_string(const char *digits) {
+	int negative = *digits == '-';
+	if (negative) {
+		digits++;
+	}
+	int64_t length = strlen(digits) / 9 + 2;
+	bignum *b = big_alloc(length);
+	b->length = 0;
+	for (; *digits; digits++) {
+		uint64_t carry = *digits - '0';
+		for (int64_t i = 0; i < b->length; i++) {
+			uint64_t product = (uint64_t)b->limbs[i] * 10 + carry;
+			b->limbs[i] = (uint32_t)product;
+			carry = product >> 32;
+		}
+		if (carry) {
+			b->limbs[b->length++] = (uint32_t)carry;
+		}
+	}
+	b->negative = negative;
+	return big_normalize(b);
+}
+
+// Decimal digits of b in a fresh string, peeling base 10^9 chunks off a
+// scratch copy of the magnitude
+static char *big_to_string(const bignum *b) {
+	bignum *scratch = big_alloc(b->length);
+	memcpy(scratch->limbs, b->limbs, b->length * sizeof(uint32_t));
+	scratch->length = b->length;
+	uint32_t *chunks = malloc((b->length * 10 / 9 + 2) * sizeof(uint32_t));
+	int64_t count = 0;
+	while (scratch->length > 0) {
+		uint64_t remainder = 0;
+		for (int64_t i = scratch->length - 1; i >= 0; i--) {
+			uint64_t current = (remainder << 32) | scratch->limbs[i];
+			scratch->limbs[i] = (uint32_t)(current / 1000000000);
+			remainder = current % 1000000000;
+		}
+		chunks[count++] = (uint32_t)remainder;
+		big_trim(scratch);
+	}
+	char *digits = malloc(count * 9 + 3);
+	char *cursor = digits;
+	if (b->negative) {
+		*cursor++ = '-';
+	}
+	cursor += sprintf(cursor, "%u", count > 0 ? chunks[count - 1] : 0);
+	for (int64_t i = count - 2; i >= 0; i--) {
+		cursor += sprintf(cursor, "%09u", chunks[i]);
+	}
+	free(chunks);
+	free(scratch);
+	return digits;
+}
+
+static int is_flonum(value v) {
+	return !IS_FIXNUM(v) && ((flonum *)v)->tag == TAG_FLONUM;
+}
+
+value lisp_box_double(double d) {
+	flonum *f = malloc(sizeof(flonum));
+	if (f == NULL) {
+		fail("out of memory");
+	}
+	f->tag = TAG_FLONUM;
+	f->value = d;
+	return (value)f;
+}
+
+double lisp_to_double(value v) {
+	if (IS_FIXNUM(v)) {
+		return (double)FIXNUM_VALUE(v);
+	}
+	if (is_flonum(v)) {
+		return ((flonum *)v)->value;
+	}
+	// strtod rounds correctly, summing the limbs would not
+	char *digits = big_to_string(to_bignum(v));
+	double d = strtod(digits, NULL);
+	free(digits);
+	return d;
+}
+
+// Same shape as Go's strconv.FormatFloat(d, 'g', -1, 64) so both engines print
+// identical text, with a trailing .0 marking integral values as inexact.
+static void write_double(double d, FILE *out) {
+	if (isnan(d)) {
+		fputs("+nan.0", out);
+		return;
+	}
+	if (isinf(d)) {
+		fputs(d > 0 ? "+inf.0" : "-inf.0", out);
+		return;
+	}
+	char buffer[64];
+	int precision = 1;
+	for (; precision < 17; precision++) {
+		snprintf(buffer, sizeof(buffer), "%.*e", precision - 1, d);
+		if (strtod(buffer, NULL) == d) {
+			break;
+		}
+	}
+	snprintf(buffer, sizeof(buffer), "%.*e", precision - 1, d);
+	int exponent = atoi(strchr(buffer, 'e') + 1);
+	if (exponent >= -4 && exponent < 6) {
+		int decimals = precision - 1 - exponent;
+		snprintf(buffer, sizeof(buffer), "%.*f", decimals > 0 ? decimals : 0, d);
+	}
+	fputs(buffer, out);
+	if (strpbrk(buffer, ".e") == NULL) {
+		fputs(".0", out);
+	}
+}
+
+void lisp_write_value(value v, FILE *out) {
+	if (IS_FIXNUM(v)) {
+		fprintf(out, "%lld", (long long)FIXNUM_VALUE(v));
+		return;
+	}
+	if (is_flonum(v)) {
+		write_double(((flonum *)v)->value, out);
+		return;
+	}
+	char *digits = big_to_string(to_bignum(v));
+	fputs(digits, out);
+	free(digits);
+}
+
+// Flushed so that print and sys_write, which bypasses stdio, come out in order
+value lisp_print(value v) {
+	lisp_write_value(v, stdout);
+	fputc('\n', stdout);
+	fflush(stdout);
+	return v;
+}
+
+// The low 64 bits of an integer, flonums are truncated. Foreign functions get
+// their integer arguments this way.
+int64_t lisp_to_int64(value v) {
+	if (IS_FIXNUM(v)) {
+		return FIXNUM_VALUE(v);
+	}
+	if (is_flonum(v)) {
+		return (int64_t)((flonum *)v)->value;
+	}
+	bignum *b = to_bignum(v);
+	uint64_t magnitude = big_low_magnitude(b);
+	return b->negative ? -(int64_t)magnitude : (int64_t)magnitude;
+}
+
+// Integers returned by foreign functions
+value lisp_from_int64(int64_t n) {
+	if (n >= FIXNUM_MIN && n <= FIXNUM_MAX) {
+		return MAKE_FIXNUM(n);
+	}
+	return (value)big_from_int64(n);
+}
+
+// main's return value becomes the exit status, bignums and flonums are truncated
+int64_t lisp_exit_code(value v) {
+	return lisp_to_int64(v);
+}
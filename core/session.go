@@ -0,0 +1,353 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Session evaluates programs read one after another in the same global
+// scope, later programs can use the functions, globals and macros of earlier
+// ones. Unlike Run, it returns errors rather than panicking, embedders
+// build on it.
+type Session struct {
+	Scope *InterpreterScope
+	// Prelude reads the standard prelude ahead of the first program
+	Prelude bool
+	// Limits bound every Load and Call
+	Limits  Limits
+	macros  map[string]*MacroNode
+	program []ASTNode
+	prelude map[ASTNode]bool
+	hosts   map[string]bool
+	started bool
+	// nextExpansion numbers the expansions of every program loaded, like
+	// those of one program
+	nextExpansion func() int
+}
+
+// Limits bound a run of the interpreter, zero values are unlimited. They let
+// a service evaluate untrusted programs without a runaway one taking it down.
+type Limits struct {
+	// Context cancels the run once it is done
+	Context context.Context
+	// Timeout is how long the run can take
+	Timeout time.Duration
+	// MaxDepth is how deeply function calls can nest, without it infinite
+	// recursion overflows the Go stack
+	MaxDepth int
+	// MaxSteps is how many calls and loop iterations the run can take
+	MaxSteps int
+	// MaxAllocations is how much the run can allocate, counted in scopes,
+	// list cells and bignum words
+	MaxAllocations int
+}
+
+// DefaultMaxDepth is how deeply calls nest before the interpreter gives up
+// when nothing else is asked for, deep enough for any reasonable program and
+// shallow enough for the Go stack
+const DefaultMaxDepth = 10000
+
+// LimitExceeded stops a run that went over one of its Limits
+type LimitExceeded struct {
+	// Limit is "call depth", "steps", "allocations" or "time"
+	Limit string
+	// Max is the limit that was exceeded, for time it is the Timeout
+	Max int64
+	err error
+	// stopped is the expression that went over the limit and the calls that
+	// led to it
+	stopped *RuntimeError
+}
+
+func (e *LimitExceeded) Error() string {
+	switch {
+	case e.Limit == "time" && e.Max > 0:
+		return fmt.Sprintf("time limit of %s exceeded", time.Duration(e.Max))
+	case e.Limit == "time":
+		return "time limit exceeded"
+	}
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// Unwrap is context.DeadlineExceeded for time limits
+func (e *LimitExceeded) Unwrap() error {
+	return e.err
+}
+
+// budget is what is left of the limits of the current run, scopes share the
+// budget of the scope they were created in
+type budget struct {
+	limits      Limits
+	context     context.Context
+	cancel      context.CancelFunc
+	depth       int
+	steps       int
+	allocations int
+}
+
+// HostFunction is a Go function programs call like a Lisp function, it
+// gets the evaluated arguments
+type HostFunction func(arguments []Value) (Value, error)
+
+// hostFunction binds a HostFunction in the global scope
+type hostFunction struct {
+	Span
+	name string
+	fn   HostFunction
+}
+
+func NewSession() *Session {
+	return &Session{
+		Scope:         NewInterpreterScope(nil),
+		Prelude:       true,
+		macros:        make(map[string]*MacroNode),
+		prelude:       make(map[ASTNode]bool),
+		hosts:         make(map[string]bool),
+		nextExpansion: expansionGenerator(),
+	}
+}
+
+// step charges a call or loop iteration to the budget
+func (s *InterpreterScope) step() {
+	b := s.budget
+	if b == nil {
+		return
+	}
+	b.steps++
+	if b.limits.MaxSteps > 0 && b.steps > b.limits.MaxSteps {
+		panic(&LimitExceeded{Limit: "steps", Max: int64(b.limits.MaxSteps)})
+	}
+	if b.context != nil {
+		select {
+		case <-b.context.Done():
+			if errors.Is(b.context.Err(), context.DeadlineExceeded) {
+				panic(&LimitExceeded{Limit: "time", Max: int64(b.limits.Timeout), err: b.context.Err()})
+			}
+			panic(b.context.Err())
+		default:
+		}
+	}
+}
+
+// enter and leave track how deeply function calls are nested
+func (s *InterpreterScope) enter() {
+	b := s.budget
+	if b == nil {
+		return
+	}
+	b.depth++
+	if b.limits.MaxDepth > 0 && b.depth > b.limits.MaxDepth {
+		panic(&LimitExceeded{Limit: "call depth", Max: int64(b.limits.MaxDepth)})
+	}
+}
+
+func (s *InterpreterScope) leave() {
+	if s.budget != nil {
+		s.budget.depth--
+	}
+}
+
+// allocate charges n allocations to the budget
+func (s *InterpreterScope) allocate(n int) {
+	b := s.budget
+	if b == nil {
+		return
+	}
+	b.allocations += n
+	if b.limits.MaxAllocations > 0 && b.allocations > b.limits.MaxAllocations {
+		panic(&LimitExceeded{Limit: "allocations", Max: int64(b.limits.MaxAllocations)})
+	}
+}
+
+// allocated charges what value took to allocate and returns it
+func (s *InterpreterScope) allocated(value Value) Value {
+	switch value := value.(type) {
+	case *Bignum:
+		s.allocate(len(value.value.Bits()))
+	case List:
+		s.allocate(len(value))
+	}
+	return value
+}
+
+// DefineHostFunction makes fn callable as name, it can't replace a builtin
+// or a function the programs define
+func (s *Session) DefineHostFunction(name string, fn HostFunction) error {
+	if Includes(builtInOperations, name) || Includes(specialForms, name) {
+		return fmt.Errorf("%s is a builtin and can not be redefined", name)
+	}
+	if node := s.Scope.inner[name]; node != nil {
+		if _, ok := node.(*hostFunction); !ok {
+			return fmt.Errorf("%s is already defined", name)
+		}
+	}
+	s.hosts[name] = true
+	s.Scope.inner[name] = &hostFunction{name: name, fn: fn}
+	return nil
+}
+
+// Load reads, checks and evaluates a program. The result is what main
+// returned or the value of the last expression. A program that doesn't
+// parse is a *ParseError, one that fails the check pass Diagnostics and one
+// that goes over the Limits a *LimitExceeded.
+func (s *Session) Load(path string, input string) (result Value, err error) {
+	s.begin()
+	defer s.end(&err)
+	if !s.started && s.Prelude {
+		parser := NewParser("")
+		parser.macros = s.macros
+		parser.nextExpansion = s.nextExpansion
+		if err := parser.UsePrelude(); err != nil {
+			return nil, err
+		}
+		for _, node := range parser.prelude {
+			s.prelude[node] = true
+		}
+		s.Scope.Run(parser.prelude)
+		s.program = parser.prelude
+	}
+	s.started = true
+	parser := NewParser(input)
+	parser.source = &SourceFile{Path: path, Input: input}
+	parser.macros = s.macros
+	parser.nextExpansion = s.nextExpansion
+	parser.budget = s.Scope.budget
+	program, err := parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	// Definitions replace the prelude's, like they do in a program read
+	// with the prelude
+	defined := make(map[string]bool)
+	for _, node := range program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			defined[node.name] = true
+		case *DefineNode:
+			defined[node.name] = true
+		}
+	}
+	kept := make([]ASTNode, 0, len(s.program))
+	replaced := make([]string, 0)
+	for _, node := range s.program {
+		if function, ok := node.(*FunctionNode); ok && s.prelude[node] && defined[function.name] {
+			replaced = append(replaced, function.name)
+			continue
+		}
+		kept = append(kept, node)
+	}
+	if diagnostics := checkWithHosts(append(kept, program...), s.hosts); len(diagnostics) > 0 {
+		return nil, Diagnostics(diagnostics)
+	}
+	for _, name := range replaced {
+		delete(s.Scope.inner, name)
+	}
+	s.program = append(kept, program...)
+	return s.Scope.Run(program), nil
+}
+
+// begin gives the Load or Call that is starting a fresh budget
+func (s *Session) begin() {
+	s.Scope.budget = newBudget(s.Limits)
+}
+
+func newBudget(limits Limits) *budget {
+	b := &budget{limits: limits, context: limits.Context}
+	if limits.Timeout > 0 {
+		if b.context == nil {
+			b.context = context.Background()
+		}
+		b.context, b.cancel = context.WithTimeout(b.context, limits.Timeout)
+	}
+	return b
+}
+
+// RunLimited is Run bounded by limits, a run that goes over them panics
+// with a *RuntimeError for the expression that did, wrapping the
+// *LimitExceeded
+func (s *InterpreterScope) RunLimited(program []ASTNode, limits Limits) Value {
+	s.budget = newBudget(limits)
+	defer func() {
+		if s.budget.cancel != nil {
+			s.budget.cancel()
+		}
+		s.budget = nil
+		if r := recover(); r != nil {
+			if limitErr, ok := r.(*LimitExceeded); ok && limitErr.stopped != nil {
+				stopped := *limitErr.stopped
+				stopped.cause = limitErr
+				panic(&stopped)
+			}
+			panic(r)
+		}
+	}()
+	return s.Run(program)
+}
+
+// end turns what a failed Load or Call panicked with into its error
+func (s *Session) end(err *error) {
+	if cancel := s.Scope.budget.cancel; cancel != nil {
+		cancel()
+	}
+	s.Scope.budget = nil
+	if r := recover(); r != nil {
+		*err = evalError(r)
+	}
+}
+
+// Call calls the function name defined by a program loaded earlier
+func (s *Session) Call(name string, arguments []Value) (result Value, err error) {
+	function, ok := s.Scope.inner[name].(*FunctionNode)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	if len(arguments) != len(function.arguments) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, len(function.arguments), len(arguments))
+	}
+	s.begin()
+	defer s.end(&err)
+	return applyFunction(function, arguments, Span{}), nil
+}
+
+// Global is the value of a global variable defined by a program loaded
+// earlier
+func (s *Session) Global(name string) (Value, bool) {
+	global, ok := s.Scope.inner[name].(*IntegerNode)
+	if !ok {
+		return nil, false
+	}
+	return global.value, true
+}
+
+// evalError turns what a failed evaluation panicked with into an error
+func evalError(r any) error {
+	switch r := r.(type) {
+	case error:
+		return r
+	case string:
+		return errors.New(strings.TrimPrefix(r, "Error: "))
+	}
+	return fmt.Errorf("%v", r)
+}
+
+func (h *hostFunction) call(arguments []Value) Value {
+	value, err := h.fn(arguments)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", h.name, err))
+	}
+	if value == nil {
+		return Fixnum(0)
+	}
+	return value
+}
+
+func (h *hostFunction) Eval(scope *InterpreterScope) Value {
+	panic(fmt.Sprintf("Error: function %s can not be used as a value", h.name))
+}
+
+func (h *hostFunction) Codegen(asm *string, symbol string, scope *CompilerScope) {
+	panic(fmt.Sprintf("Error: %s is a host function, it only exists in the interpreter", h.name))
+}
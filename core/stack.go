@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Frame is a call of a Lisp function that was running when an error happened
+type Frame struct {
+	Function  string
+	Arguments []Value
+	// Span is the call, it has no source for calls made from Go
+	Span Span
+}
+
+func (f Frame) String() string {
+	call := "(" + f.Function
+	for _, argument := range f.Arguments {
+		call += " " + argument.String()
+	}
+	call += ")"
+	if location := spanLocation(f.Span); location != "" {
+		call += " at " + location
+	}
+	return call
+}
+
+// RuntimeError is an error raised while interpreting a program, with the
+// expression that failed and the Lisp calls that led to it, innermost first
+type RuntimeError struct {
+	Message string
+	Span    Span
+	Frames  []Frame
+	// cause is what the failed expression panicked with
+	cause any
+}
+
+func (e *RuntimeError) Error() string {
+	if location := spanLocation(e.Span); location != "" {
+		return location + ": " + e.Message
+	}
+	return e.Message
+}
+
+// Unwrap is the error the expression failed with, so errors.Is still finds
+// ErrDivisionByZero and the errors of host functions
+func (e *RuntimeError) Unwrap() error {
+	err, _ := e.cause.(error)
+	return err
+}
+
+// maxTraceFrames is how many frames Trace lists, half from either end of
+// the stack
+const maxTraceFrames = 20
+
+// Trace is the error followed by a line for every frame, the middle of deep
+// stacks is left out
+func (e *RuntimeError) Trace() string {
+	lines := []string{e.Error()}
+	for indx, frame := range e.Frames {
+		if len(e.Frames) > maxTraceFrames && indx >= maxTraceFrames/2 && indx < len(e.Frames)-maxTraceFrames/2 {
+			if indx == maxTraceFrames/2 {
+				lines = append(lines, fmt.Sprintf("  ... %d more calls", len(e.Frames)-maxTraceFrames))
+			}
+			continue
+		}
+		lines = append(lines, "  in "+frame.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func spanLocation(span Span) string {
+	if span.Source == nil {
+		return ""
+	}
+	line, column := Position(span.Source.Input, span.Start)
+	return fmt.Sprintf("%s:%d:%d", span.Source.Path, line, column)
+}
+
+// callStack holds the frames of the Lisp functions being applied, scopes
+// share the stack of the scope they were created in
+type callStack struct {
+	frames []Frame
+}
+
+func (s *InterpreterScope) push(frame Frame) {
+	if s.calls != nil {
+		s.calls.frames = append(s.calls.frames, frame)
+	}
+}
+
+func (s *InterpreterScope) pop() {
+	if s.calls != nil {
+		s.calls.frames = s.calls.frames[:len(s.calls.frames)-1]
+	}
+}
+
+// runtimeError is what the expression at span panicking with r re-panics
+// with. The innermost expression to fail turns r into a RuntimeError holding
+// the stack at that point, the ones it was part of pass it on. Limits and
+// cancellation stop the program rather than being errors in it, and Go
+// runtime errors are bugs in the interpreter, those are passed on unchanged.
+// A limit keeps where it was exceeded for RunLimited to report.
+func (s *InterpreterScope) runtimeError(r any, span Span) any {
+	switch r := r.(type) {
+	case *LimitExceeded:
+		if r.stopped == nil {
+			r.stopped = s.runtimeError(errors.New(r.Error()), span).(*RuntimeError)
+		}
+		return r
+	case *RuntimeError, runtime.Error:
+		return r
+	case error:
+		if errors.Is(r, context.Canceled) {
+			return r
+		}
+	}
+	message := fmt.Sprint(r)
+	if err, ok := r.(error); ok {
+		message = err.Error()
+	}
+	runtimeErr := &RuntimeError{Message: strings.TrimPrefix(message, "Error: "), Span: span, cause: r}
+	if s.calls != nil {
+		for indx := len(s.calls.frames) - 1; indx >= 0; indx-- {
+			runtimeErr.Frames = append(runtimeErr.Frames, s.calls.frames[indx])
+		}
+	}
+	return runtimeErr
+}
@@ -0,0 +1,11 @@
+; Raising and handling errors
+(def check (x)
+  (if (< x 0)
+      (error "negative" x)
+      x))
+
+(def main ()
+  (print (catch (/ 10 0) -1))
+  (print (guard (e (+ e 100)) (check -7)))
+  (dynamic-wind (print 1) (print (check 5)) (print 3))
+  0)
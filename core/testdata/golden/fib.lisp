@@ -0,0 +1,9 @@
+; Recursion and conditionals
+(def fib (n)
+  (if (< n 2)
+      n
+      (+ (fib (- n 1)) (fib (- n 2)))))
+
+(def main ()
+  (print (fib 20))
+  0)
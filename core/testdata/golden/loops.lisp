@@ -0,0 +1,17 @@
+; Local variables, assignment and both kinds of loop
+(def sum-to (n)
+  (let ((total 0) (i 0))
+    (while (< i n)
+      (set! i (+ i 1))
+      (set! total (+ total i)))
+    total))
+
+(def factorial (n)
+  (do ((i 1 (+ i 1))
+       (acc 1 (* acc i)))
+      ((> i n) acc)))
+
+(def main ()
+  (print (sum-to 10))
+  (print (factorial 25))
+  0)
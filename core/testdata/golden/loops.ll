@@ -0,0 +1,528 @@
+; ModuleID = 'testdata/golden/loops.lisp'
+source_filename = "testdata/golden/loops.lisp"
+target triple = "x86_64-pc-linux-gnu"
+
+define i64 @"sum-to"(i64 %n) {
+entry:
+  %sym1 = add i64 %n, 0
+  %sym2 = alloca i64, align 4
+  store i64 %sym1, i64* %sym2, align 4
+  %sym3 = alloca i64, align 4
+  %sym4 = alloca i64, align 4
+  %sym5 = add i64 1, 0
+  store i64 %sym5, i64* %sym3, align 4
+  %sym6 = add i64 1, 0
+  store i64 %sym6, i64* %sym4, align 4
+  br label %loopcond1
+
+loopcond1:
+  %sym7 = load i64, i64* %sym4, align 4%sym8 = load i64, i64* %sym2, align 4
+  %sym9 = call i1 @__lisp_lt(i64 %sym7, i64 %sym8)
+  br i1 %sym9, label %loopbody1, label %loopend1
+
+loopbody1:
+  %sym10 = load i64, i64* %sym4, align 4
+  %sym11 = add i64 3, 0
+  %sym12 = call i64 @__lisp_add(i64 %sym10, i64 %sym11)
+  store i64 %sym12, i64* %sym4, align 4
+  %sym13 = add i64 %sym12, 0
+  %sym14 = load i64, i64* %sym3, align 4%sym15 = load i64, i64* %sym4, align 4
+  %sym16 = call i64 @__lisp_add(i64 %sym14, i64 %sym15)
+  store i64 %sym16, i64* %sym3, align 4
+  %sym17 = add i64 %sym16, 0
+  br label %loopcond1
+
+loopend1:
+  %sym18 = add i64 1, 0
+  %sym19 = load i64, i64* %sym3, align 4
+  ret i64 %sym19
+}
+
+define i64 @factorial(i64 %n) {
+entry:
+  %sym1 = add i64 %n, 0
+  %sym2 = alloca i64, align 4
+  store i64 %sym1, i64* %sym2, align 4
+  %sym3 = alloca i64, align 4
+  %sym4 = alloca i64, align 4
+  %sym5 = add i64 3, 0
+  store i64 %sym5, i64* %sym3, align 4
+  %sym6 = add i64 3, 0
+  store i64 %sym6, i64* %sym4, align 4
+  br label %loopcond1
+
+loopcond1:
+  %sym7 = load i64, i64* %sym3, align 4%sym8 = load i64, i64* %sym2, align 4
+  %sym9 = call i1 @__lisp_gt(i64 %sym7, i64 %sym8)
+  br i1 %sym9, label %loopend1, label %loopbody1
+
+loopbody1:
+  %sym10 = load i64, i64* %sym3, align 4
+  %sym11 = add i64 3, 0
+  %sym12 = call i64 @__lisp_add(i64 %sym10, i64 %sym11)
+  %sym13 = load i64, i64* %sym4, align 4%sym14 = load i64, i64* %sym3, align 4
+  %sym15 = call i64 @__lisp_mul(i64 %sym13, i64 %sym14)
+  store i64 %sym12, i64* %sym3, align 4
+  store i64 %sym15, i64* %sym4, align 4
+  br label %loopcond1
+
+loopend1:
+  %sym16 = load i64, i64* %sym4, align 4
+  ret i64 %sym16
+}
+
+define i64 @lisp_main() {
+entry:
+  %sym1 = add i64 21, 0
+  %sym2 = call i64 @"sum-to"(i64 %sym1)
+  %sym3 = load i8, i8* @lisp_error_pending
+  %sym4 = icmp ne i8 %sym3, 0
+  br i1 %sym4, label %unwind, label %noerror1
+
+noerror1:
+  %sym5 = add i64 %sym2, 0
+  %sym6 = call i64 @lisp_print(i64 %sym5)
+  %sym7 = add i64 51, 0
+  %sym8 = call i64 @factorial(i64 %sym7)
+  %sym9 = load i8, i8* @lisp_error_pending
+  %sym10 = icmp ne i8 %sym9, 0
+  br i1 %sym10, label %unwind, label %noerror2
+
+noerror2:
+  %sym11 = add i64 %sym8, 0
+  %sym12 = call i64 @lisp_print(i64 %sym11)
+  %sym13 = add i64 1, 0
+  ret i64 %sym13
+
+unwind:
+  ret i64 1
+}
+
+define i32 @main() {
+entry:
+  call void @__init()
+  %value = call i64 @lisp_main()
+  %status = call i64 @lisp_exit_code(i64 %value)
+  %exit = trunc i64 %status to i32
+  ret i32 %exit
+}
+
+@lisp_check_overflow = global i8 0
+
+declare i64 @lisp_add(i64, i64)
+declare i64 @lisp_sub(i64, i64)
+declare i64 @lisp_mul(i64, i64)
+declare i64 @lisp_div(i64, i64)
+declare i64 @lisp_rem(i64, i64)
+declare i64 @lisp_mod(i64, i64)
+declare i64 @lisp_compare(i64, i64)
+declare i64 @lisp_big_from_string(i8*)
+declare i64 @lisp_box_double(double)
+declare double @lisp_to_double(i64)
+declare i64 @lisp_print(i64)
+declare i64 @lisp_exit_code(i64)
+declare i64 @lisp_to_int64(i64)
+declare i64 @lisp_from_int64(i64)
+declare void @lisp_raise(i8*, i64, ...)
+declare void @lisp_enter_handler()
+declare void @lisp_leave_handler()
+declare i64 @lisp_catch()
+declare i8* @lisp_suspend_error()
+declare void @lisp_resume_error(i8*)
+
+@lisp_error_pending = external global i8
+
+declare {i64, i1} @llvm.sadd.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.ssub.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.smul.with.overflow.i64(i64, i64)
+declare double @llvm.sqrt.f64(double)
+declare double @llvm.floor.f64(double)
+declare double @llvm.roundeven.f64(double)
+
+define internal i1 @__lisp_fixnums(i64 %a, i64 %b) alwaysinline {
+entry:
+  %tags = and i64 %a, %b
+  %tag = and i64 %tags, 1
+  %fixnums = icmp ne i64 %tag, 0
+  ret i1 %fixnums
+}
+
+define internal i1 @__lisp_is_flonum(i64 %a) {
+entry:
+  %tag = and i64 %a, 1
+  %fixnum = icmp ne i64 %tag, 0
+  br i1 %fixnum, label %exact, label %object
+
+exact:
+  ret i1 false
+
+object:
+  %pointer = inttoptr i64 %a to i64*
+  %kind = load i64, i64* %pointer
+  %flonum = icmp eq i64 %kind, 2
+  ret i1 %flonum
+}
+
+define internal i1 @__lisp_flonums(i64 %a, i64 %b) {
+entry:
+  %left = call i1 @__lisp_is_flonum(i64 %a)
+  %right = call i1 @__lisp_is_flonum(i64 %b)
+  %either = or i1 %left, %right
+  ret i1 %either
+}
+
+define internal i64 @__lisp_exact_to_inexact(i64 %a) {
+entry:
+  %x = call double @lisp_to_double(i64 %a)
+  %boxed = call i64 @lisp_box_double(double %x)
+  ret i64 %boxed
+}
+
+define internal i64 @__lisp_sqrt(i64 %a) {
+entry:
+  %x = call double @lisp_to_double(i64 %a)
+  %root = call double @llvm.sqrt.f64(double %x)
+  %boxed = call i64 @lisp_box_double(double %root)
+  ret i64 %boxed
+}
+
+define internal i64 @__lisp_add(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %untagged = sub i64 %a, 1
+  %result = call {i64, i1} @llvm.sadd.with.overflow.i64(i64 %untagged, i64 %b)
+  %overflow = extractvalue {i64, i1} %result, 1
+  br i1 %overflow, label %slow, label %done
+
+done:
+  %value = extractvalue {i64, i1} %result, 0
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fadd double %x, %y
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_add(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i64 @__lisp_sub(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %untagged = sub i64 %b, 1
+  %result = call {i64, i1} @llvm.ssub.with.overflow.i64(i64 %a, i64 %untagged)
+  %overflow = extractvalue {i64, i1} %result, 1
+  br i1 %overflow, label %slow, label %done
+
+done:
+  %value = extractvalue {i64, i1} %result, 0
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fsub double %x, %y
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_sub(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i64 @__lisp_mul(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %left = ashr i64 %a, 1
+  %right = sub i64 %b, 1
+  %result = call {i64, i1} @llvm.smul.with.overflow.i64(i64 %left, i64 %right)
+  %overflow = extractvalue {i64, i1} %result, 1
+  br i1 %overflow, label %slow, label %done
+
+done:
+  %product = extractvalue {i64, i1} %result, 0
+  %value = or i64 %product, 1
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fmul double %x, %y
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_mul(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i64 @__lisp_div(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %is_zero = icmp eq i64 %b, 1
+  %is_minus_one = icmp eq i64 %b, -1
+  %special = or i1 %is_zero, %is_minus_one
+  br i1 %special, label %slow, label %divide
+
+divide:
+  %left = ashr i64 %a, 1
+  %right = ashr i64 %b, 1
+  %result = sdiv i64 %left, %right
+  %untagged = add i64 %result, 0
+  %shifted = shl i64 %untagged, 1
+  %value = or i64 %shifted, 1
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fdiv double %x, %y
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_div(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i64 @__lisp_rem(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %is_zero = icmp eq i64 %b, 1
+  %is_minus_one = icmp eq i64 %b, -1
+  %special = or i1 %is_zero, %is_minus_one
+  br i1 %special, label %slow, label %divide
+
+divide:
+  %left = ashr i64 %a, 1
+  %right = ashr i64 %b, 1
+  %result = srem i64 %left, %right
+  %untagged = add i64 %result, 0
+  %shifted = shl i64 %untagged, 1
+  %value = or i64 %shifted, 1
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = frem double %x, %y
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_rem(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i64 @__lisp_mod(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %is_zero = icmp eq i64 %b, 1
+  %is_minus_one = icmp eq i64 %b, -1
+  %special = or i1 %is_zero, %is_minus_one
+  br i1 %special, label %slow, label %divide
+
+divide:
+  %left = ashr i64 %a, 1
+  %right = ashr i64 %b, 1
+  %result = srem i64 %left, %right
+  %is_nonzero = icmp ne i64 %result, 0
+  %sign = xor i64 %result, %right
+  %signs_differ = icmp slt i64 %sign, 0
+  %adjust = and i1 %is_nonzero, %signs_differ
+  %adjusted = add i64 %result, %right
+  %untagged = select i1 %adjust, i64 %adjusted, i64 %result
+  %shifted = shl i64 %untagged, 1
+  %value = or i64 %shifted, 1
+  ret i64 %value
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %truncated = frem double %x, %y
+  %float_is_nonzero = fcmp une double %truncated, 0.0
+  %float_negative = fcmp olt double %truncated, 0.0
+  %float_divisor_negative = fcmp olt double %y, 0.0
+  %float_signs_differ = xor i1 %float_negative, %float_divisor_negative
+  %float_adjust = and i1 %float_is_nonzero, %float_signs_differ
+  %float_adjusted = fadd double %truncated, %y
+  %real = select i1 %float_adjust, double %float_adjusted, double %truncated
+  %boxed = call i64 @lisp_box_double(double %real)
+  ret i64 %boxed
+
+slow:
+  %promoted = call i64 @lisp_mod(i64 %a, i64 %b)
+  ret i64 %promoted
+}
+
+define internal i1 @__lisp_lt(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %inline = icmp slt i64 %a, %b
+  ret i1 %inline
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fcmp olt double %x, %y
+  ret i1 %real
+
+slow:
+  %comparison = call i64 @lisp_compare(i64 %a, i64 %b)
+  %result = icmp slt i64 %comparison, 0
+  ret i1 %result
+}
+
+define internal i1 @__lisp_gt(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %inline = icmp sgt i64 %a, %b
+  ret i1 %inline
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fcmp ogt double %x, %y
+  ret i1 %real
+
+slow:
+  %comparison = call i64 @lisp_compare(i64 %a, i64 %b)
+  %result = icmp sgt i64 %comparison, 0
+  ret i1 %result
+}
+
+define internal i1 @__lisp_eq(i64 %a, i64 %b) {
+entry:
+  %fixnums = call i1 @__lisp_fixnums(i64 %a, i64 %b)
+  br i1 %fixnums, label %fast, label %inexact
+
+fast:
+  %inline = icmp eq i64 %a, %b
+  ret i1 %inline
+
+inexact:
+  %flonums = call i1 @__lisp_flonums(i64 %a, i64 %b)
+  br i1 %flonums, label %float, label %slow
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = call double @lisp_to_double(i64 %b)
+  %real = fcmp oeq double %x, %y
+  ret i1 %real
+
+slow:
+  %comparison = call i64 @lisp_compare(i64 %a, i64 %b)
+  %result = icmp eq i64 %comparison, 0
+  ret i1 %result
+}
+
+define internal i64 @__lisp_negate(i64 %a) {
+entry:
+  %flonum = call i1 @__lisp_is_flonum(i64 %a)
+  br i1 %flonum, label %float, label %exact
+
+exact:
+  %negated = call i64 @__lisp_sub(i64 1, i64 %a)
+  ret i64 %negated
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %y = fneg double %x
+  %boxed = call i64 @lisp_box_double(double %y)
+  ret i64 %boxed
+}
+
+define internal i64 @__lisp_floor(i64 %a) {
+entry:
+  %flonum = call i1 @__lisp_is_flonum(i64 %a)
+  br i1 %flonum, label %float, label %exact
+
+exact:
+  ret i64 %a
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %rounded = call double @llvm.floor.f64(double %x)
+  %boxed = call i64 @lisp_box_double(double %rounded)
+  ret i64 %boxed
+}
+
+define internal i64 @__lisp_round(i64 %a) {
+entry:
+  %flonum = call i1 @__lisp_is_flonum(i64 %a)
+  br i1 %flonum, label %float, label %exact
+
+exact:
+  ret i64 %a
+
+float:
+  %x = call double @lisp_to_double(i64 %a)
+  %rounded = call double @llvm.roundeven.f64(double %x)
+  %boxed = call i64 @lisp_box_double(double %rounded)
+  ret i64 %boxed
+}
+
+define internal void @__init() {
+entry:
+  ret void
+}
@@ -0,0 +1,25 @@
+; Hygienic macros, globals, floats and C functions
+(defmacro swap! (a b)
+  `(let ((tmp ,a))
+     (set! ,a ,b)
+     (set! ,b tmp)))
+
+(defmacro defsquare (name)
+  `(def ,name (v) (* v v)))
+
+(defsquare square)
+
+(extern puts (ptr) i32)
+
+(define scale 2.5)
+(define big (* 4611686018427387904 4))
+
+(def main ()
+  (let ((x 1) (tmp 2))
+    (swap! x tmp)
+    (print x)
+    (print (* scale tmp)))
+  (print big)
+  (print (square 12))
+  (puts "done")
+  0)
@@ -0,0 +1,739 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Type is a type in the inference pass, either a constructor applied to its
+// arguments or a type variable
+type Type interface {
+	String() string
+}
+
+// TypeConstructor is Int, Float, Bool, String, Symbol, List with its element
+// type or a function type "->" whose arguments are the parameters followed by
+// the result
+type TypeConstructor struct {
+	name string
+	args []Type
+}
+
+// TypeVariable is bound to a type once unification decides what it is,
+// numeric variables can only be bound to Int or Float
+type TypeVariable struct {
+	id       int
+	instance Type
+	numeric  bool
+}
+
+// TypeScheme is a type quantified over some of its variables, every use of a
+// function instantiates them afresh
+type TypeScheme struct {
+	variables []*TypeVariable
+	body      Type
+}
+
+// TypeInfo is the result of inference, the type of every expression and the
+// signature of every top level definition
+type TypeInfo struct {
+	types      map[ASTNode]Type
+	Signatures []string
+}
+
+var (
+	IntType    = &TypeConstructor{name: "Int"}
+	FloatType  = &TypeConstructor{name: "Float"}
+	BoolType   = &TypeConstructor{name: "Bool"}
+	StringType = &TypeConstructor{name: "String"}
+	SymbolType = &TypeConstructor{name: "Symbol"}
+)
+
+// InferredTypes lets codegen keep values it knows to be flonums unboxed, it
+// is only set when the types were checked
+var InferredTypes *TypeInfo
+
+// annotationType is the type an annotation names, nil when it doesn't name one
+func annotationType(annotation *TypeAnnotation) Type {
+	if annotation == nil {
+		return nil
+	}
+	if annotation.name == "list" && len(annotation.args) == 1 {
+		if element := annotationType(annotation.args[0]); element != nil {
+			return listType(element)
+		}
+		return nil
+	}
+	if len(annotation.args) != 0 {
+		return nil
+	}
+	switch annotation.name {
+	case "int":
+		return IntType
+	case "float":
+		return FloatType
+	case "bool":
+		return BoolType
+	case "string":
+		return StringType
+	}
+	return nil
+}
+
+// HasTypeAnnotations reports whether any def is annotated, annotated programs
+// are always type checked
+func HasTypeAnnotations(program []ASTNode) bool {
+	for _, node := range program {
+		if function, ok := node.(*FunctionNode); ok {
+			if function.returnType != nil {
+				return true
+			}
+			for _, annotation := range function.parameterTypes {
+				if annotation != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func listType(element Type) Type {
+	return &TypeConstructor{name: "List", args: []Type{element}}
+}
+
+func functionType(parameters []Type, result Type) Type {
+	return &TypeConstructor{name: "->", args: append(append([]Type{}, parameters...), result)}
+}
+
+// prune follows bound variables to the type they stand for
+func prune(t Type) Type {
+	for {
+		variable, ok := t.(*TypeVariable)
+		if !ok || variable.instance == nil {
+			return t
+		}
+		t = variable.instance
+	}
+}
+
+func (t *TypeConstructor) String() string {
+	return typeString(t, make(map[*TypeVariable]string))
+}
+
+func (v *TypeVariable) String() string {
+	return typeString(v, make(map[*TypeVariable]string))
+}
+
+// typeString names variables a, b, c... in the order they appear
+func typeString(t Type, names map[*TypeVariable]string) string {
+	switch t := prune(t).(type) {
+	case *TypeVariable:
+		if names[t] == "" {
+			names[t] = variableName(len(names))
+		}
+		return names[t]
+	case *TypeConstructor:
+		if len(t.args) == 0 {
+			return t.name
+		}
+		args := make([]string, len(t.args))
+		for indx, arg := range t.args {
+			args[indx] = typeString(arg, names)
+		}
+		if t.name == "->" {
+			parameters := strings.Join(args[:len(args)-1], " ")
+			if parameters == "" {
+				return "(-> " + args[len(args)-1] + ")"
+			}
+			return "(" + parameters + " -> " + args[len(args)-1] + ")"
+		}
+		return "(" + t.name + " " + strings.Join(args, " ") + ")"
+	}
+	return "?"
+}
+
+func variableName(indx int) string {
+	if indx < 26 {
+		return string(rune('a' + indx))
+	}
+	return fmt.Sprintf("t%d", indx)
+}
+
+// String shows the numeric constraints the way haskell does, Num a => (a -> a)
+func (s *TypeScheme) String() string {
+	names := make(map[*TypeVariable]string)
+	body := typeString(s.body, names)
+	constraints := make([]string, 0)
+	for _, variable := range freeVariables(s.body) {
+		if variable.numeric {
+			constraints = append(constraints, "Num "+names[variable])
+		}
+	}
+	if len(constraints) == 0 {
+		return body
+	}
+	return strings.Join(constraints, ", ") + " => " + body
+}
+
+func (t *TypeInfo) isFloat(node ASTNode) bool {
+	if t == nil || t.types[node] == nil {
+		return false
+	}
+	return prune(t.types[node]) == FloatType
+}
+
+type typeEnv struct {
+	names map[string]*TypeScheme
+	outer *typeEnv
+}
+
+func newTypeEnv(outer *typeEnv) *typeEnv {
+	return &typeEnv{names: make(map[string]*TypeScheme), outer: outer}
+}
+
+func (e *typeEnv) get(name string) *TypeScheme {
+	if scheme, ok := e.names[name]; ok {
+		return scheme
+	}
+	if e.outer == nil {
+		return nil
+	}
+	return e.outer.get(name)
+}
+
+// bind gives name a monomorphic type, used for parameters and variables
+func (e *typeEnv) bind(name string, t Type) {
+	e.names[name] = &TypeScheme{body: t}
+}
+
+type inferencer struct {
+	variables   int
+	types       map[ASTNode]Type
+	diagnostics []Diagnostic
+}
+
+func (i *inferencer) newVariable(numeric bool) *TypeVariable {
+	i.variables++
+	return &TypeVariable{id: i.variables, numeric: numeric}
+}
+
+func (i *inferencer) errorf(node any, format string, args ...any) {
+	i.diagnostics = append(i.diagnostics, Diagnostic{Span: node.(spanned).sourceSpan(), Message: fmt.Sprintf(format, args...)})
+}
+
+func occurs(variable *TypeVariable, t Type) bool {
+	switch t := prune(t).(type) {
+	case *TypeVariable:
+		return t == variable
+	case *TypeConstructor:
+		for _, arg := range t.args {
+			if occurs(variable, arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isNumeric(t Type) bool {
+	return t == IntType || t == FloatType
+}
+
+// unify makes expected and actual the same type, errors describe the
+// mismatch from the point of view of expected
+func unify(expected Type, actual Type) error {
+	expected, actual = prune(expected), prune(actual)
+	if variable, ok := expected.(*TypeVariable); ok {
+		return bindVariable(variable, actual, expected, actual)
+	}
+	if variable, ok := actual.(*TypeVariable); ok {
+		return bindVariable(variable, expected, expected, actual)
+	}
+	expectedConstructor := expected.(*TypeConstructor)
+	actualConstructor := actual.(*TypeConstructor)
+	if expectedConstructor.name != actualConstructor.name || len(expectedConstructor.args) != len(actualConstructor.args) {
+		return fmt.Errorf("expected %s, got %s", expected, actual)
+	}
+	for indx := range expectedConstructor.args {
+		if err := unify(expectedConstructor.args[indx], actualConstructor.args[indx]); err != nil {
+			return fmt.Errorf("expected %s, got %s", expected, actual)
+		}
+	}
+	return nil
+}
+
+func bindVariable(variable *TypeVariable, t Type, expected Type, actual Type) error {
+	if other, ok := t.(*TypeVariable); ok {
+		if other != variable {
+			other.numeric = other.numeric || variable.numeric
+			variable.instance = other
+		}
+		return nil
+	}
+	if occurs(variable, t) {
+		return fmt.Errorf("expected %s, got %s which contains it", expected, actual)
+	}
+	if variable.numeric && !isNumeric(t) {
+		return fmt.Errorf("expected a number, got %s", t)
+	}
+	variable.instance = t
+	return nil
+}
+
+// freeVariables lists the unbound variables of t in order of appearance
+func freeVariables(t Type) []*TypeVariable {
+	switch t := prune(t).(type) {
+	case *TypeVariable:
+		return []*TypeVariable{t}
+	case *TypeConstructor:
+		variables := make([]*TypeVariable, 0)
+		for _, arg := range t.args {
+			for _, variable := range freeVariables(arg) {
+				if !Includes(variables, variable) {
+					variables = append(variables, variable)
+				}
+			}
+		}
+		return variables
+	}
+	return nil
+}
+
+func (e *typeEnv) freeVariables() []*TypeVariable {
+	variables := make([]*TypeVariable, 0)
+	for ; e != nil; e = e.outer {
+		for _, scheme := range e.names {
+			for _, variable := range freeVariables(scheme.body) {
+				if !Includes(scheme.variables, variable) {
+					variables = append(variables, variable)
+				}
+			}
+		}
+	}
+	return variables
+}
+
+func generalize(t Type, env *typeEnv) *TypeScheme {
+	bound := env.freeVariables()
+	variables := make([]*TypeVariable, 0)
+	for _, variable := range freeVariables(t) {
+		if !Includes(bound, variable) {
+			variables = append(variables, variable)
+		}
+	}
+	return &TypeScheme{variables: variables, body: t}
+}
+
+func (i *inferencer) instantiate(scheme *TypeScheme) Type {
+	fresh := make(map[*TypeVariable]Type)
+	for _, variable := range scheme.variables {
+		fresh[variable] = i.newVariable(variable.numeric)
+	}
+	var copyType func(t Type) Type
+	copyType = func(t Type) Type {
+		switch t := prune(t).(type) {
+		case *TypeVariable:
+			if replacement, ok := fresh[t]; ok {
+				return replacement
+			}
+			return t
+		case *TypeConstructor:
+			if len(t.args) == 0 {
+				return t
+			}
+			args := make([]Type, len(t.args))
+			for indx, arg := range t.args {
+				args[indx] = copyType(arg)
+			}
+			return &TypeConstructor{name: t.name, args: args}
+		}
+		return t
+	}
+	return copyType(scheme.body)
+}
+
+// InferTypes runs Hindley-Milner inference over a checked program. Top level
+// definitions are inferred in dependency order so functions are polymorphic
+// in their callers, mutually recursive functions are inferred together.
+// Arithmetic on Ints is Int and becomes Float once a Float takes part.
+func InferTypes(program []ASTNode) (*TypeInfo, []Diagnostic) {
+	i := &inferencer{types: make(map[ASTNode]Type)}
+	globals := newTypeEnv(nil)
+	definitions := make(map[string]ASTNode)
+	names := make([]string, 0)
+	for _, node := range program {
+		switch node := node.(type) {
+		case *FunctionNode:
+			definitions[node.name] = node
+			names = append(names, node.name)
+		case *DefineNode:
+			definitions[node.name] = node
+			names = append(names, node.name)
+		case *ExternNode:
+			globals.names[node.name] = generalize(i.foreignType(node), globals)
+		}
+	}
+	for _, group := range dependencyGroups(names, definitions) {
+		i.inferGroup(group, definitions, globals)
+	}
+	for _, node := range program {
+		switch node.(type) {
+		case *FunctionNode, *DefineNode, *ExternNode:
+		default:
+			i.infer(node, globals)
+		}
+	}
+	info := &TypeInfo{types: i.types, Signatures: make([]string, 0)}
+	for _, name := range names {
+		info.Signatures = append(info.Signatures, fmt.Sprintf("%s : %s", name, globals.get(name)))
+	}
+	sort.SliceStable(i.diagnostics, func(a, b int) bool {
+		return i.diagnostics[a].Span.Start < i.diagnostics[b].Span.Start
+	})
+	return info, i.diagnostics
+}
+
+// inferGroup infers definitions that refer to each other, they are
+// monomorphic among themselves and generalized once the group is done
+func (i *inferencer) inferGroup(group []string, definitions map[string]ASTNode, globals *typeEnv) {
+	placeholders := make(map[string]Type)
+	for _, name := range group {
+		placeholders[name] = i.newVariable(false)
+		globals.bind(name, placeholders[name])
+	}
+	for _, name := range group {
+		switch definition := definitions[name].(type) {
+		case *FunctionNode:
+			env := newTypeEnv(globals)
+			parameters := make([]Type, len(definition.arguments))
+			for indx, arg := range definition.arguments {
+				parameters[indx] = annotationType(definition.parameterType(indx))
+				if parameters[indx] == nil {
+					parameters[indx] = i.newVariable(false)
+				}
+				env.bind(arg, parameters[indx])
+			}
+			result := i.inferBody(definition.body, env)
+			if annotated := annotationType(definition.returnType); annotated != nil {
+				if err := unify(annotated, result); err != nil {
+					i.errorf(definition.returnType, "%s returns %s", name, err)
+				}
+				result = annotated
+			}
+			if err := unify(placeholders[name], functionType(parameters, result)); err != nil {
+				i.errorf(definition, "%s: %s", name, err)
+			}
+			i.types[definition] = placeholders[name]
+		case *DefineNode:
+			if err := unify(placeholders[name], i.infer(definition.value, globals)); err != nil {
+				i.errorf(definition, "%s: %s", name, err)
+			}
+			i.types[definition] = placeholders[name]
+		}
+	}
+	for _, name := range group {
+		delete(globals.names, name)
+	}
+	for _, name := range group {
+		if _, ok := definitions[name].(*FunctionNode); ok {
+			globals.names[name] = generalize(placeholders[name], globals)
+		} else {
+			globals.bind(name, placeholders[name])
+		}
+	}
+}
+
+// foreignType is the type of a C function, integers are Int and floating
+// point numbers Float. A ptr parameter takes a string or an integer address.
+func (i *inferencer) foreignType(extern *ExternNode) Type {
+	cType := func(name string) Type {
+		switch name {
+		case "float", "double":
+			return FloatType
+		case "ptr":
+			return i.newVariable(false)
+		}
+		return IntType
+	}
+	parameters := make([]Type, len(extern.parameters))
+	for indx, parameter := range extern.parameters {
+		parameters[indx] = cType(parameter)
+	}
+	result := IntType
+	if extern.result == "float" || extern.result == "double" {
+		result = FloatType
+	}
+	return functionType(parameters, result)
+}
+
+// inferBody is the type of the last expression, an empty body returns 0
+func (i *inferencer) inferBody(body []ASTNode, env *typeEnv) Type {
+	var result Type = IntType
+	for _, expr := range body {
+		result = i.infer(expr, env)
+	}
+	return result
+}
+
+func (i *inferencer) infer(node ASTNode, env *typeEnv) Type {
+	t := i.inferNode(node, env)
+	i.types[node] = t
+	return t
+}
+
+func (i *inferencer) inferNode(node ASTNode, env *typeEnv) Type {
+	switch node := node.(type) {
+	case *IntegerNode:
+		return IntType
+	case *FloatNode:
+		return FloatType
+	case *StringNode:
+		return StringType
+	case *IdentifierNode:
+		if scheme := env.get(node.name); scheme != nil {
+			return i.instantiate(scheme)
+		}
+		return i.newVariable(false)
+	case *ReferenceNode:
+		i.infer(node.value, env)
+		return IntType
+	case *SExpr:
+		return i.inferCall(node, env)
+	case *IfNode:
+		i.inferCondition(node.condition, env)
+		trueType := i.infer(node.trueExpr, env)
+		if node.falseExpr == nil {
+			if err := unify(IntType, trueType); err != nil {
+				i.errorf(node.trueExpr, "if without an else evaluates to 0: %s", err)
+			}
+			return IntType
+		}
+		if err := unify(trueType, i.infer(node.falseExpr, env)); err != nil {
+			i.errorf(node.falseExpr, "if branches differ: %s", err)
+		}
+		return trueType
+	case *SetNode:
+		valueType := i.infer(node.value, env)
+		if scheme := env.get(node.name); scheme != nil {
+			if err := unify(i.instantiate(scheme), valueType); err != nil {
+				i.errorf(node.value, "set! %s: %s", node.name, err)
+			}
+		}
+		return valueType
+	case *WhileNode:
+		i.inferCondition(node.condition, env)
+		i.inferBody(node.body, env)
+		return IntType
+	case *DoNode:
+		loopEnv := i.inferBindings(node.bindings, env)
+		for _, binding := range node.bindings {
+			if binding.step == nil {
+				continue
+			}
+			if err := unify(i.instantiate(loopEnv.get(binding.name)), i.infer(binding.step, loopEnv)); err != nil {
+				i.errorf(binding.step, "step of %s: %s", binding.name, err)
+			}
+		}
+		i.inferCondition(node.test, loopEnv)
+		i.inferBody(node.body, loopEnv)
+		return i.inferBody(node.result, loopEnv)
+	case *LetNode:
+		return i.inferBody(node.body, i.inferBindings(node.bindings, env))
+	case *ErrorNode:
+		for _, irritant := range node.irritants {
+			i.infer(irritant, env)
+		}
+		return i.newVariable(false)
+	case *CatchNode:
+		bodyType := i.inferBody(node.body, env)
+		handlerEnv := env
+		if node.variable != "" {
+			handlerEnv = newTypeEnv(env)
+			handlerEnv.bind(node.variable, i.newVariable(false))
+		}
+		if err := unify(bodyType, i.inferBody(node.handler, handlerEnv)); err != nil {
+			// An empty handler is reported at the guard
+			var at ASTNode = node
+			if len(node.handler) > 0 {
+				at = node.handler[len(node.handler)-1]
+			}
+			i.errorf(at, "handler differs from the body: %s", err)
+		}
+		return bodyType
+	case *WindNode:
+		i.infer(node.before, env)
+		i.infer(node.after, env)
+		return i.infer(node.body, env)
+	case *QuoteNode:
+		return i.datumType(node.datum)
+	case *QuasiquoteNode:
+		for _, hole := range templateHoles(node.template, nil) {
+			i.infer(hole.expr, env)
+		}
+	}
+	return i.newVariable(false)
+}
+
+// datumType is the type of quoted data, a list whose elements differ has
+// elements of an unknown type
+func (i *inferencer) datumType(datum Value) Type {
+	switch datum := datum.(type) {
+	case Fixnum, *Bignum:
+		return IntType
+	case Flonum:
+		return FloatType
+	case Symbol:
+		return SymbolType
+	case List:
+		var element Type = i.newVariable(false)
+		for _, item := range datum {
+			if err := unify(element, i.datumType(item)); err != nil {
+				return listType(i.newVariable(false))
+			}
+		}
+		return listType(element)
+	}
+	return i.newVariable(false)
+}
+
+// Bindings are monomorphic, set! could otherwise give a variable two types
+func (i *inferencer) inferBindings(bindings []Binding, env *typeEnv) *typeEnv {
+	inner := newTypeEnv(env)
+	for _, binding := range bindings {
+		inner.bind(binding.name, i.infer(binding.init, env))
+	}
+	return inner
+}
+
+func (i *inferencer) inferCondition(condition *SExpr, env *typeEnv) {
+	if err := unify(BoolType, i.infer(condition, env)); err != nil {
+		i.errorf(condition, "condition: %s", err)
+	}
+}
+
+func (i *inferencer) inferCall(call *SExpr, env *typeEnv) Type {
+	arguments := make([]Type, len(call.arguments))
+	for indx, arg := range call.arguments {
+		arguments[indx] = i.infer(arg, env)
+	}
+	// Numeric builtins take numbers. Ints are promoted where they meet a
+	// Float, so arithmetic is Float if any argument is, Int if all are and
+	// otherwise the number type its unknown arguments share.
+	number := func() Type {
+		var number Type = IntType
+		float := false
+		for indx, arg := range call.arguments {
+			switch argument := prune(arguments[indx]).(type) {
+			case *TypeVariable:
+				if number == IntType {
+					number = i.newVariable(true)
+				}
+				if err := unify(number, argument); err != nil {
+					i.errorf(arg, "%s: %s", call.operand, err)
+				}
+			default:
+				if !isNumeric(argument) {
+					i.errorf(arg, "%s: expected a number, got %s", call.operand, argument)
+				}
+				float = float || argument == FloatType
+			}
+		}
+		if float {
+			return FloatType
+		}
+		return number
+	}
+	switch {
+	case Includes(arithmeticOps, call.operand) || call.operand == "floor" || call.operand == "round":
+		return number()
+	case Includes(comparisionOps, call.operand):
+		number()
+		return BoolType
+	case call.operand == "exact->inexact" || call.operand == "sqrt":
+		number()
+		return FloatType
+	case call.operand == "print":
+		if len(arguments) == 1 {
+			return arguments[0]
+		}
+		return i.newVariable(false)
+	case Includes(systemCalls, call.operand):
+		return IntType
+	}
+	scheme := env.get(call.operand)
+	if scheme == nil {
+		return i.newVariable(false)
+	}
+	callee := i.instantiate(scheme)
+	result := i.newVariable(false)
+	if function, ok := prune(callee).(*TypeConstructor); ok && function.name == "->" && len(function.args) == len(arguments)+1 {
+		for indx, arg := range call.arguments {
+			if err := unify(function.args[indx], arguments[indx]); err != nil {
+				i.errorf(arg, "argument %d of %s: %s", indx+1, call.operand, err)
+			}
+		}
+		return function.args[len(arguments)]
+	}
+	if err := unify(callee, functionType(arguments, result)); err != nil {
+		i.errorf(call, "%s: %s", call.operand, err)
+	}
+	return result
+}
+
+// dependencyGroups orders top level definitions so that everything a
+// definition refers to comes first, definitions that refer to each other
+// share a group (Tarjan's strongly connected components)
+func dependencyGroups(names []string, definitions map[string]ASTNode) [][]string {
+	edges := make(map[string][]string)
+	for _, name := range names {
+		edges[name] = make([]string, 0)
+		renameFree(definitions[name], nil, func(reference string, _ ASTNode) string {
+			if definitions[reference] != nil && !Includes(edges[name], reference) {
+				edges[name] = append(edges[name], reference)
+			}
+			return reference
+		})
+	}
+	index := make(map[string]int)
+	lowLink := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := make([]string, 0)
+	groups := make([][]string, 0)
+	var connect func(name string)
+	connect = func(name string) {
+		index[name] = len(index)
+		lowLink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+		for _, next := range edges[name] {
+			if _, visited := index[next]; !visited {
+				connect(next)
+				lowLink[name] = min(lowLink[name], lowLink[next])
+			} else if onStack[next] {
+				lowLink[name] = min(lowLink[name], index[next])
+			}
+		}
+		if lowLink[name] != index[name] {
+			return
+		}
+		group := make([]string, 0)
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			group = append(group, member)
+			if member == name {
+				break
+			}
+		}
+		groups = append(groups, group)
+	}
+	for _, name := range names {
+		if _, visited := index[name]; !visited {
+			connect(name)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func inferProgram(t *testing.T, input string) (*TypeInfo, []string) {
+	t.Helper()
+	expressions, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, diagnostics := InferTypes(expressions)
+	messages := make([]string, 0)
+	for _, diagnostic := range diagnostics {
+		line, column := Position(input, diagnostic.Span.Start)
+		messages = append(messages, fmt.Sprintf("%d:%d: %s", line, column, diagnostic.Message))
+	}
+	return info, messages
+}
+
+func TestInferTypes(t *testing.T) {
+	type TestCase struct {
+		input      string
+		signatures []string
+	}
+	testCases := []TestCase{
+		{input: "(def main() (+ 1 2))", signatures: []string{"main : (-> Int)"}},
+		{input: "(def half(x) (/ x 2.0))", signatures: []string{"half : Num a => (a -> Float)"}},
+		{input: "(def add(a b) (+ a b))", signatures: []string{"add : Num a => (a a -> a)"}},
+		{input: "(def id(x) x) (def main() (id 1) (id 2.5))", signatures: []string{"id : (a -> a)", "main : (-> Float)"}},
+		{input: "(def root(x) (sqrt x)) (define r (root 4))", signatures: []string{"root : Num a => (a -> Float)", "r : Float"}},
+		{input: "(define x 1.5) (def scale(y) (* x y))", signatures: []string{"x : Float", "scale : Num a => (a -> Float)"}},
+		{
+			input:      "(def is_even(n) (if (= n 0) 1 (is_odd (- n 1)))) (def is_odd(n) (if (= n 0) 0 (is_even (- n 1))))",
+			signatures: []string{"is_even : Num a => (a -> Int)", "is_odd : Num a => (a -> Int)"},
+		},
+		{input: "(def fib(n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))", signatures: []string{"fib : Num a => (a -> a)"}},
+		{input: "(def sum(n) (do ((i 0 (+ i 1)) (total 0.0 (+ total (exact->inexact i)))) ((= i n) total)))", signatures: []string{"sum : Num a => (a -> Float)"}},
+		{input: "(def area(r) (let ((pi 3.14159)) (* pi r r)))", signatures: []string{"area : Num a => (a -> Float)"}},
+		{input: "(def count(n) (while (< n 10) (set! n (+ n 1))) n)", signatures: []string{"count : Num a => (a -> a)"}},
+		{input: "(def add((a : float) b) (+ a b))", signatures: []string{"add : Num a => (Float a -> Float)"}},
+		{input: "(def id(x) : int x)", signatures: []string{"id : (Int -> Int)"}},
+		{input: "(extern pow (double double) double) (def cube(x) (pow x 3.0))", signatures: []string{"cube : (Float -> Float)"}},
+		{input: "(extern puts (ptr) i32) (def main() (puts \"hi\") (puts 0))", signatures: []string{"main : (-> Int)"}},
+		{input: "(def safe(a b) (catch (/ a b) 0))", signatures: []string{"safe : (Int Int -> Int)"}},
+		{input: "(def check(x) (if (< x 0) (error \"negative\" x) x)) (def main() (guard (e (* e 2)) (check 3)))", signatures: []string{"check : Num a => (a -> a)", "main : (-> Int)"}},
+		// Ints are promoted where they meet a Float
+		{input: "(def main() (+ 1 2.5))", signatures: []string{"main : (-> Float)"}},
+		{input: "(def half(x) (/ x 2.0)) (define h (half 3))", signatures: []string{"half : Num a => (a -> Float)", "h : Float"}},
+		{input: "(def inc(x) : float (+ x 1))", signatures: []string{"inc : (Float -> Float)"}},
+		{input: "(def scale((x : int)) (/ x 2.0))", signatures: []string{"scale : (Int -> Float)"}},
+		{input: "(define xs '(1 2 3)) (define ys '(1.5 x)) (define s 'x)", signatures: []string{"xs : (List Int)", "ys : (List a)", "s : Symbol"}},
+	}
+	for _, testCase := range testCases {
+		info, messages := inferProgram(t, testCase.input)
+		if len(messages) != 0 {
+			t.Errorf("%s: unexpected type errors %v", testCase.input, messages)
+			continue
+		}
+		if fmt.Sprint(info.Signatures) != fmt.Sprint(testCase.signatures) {
+			t.Errorf("%s: expected %q, got %q", testCase.input, testCase.signatures, info.Signatures)
+		}
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	type TestCase struct {
+		input    string
+		messages []string
+	}
+	testCases := []TestCase{
+		// The check pass keeps comparisons out of arithmetic, inference catches it on its own too
+		{input: "(def main() (+ 1 (< 1 2)))", messages: []string{"1:18: +: expected a number, got Bool"}},
+		{input: "(def main() (+ 1 '(1 2)))", messages: []string{"1:18: +: expected a number, got (List Int)"}},
+		{input: "(def main() (* 'x 2.5))", messages: []string{"1:16: *: expected a number, got Symbol"}},
+		{input: "(def main() (if (< 1 2) 1 2.0))", messages: []string{"1:27: if branches differ: expected Int, got Float"}},
+		{input: "(def main() (if (< 1 2) 1.0))", messages: []string{"1:25: if without an else evaluates to 0: expected Int, got Float"}},
+		{input: "(define x 1) (def main() (set! x 2.0))", messages: []string{"1:34: set! x: expected Int, got Float"}},
+		{input: "(def main() (if (+ 1 2) 1 2))", messages: []string{"1:17: condition: expected Bool, got Int"}},
+		{input: "(def main() (let ((b (< 1 2))) (* b 2)))", messages: []string{"1:35: *: expected a number, got Bool"}},
+		{input: "(def f((x : int)) : float (+ x 1))", messages: []string{"1:21: f returns expected Float, got Int"}},
+		{input: "(def f((x : float)) x) (def main() (f 1))", messages: []string{"1:39: argument 1 of f: expected Float, got Int"}},
+		{input: "(def main() (catch 1 2.5))", messages: []string{"1:22: handler differs from the body: expected Int, got Float"}},
+		{input: "(def main() (guard (e) 1.5))", messages: []string{"1:13: handler differs from the body: expected Float, got Int"}},
+	}
+	for _, testCase := range testCases {
+		_, messages := inferProgram(t, testCase.input)
+		if fmt.Sprint(messages) != fmt.Sprint(testCase.messages) {
+			t.Errorf("%s: expected %q, got %q", testCase.input, testCase.messages, messages)
+		}
+	}
+}
+
+func TestTypeStrings(t *testing.T) {
+	element := &TypeVariable{id: 1}
+	types := map[string]Type{
+		"(List a)":                 listType(element),
+		"((List a) -> a)":          functionType([]Type{listType(element)}, element),
+		"(String Int -> Bool)":     functionType([]Type{StringType, IntType}, BoolType),
+		"(-> (List (List Float)))": functionType(nil, listType(listType(FloatType))),
+	}
+	for expected, typ := range types {
+		if typ.String() != expected {
+			t.Errorf("Expected %s, got %s", expected, typ)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Value is what expressions evaluate to in the interpreter
+type Value interface {
+	String() string
+}
+
+// Fixnum is an integer that fits in a machine word, arithmetic that overflows
+// it promotes the result to a Bignum.
+type Fixnum int64
+
+// Bignum holds integers outside the Fixnum range, results are normalised back
+// to a Fixnum whenever they fit.
+type Bignum struct {
+	value *big.Int
+}
+
+// Flonum is an inexact number, any arithmetic involving one is inexact
+type Flonum float64
+
+func (f Fixnum) String() string {
+	return strconv.FormatInt(int64(f), 10)
+}
+
+func (b *Bignum) String() string {
+	return b.value.String()
+}
+
+// Integral flonums keep a trailing .0 so they read back as inexact, the C
+// runtime prints the same text
+func (f Flonum) String() string {
+	switch {
+	case math.IsNaN(float64(f)):
+		return "+nan.0"
+	case math.IsInf(float64(f), 1):
+		return "+inf.0"
+	case math.IsInf(float64(f), -1):
+		return "-inf.0"
+	}
+	formatted := strconv.FormatFloat(float64(f), 'g', -1, 64)
+	if !strings.ContainsAny(formatted, ".e") {
+		formatted += ".0"
+	}
+	return formatted
+}
+
+func normalizeBig(value *big.Int) Value {
+	if value.IsInt64() {
+		return Fixnum(value.Int64())
+	}
+	return &Bignum{value}
+}
+
+func toBig(value Value) *big.Int {
+	switch value := value.(type) {
+	case Fixnum:
+		return big.NewInt(int64(value))
+	case *Bignum:
+		return value.value
+	}
+	panic(fmt.Sprintf("Expected an integer, got %s", value))
+}
+
+func toFloat(value Value) float64 {
+	switch value := value.(type) {
+	case Fixnum:
+		return float64(value)
+	case *Bignum:
+		float, _ := new(big.Float).SetInt(value.value).Float64()
+		return float
+	case Flonum:
+		return float64(value)
+	}
+	panic(fmt.Sprintf("Expected a number, got %s", value))
+}
+
+func isInexact(a Value, b Value) bool {
+	_, aInexact := a.(Flonum)
+	_, bInexact := b.(Flonum)
+	return aInexact || bInexact
+}
+
+// promote is called when fixnum arithmetic overflowed
+func promote(result *big.Int) Value {
+	if CheckOverflow {
+		panic(ErrIntegerOverflow)
+	}
+	return normalizeBig(result)
+}
+
+func addValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		return Flonum(toFloat(a) + toFloat(b))
+	}
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		result := x + y
+		if (result > x) == (y > 0) {
+			return result
+		}
+		return promote(new(big.Int).Add(toBig(a), toBig(b)))
+	}
+	return normalizeBig(new(big.Int).Add(toBig(a), toBig(b)))
+}
+
+func subValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		return Flonum(toFloat(a) - toFloat(b))
+	}
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		result := x - y
+		if (result < x) == (y > 0) {
+			return result
+		}
+		return promote(new(big.Int).Sub(toBig(a), toBig(b)))
+	}
+	return normalizeBig(new(big.Int).Sub(toBig(a), toBig(b)))
+}
+
+func mulValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		return Flonum(toFloat(a) * toFloat(b))
+	}
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		result := x * y
+		if x == 0 || (result/x == y && !(x == -1 && y == math.MinInt64)) {
+			return result
+		}
+		return promote(new(big.Int).Mul(toBig(a), toBig(b)))
+	}
+	return normalizeBig(new(big.Int).Mul(toBig(a), toBig(b)))
+}
+
+func divValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		return Flonum(toFloat(a) / toFloat(b))
+	}
+	if isZero(b) {
+		panic(ErrDivisionByZero)
+	}
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		if x == math.MinInt64 && y == -1 {
+			return promote(new(big.Int).Neg(toBig(a)))
+		}
+		return x / y
+	}
+	return normalizeBig(new(big.Int).Quo(toBig(a), toBig(b)))
+}
+
+func negateValue(a Value) Value {
+	if float, ok := a.(Flonum); ok {
+		return -float
+	}
+	return subValues(Fixnum(0), a)
+}
+
+// remainder truncates like srem, the result takes the sign of the dividend
+func remValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		return Flonum(math.Mod(toFloat(a), toFloat(b)))
+	}
+	if isZero(b) {
+		panic(ErrDivisionByZero)
+	}
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		if y == -1 {
+			return Fixnum(0)
+		}
+		return x % y
+	}
+	return normalizeBig(new(big.Int).Rem(toBig(a), toBig(b)))
+}
+
+// modulo floors, the result takes the sign of the divisor
+func modValues(a Value, b Value) Value {
+	if isInexact(a, b) {
+		remainder := math.Mod(toFloat(a), toFloat(b))
+		if remainder != 0 && (remainder < 0) != (toFloat(b) < 0) {
+			remainder += toFloat(b)
+		}
+		return Flonum(remainder)
+	}
+	remainder := remValues(a, b)
+	if !isZero(remainder) && (compareValues(remainder, Fixnum(0)) < 0) != (compareValues(b, Fixnum(0)) < 0) {
+		return addValues(remainder, b)
+	}
+	return remainder
+}
+
+// compareNumbers applies one of the comparision operators, flonums compare
+// as IEEE doubles so NaN is neither smaller, larger nor equal
+func compareNumbers(operand string, a Value, b Value) bool {
+	if isInexact(a, b) {
+		x, y := toFloat(a), toFloat(b)
+		switch operand {
+		case "<":
+			return x < y
+		case ">":
+			return x > y
+		case "=":
+			return x == y
+		}
+		panic("Error: unknown comparision " + operand)
+	}
+	comparison := compareValues(a, b)
+	switch operand {
+	case "<":
+		return comparison < 0
+	case ">":
+		return comparison > 0
+	case "=":
+		return comparison == 0
+	}
+	panic("Error: unknown comparision " + operand)
+}
+
+// compareValues orders two exact numbers
+func compareValues(a Value, b Value) int {
+	x, xok := a.(Fixnum)
+	y, yok := b.(Fixnum)
+	if xok && yok {
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+		return 0
+	}
+	return toBig(a).Cmp(toBig(b))
+}
+
+func isZero(value Value) bool {
+	fixnum, ok := value.(Fixnum)
+	return ok && fixnum == 0
+}
+
+// parseInteger reads a literal of any length, falling back to a Bignum when
+// it does not fit in a Fixnum
+func parseInteger(digits string) (Value, bool) {
+	if value, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		return Fixnum(value), true
+	}
+	value, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, false
+	}
+	return normalizeBig(value), true
+}
+
+// parseNumber reads a decimal literal, anything with a fraction or an exponent
+// is a Flonum
+func parseNumber(literal string) (Value, bool) {
+	if !strings.ContainsAny(literal, ".eE") {
+		return parseInteger(literal)
+	}
+	value, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, false
+	}
+	return Flonum(value), true
+}
+
+// Symbol is a quoted identifier. Symbols written in a macro's templates
+// remember which expansion introduced them, so the variables a macro binds
+// can be renamed apart from the ones in its arguments.
+type Symbol struct {
+	name      string
+	expansion int
+}
+
+// List is a quoted list, the empty list is nil
+type List []Value
+
+// String is a string literal, the interpreter hands it to foreign functions
+// standing in for ones taking a char *
+type String string
+
+func (s String) String() string {
+	return string(s)
+}
+
+func (s Symbol) String() string {
+	return s.name
+}
+
+func (l List) String() string {
+	items := make([]string, len(l))
+	for indx, item := range l {
+		items[indx] = item.String()
+	}
+	return "(" + strings.Join(items, " ") + ")"
+}
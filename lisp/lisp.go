@@ -0,0 +1,122 @@
+// Package lisp embeds the interpreter in Go programs, for using the language
+// as a configuration or scripting layer. A Runtime holds the functions and
+// globals of the programs loaded into it, Go code calls them with Call and
+// programs call the Go functions registered with RegisterBuiltin.
+//
+//	rt := lisp.NewRuntime()
+//	if err := rt.LoadString("(def double(x) (* x 2))"); err != nil {
+//		return err
+//	}
+//	value, err := rt.Call("double", lisp.Int(21))
+//
+// Errors in a program are returned, they never panic in the host, and the
+// runtime's limits keep untrusted programs from running away. A Runtime is
+// not safe for concurrent use, but Runtimes share no state and different
+// ones can run on different goroutines.
+package lisp
+
+import (
+	"context"
+	"lisp-compiler/core"
+	"time"
+)
+
+// Value is what Lisp expressions evaluate to
+type Value = core.Value
+
+// The values Go code passes to Lisp and gets back. Integers too large for an
+// Int come back as *core.Bignum.
+type (
+	Int    = core.Fixnum
+	Float  = core.Flonum
+	String = core.String
+	List   = core.List
+)
+
+// Builtin is a Go function Lisp code can call, an error it returns stops the
+// program and is returned to whoever called into the runtime
+type Builtin func(args []Value) (Value, error)
+
+// RuntimeError is the error a program that failed while running returns,
+// Trace lists the Lisp calls that led to it
+type RuntimeError = core.RuntimeError
+
+// LimitExceeded is the error a LoadString or Call that went over one of the
+// runtime's limits fails with
+type LimitExceeded = core.LimitExceeded
+
+// DefaultMaxDepth is how deeply calls can nest in a new runtime
+const DefaultMaxDepth = core.DefaultMaxDepth
+
+// Runtime limits apply to each LoadString and Call on its own, 0 is unlimited
+type Runtime struct {
+	session *core.Session
+	// MaxDepth is how deeply function calls can nest
+	MaxDepth int
+	// MaxSteps is how many calls and loop iterations can be taken
+	MaxSteps int
+	// MaxAllocations is how much can be allocated, counted in scopes, list
+	// cells and bignum words
+	MaxAllocations int
+	// Timeout is how long it can take
+	Timeout time.Duration
+}
+
+// NewRuntime returns a runtime with the standard prelude loaded
+func NewRuntime() *Runtime {
+	return &Runtime{session: core.NewSession(), MaxDepth: DefaultMaxDepth}
+}
+
+// NewBareRuntime returns a runtime without the standard prelude
+func NewBareRuntime() *Runtime {
+	rt := NewRuntime()
+	rt.session.Prelude = false
+	return rt
+}
+
+// LoadString evaluates src, its definitions can be called from Go and from
+// programs loaded later. A main function in src runs as it does in the
+// interpreter.
+func (rt *Runtime) LoadString(src string) error {
+	return rt.LoadStringContext(context.Background(), src)
+}
+
+// LoadStringContext is LoadString, stopped with the context's error once ctx
+// is done
+func (rt *Runtime) LoadStringContext(ctx context.Context, src string) error {
+	rt.session.Limits = rt.limits(ctx)
+	_, err := rt.session.Load("<string>", src)
+	return err
+}
+
+// Call calls a function defined by a loaded program
+func (rt *Runtime) Call(name string, args ...Value) (Value, error) {
+	return rt.CallContext(context.Background(), name, args...)
+}
+
+// CallContext is Call, stopped with the context's error once ctx is done
+func (rt *Runtime) CallContext(ctx context.Context, name string, args ...Value) (Value, error) {
+	rt.session.Limits = rt.limits(ctx)
+	return rt.session.Call(name, args)
+}
+
+func (rt *Runtime) limits(ctx context.Context) core.Limits {
+	return core.Limits{
+		Context:        ctx,
+		Timeout:        rt.Timeout,
+		MaxDepth:       rt.MaxDepth,
+		MaxSteps:       rt.MaxSteps,
+		MaxAllocations: rt.MaxAllocations,
+	}
+}
+
+// RegisterBuiltin makes fn callable from programs loaded afterwards as
+// (name args...)
+func (rt *Runtime) RegisterBuiltin(name string, fn Builtin) error {
+	return rt.session.DefineHostFunction(name, core.HostFunction(fn))
+}
+
+// Global is the value of a global variable a loaded program defined
+func (rt *Runtime) Global(name string) (Value, bool) {
+	return rt.session.Global(name)
+}
@@ -0,0 +1,230 @@
+package lisp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lisp-compiler/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadAndCall(t *testing.T) {
+	rt := NewRuntime()
+	if err := rt.LoadString("(define base 100) (def fact (n) (if (< n 2) 1 (* n (fact (- n 1)))))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.LoadString("(def scaled (n) (+ base (fact n)))"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := rt.Call("scaled", Int(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != Int(220) {
+		t.Errorf("(scaled 5) = %v, want 220", value)
+	}
+	value, err = rt.Call("fact", Int(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(value) != "265252859812191058636308480000000" {
+		t.Errorf("(fact 30) = %v", value)
+	}
+	if base, ok := rt.Global("base"); !ok || base != Int(100) {
+		t.Errorf("base = %v, %v", base, ok)
+	}
+	if _, ok := rt.Global("fact"); ok {
+		t.Error("fact is not a global variable")
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	rt := NewRuntime()
+	calls := 0
+	err := rt.RegisterBuiltin("host-add", func(args []Value) (Value, error) {
+		calls++
+		sum := Int(0)
+		for _, arg := range args {
+			n, ok := arg.(Int)
+			if !ok {
+				return nil, fmt.Errorf("expected an integer, got %v", arg)
+			}
+			sum += n
+		}
+		return sum, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.LoadString("(def total (a b) (host-add a b 3))"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := rt.Call("total", Int(1), Int(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != Int(6) || calls != 1 {
+		t.Errorf("(total 1 2) = %v after %d calls", value, calls)
+	}
+	_, err = rt.Call("total", Float(1.5), Int(2))
+	if err == nil || !strings.Contains(err.Error(), "host-add: expected an integer") {
+		t.Errorf("error = %v", err)
+	}
+	for _, name := range []string{"+", "if", "total"} {
+		if err := rt.RegisterBuiltin(name, func([]Value) (Value, error) { return nil, nil }); err == nil {
+			t.Errorf("registering %s should fail", name)
+		}
+	}
+}
+
+func TestErrorsAreReturned(t *testing.T) {
+	rt := NewRuntime()
+	var parseError *core.ParseError
+	if err := rt.LoadString("(def f (x) (+ x 1)"); !errors.As(err, &parseError) {
+		t.Errorf("unbalanced parentheses: %v", err)
+	}
+	var diagnostics core.Diagnostics
+	if err := rt.LoadString("(def f (x) (g x))"); !errors.As(err, &diagnostics) {
+		t.Errorf("undefined function: %v", err)
+	}
+	if err := rt.LoadString("(def f (x) (/ x 0))"); err != nil {
+		t.Fatal(err)
+	}
+	var runtimeErr *core.RuntimeError
+	if _, err := rt.Call("f", Int(1)); !errors.As(err, &runtimeErr) || !errors.Is(err, core.ErrDivisionByZero) {
+		t.Errorf("dividing by zero: %v", err)
+	} else if trace := runtimeErr.Trace(); trace != "<string>:1:12: division by zero\n  in (f 1)" {
+		t.Errorf("trace = %q", trace)
+	}
+	if _, err := rt.Call("f"); err == nil {
+		t.Error("calling f without arguments should fail")
+	}
+	if _, err := rt.Call("missing"); err == nil {
+		t.Error("calling an undefined function should fail")
+	}
+}
+
+// exceeded reports whether err is a LimitExceeded for limit
+func exceeded(err error, limit string) bool {
+	var limitErr *LimitExceeded
+	return errors.As(err, &limitErr) && limitErr.Limit == limit
+}
+
+func TestLimits(t *testing.T) {
+	rt := NewBareRuntime()
+	rt.MaxSteps = 1000
+	if err := rt.LoadString("(def spin (n) (while (< n 1) (set! n n)) n) (def down (n) (if (= n 0) 0 (down (- n 1))))"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Call("spin", Int(0)); !exceeded(err, "steps") {
+		t.Errorf("spin: %v", err)
+	}
+	if _, err := rt.Call("down", Int(5000)); !exceeded(err, "steps") || err.Error() != "steps limit of 1000 exceeded" {
+		t.Errorf("down 5000: %v", err)
+	}
+	// Every call gets the whole budget
+	for i := 0; i < 3; i++ {
+		if _, err := rt.Call("down", Int(500)); err != nil {
+			t.Errorf("down 500: %v", err)
+		}
+	}
+	rt.MaxSteps = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rt.CallContext(ctx, "spin", Int(0)); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled spin: %v", err)
+	}
+	if err := rt.LoadStringContext(ctx, "(def main () (spin 0))"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled load: %v", err)
+	}
+	rt.Timeout = 20 * time.Millisecond
+	if _, err := rt.Call("spin", Int(0)); !exceeded(err, "time") || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("spin with a timeout: %v", err)
+	}
+	rt.Timeout = 0
+	if _, err := rt.Call("down", Int(DefaultMaxDepth*2)); !exceeded(err, "call depth") {
+		t.Errorf("down %d: %v", DefaultMaxDepth*2, err)
+	}
+	if _, err := rt.Call("down", Int(DefaultMaxDepth-1)); err != nil {
+		t.Errorf("down %d: %v", DefaultMaxDepth-1, err)
+	}
+}
+
+func TestAllocationLimit(t *testing.T) {
+	rt := NewBareRuntime()
+	rt.MaxAllocations = 1000
+	if err := rt.LoadString("(def grow (n x) (if (= n 0) 0 (grow (- n 1) (* x x))))"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Call("grow", Int(6), Int(3)); err != nil {
+		t.Errorf("grow 6: %v", err)
+	}
+	// Squaring doubles the size of the bignum every call
+	if _, err := rt.Call("grow", Int(20), Int(3)); !exceeded(err, "allocations") {
+		t.Errorf("grow 20: %v", err)
+	}
+}
+
+func TestLimitsBoundMacros(t *testing.T) {
+	rt := NewBareRuntime()
+	rt.MaxSteps = 1000
+	err := rt.LoadString("(defmacro forever () (while (< 0 1) 0) 0) (def main () (forever))")
+	if !exceeded(err, "steps") {
+		t.Errorf("expanding forever: %v", err)
+	}
+}
+
+func TestRedefiningPreludeFunctions(t *testing.T) {
+	rt := NewRuntime()
+	if err := rt.LoadString("(def twice (x) (abs x))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.LoadString("(def abs (x) 42)"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := rt.Call("twice", Int(-3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != Int(42) {
+		t.Errorf("(twice -3) = %v, want 42", value)
+	}
+}
+
+// Runtimes share no state, go test -race checks two can run at once
+func TestRuntimesRunInParallel(t *testing.T) {
+	program := "(defmacro swap-sum (a b) `(let ((tmp ,a)) (+ ,b tmp))) (def total (n) (let ((sum 0) (i 0)) (while (< i n) (set! sum (swap-sum sum i)) (set! i (+ i 1))) sum))"
+	results := make(chan error, 2)
+	for worker := 0; worker < 2; worker++ {
+		go func() {
+			rt := NewRuntime()
+			if err := rt.LoadString(program); err != nil {
+				results <- err
+				return
+			}
+			for round := 0; round < 20; round++ {
+				if err := rt.LoadString(fmt.Sprintf("(def bump-%c (n) (swap-sum n %d))", 'a'+round, round)); err != nil {
+					results <- err
+					return
+				}
+				value, err := rt.Call("total", Int(100))
+				if err != nil {
+					results <- err
+					return
+				}
+				if value != Int(4950) {
+					results <- fmt.Errorf("(total 100) = %v, want 4950", value)
+					return
+				}
+			}
+			results <- nil
+		}()
+	}
+	for worker := 0; worker < 2; worker++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -1,54 +1,192 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"lisp-compiler/core"
 	"lisp-compiler/utils"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 )
 
+const usage = `
+Usage: lisp-compiler <mode> [flags] <input-path>
+mode: interpret,compile,jit,check, default: compile
+flags:
+  --check-overflow  trap on signed integer overflow instead of wrapping around
+  --types           infer types and reject programs that mix them up, check prints the
+                    inferred signatures and compile keeps flonums unboxed
+  --no-prelude      don't read the standard prelude (stdlib/prelude.lisp) ahead of the program
+  --emit=ll         write the LLVM IR of the program to output.ll, and of every module to
+                    output.module.ll, instead of building output
+  --annotate        precede the instructions generated for every expression with a
+                    ; file.lisp:line:col (expression) comment
+  -O0, -O1, -O2     how much to optimise, -O1 (the default) folds constants, prunes ifs
+                    whose condition is constant and drops functions main doesn't use,
+                    -O2 also inlines small functions and runs LLVM's opt -O2 if it is
+                    installed; -O0 leaves the program and llc's output unoptimised
+  -g                emit DWARF debug information so gdb can break on functions and step
+                    through the .lisp source, the code isn't optimised unless -O is given
+  --max-depth=N     how deeply interpret lets calls nest before stopping the program with a
+                    runtime error, default 10000, 0 is unlimited
+  --max-steps=N, --max-allocations=N, --timeout=D
+                    stop interpret after N calls and loop iterations, N allocations or after
+                    the duration D (10s, 500ms), unlimited by default
+  -I <dir>          look for (require name) modules in dir, after the requiring file's directory
+                    and before the directories listed in LISPPATH
+
+compile builds an object file per module and links them into output, objects are
+cached in $LISP_CACHE (default: the user cache directory) and reused while the
+module and its imports are unchanged
+
+jit compiles the program the same way but runs it straight away with LLVM's lli
+and prints the value main returns, like interpret does
+`
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println(`
-Usage: lisp-compiler <mode> <input-path>
-mode: interpret,compile, default: compile
-		`)
-		return
+	args := os.Args[1:]
+	mode := "compile"
+	if len(args) > 0 && (args[0] == "interpret" || args[0] == "compile" || args[0] == "jit" || args[0] == "check") {
+		mode = args[0]
+		args = args[1:]
 	}
-	var input string
-	var err error
-	var mode string
-	if len(os.Args) == 3 {
-		mode = os.Args[1]
-		input, err = utils.LoadLispFileToString(strings.TrimSpace(os.Args[2]))
+	flags := flag.NewFlagSet(mode, flag.ExitOnError)
+	flags.Usage = func() { fmt.Print(usage) }
+	checkOverflow := flags.Bool("check-overflow", false, "trap on signed integer overflow")
+	types := flags.Bool("types", false, "infer and check types")
+	noPrelude := flags.Bool("no-prelude", false, "don't read the standard prelude")
+	debugInfo := flags.Bool("g", false, "emit debug information")
+	emit := flags.String("emit", "exe", "what compile writes, exe or ll")
+	annotate := flags.Bool("annotate", false, "annotate the IR with the source of every expression")
+	maxDepth := flags.Int("max-depth", core.DefaultMaxDepth, "how deeply interpreted calls can nest")
+	maxSteps := flags.Int("max-steps", 0, "how many calls and loop iterations interpret can take")
+	maxAllocations := flags.Int("max-allocations", 0, "how much interpret can allocate")
+	timeout := flags.Duration("timeout", 0, "how long interpret can run")
+	optimization := -1
+	for level := 0; level <= 2; level++ {
+		flags.BoolFunc(fmt.Sprintf("O%d", level), "optimisation level", func(string) error {
+			optimization = level
+			return nil
+		})
 	}
-	if len(os.Args) == 2 {
-		mode = "compile"
-		input, err = utils.LoadLispFileToString(strings.TrimSpace(os.Args[1]))
+	searchPath := make([]string, 0)
+	flags.Func("I", "add a directory to the module search path", func(dir string) error {
+		searchPath = append(searchPath, dir)
+		return nil
+	})
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*emit != "exe" && *emit != "ll") {
+		flags.Usage()
+		return
+	}
+	core.CheckOverflow = *checkOverflow
+	core.DebugInfo = *debugInfo
+	core.Annotate = *annotate
+	core.OptimizationLevel = optimization
+	if optimization < 0 {
+		core.OptimizationLevel = 1
+		if *debugInfo {
+			core.OptimizationLevel = 0
+		}
 	}
+	input, err := utils.LoadLispFileToString(strings.TrimSpace(flags.Arg(0)))
 	if err != nil {
 		panic(err)
 	}
-	parser := core.NewParser(input)
-	asm := ""
-	symbol := "%sym1"
-	parsed := parser.Parse()
+	path := strings.TrimSpace(flags.Arg(0))
+	if lispPath := os.Getenv("LISPPATH"); lispPath != "" {
+		searchPath = append(searchPath, filepath.SplitList(lispPath)...)
+	}
+	loader := core.NewLoader(searchPath)
+	loader.Prelude = !*noPrelude
+	parsed, err := loader.Load(path, input)
+	if parseErr, ok := err.(*core.ParseError); ok {
+		reportDiagnostics(path, input, []core.Diagnostic{{Span: core.Span{Start: parseErr.Offset, Source: parseErr.Source}, Message: parseErr.Message}})
+	} else if err != nil {
+		panic(err)
+	}
+	if mode == "compile" || mode == "jit" {
+		reportDiagnostics(path, input, core.CheckCompiled(parsed))
+	} else {
+		reportDiagnostics(path, input, core.Check(parsed))
+	}
+	if *types || core.HasTypeAnnotations(parsed) {
+		typeInfo, diagnostics := core.InferTypes(parsed)
+		reportDiagnostics(path, input, diagnostics)
+		if mode == "check" && *types {
+			for _, signature := range typeInfo.Signatures {
+				fmt.Println(signature)
+			}
+		}
+		core.InferredTypes = typeInfo
+	}
+	if mode == "check" {
+		return
+	}
+
+	if mode == "compile" || mode == "jit" {
+		parsed = core.Optimize(parsed, loader.Units(), core.OptimizationLevel)
+	}
 
 	if mode == "interpret" {
+		defer reportRuntimeError()
 		scope := core.NewInterpreterScope(nil)
-		var value int
-		for _, parsedExpr := range parsed {
-			value = parsedExpr.Eval(scope)
-		}
-		fmt.Println(value)
+		fmt.Println(scope.RunLimited(parsed, core.Limits{
+			MaxDepth:       *maxDepth,
+			MaxSteps:       *maxSteps,
+			MaxAllocations: *maxAllocations,
+			Timeout:        *timeout,
+		}))
 		return
-	} else {
-		scope := core.NewCompilerScope(nil)
-		for _, parsedExpr := range parsed {
-			parsedExpr.Codegen(&asm, symbol, scope)
-			asm += "\n"
+	} else if mode == "jit" {
+		status, err := utils.RunJIT(parsed, loader.Units())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	} else if *emit == "ll" {
+		if err := utils.EmitUnits(parsed, loader.Units(), "output"); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	} else if err := utils.BuildUnits(parsed, loader.Units(), "output"); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// reportDiagnostics prints every diagnostic as path:line:col and exits if
+// there were any
+func reportDiagnostics(path string, input string, diagnostics []core.Diagnostic) {
+	for _, diagnostic := range diagnostics {
+		source := diagnostic.Span.Source
+		if source == nil {
+			source = &core.SourceFile{Path: path, Input: input}
+		}
+		line, column := core.Position(source.Input, diagnostic.Span.Start)
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", source.Path, line, column, diagnostic.Message)
+	}
+	if len(diagnostics) > 0 {
+		os.Exit(1)
+	}
+}
+
+// reportRuntimeError prints errors raised by the interpreter (division by zero,
+// overflow) without a go stack trace, anything else is still a bug and re-panics.
+func reportRuntimeError() {
+	if r := recover(); r != nil {
+		err, ok := r.(error)
+		if _, isGoError := r.(runtime.Error); !ok || isGoError {
+			panic(r)
+		}
+		if runtimeErr, ok := err.(*core.RuntimeError); ok {
+			fmt.Fprintln(os.Stderr, "runtime error:", runtimeErr.Trace())
+		} else {
+			fmt.Fprintln(os.Stderr, "runtime error:", err)
 		}
-		utils.WriteLLVMAssembly(asm)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,42 @@
+; The prelude is read before every program, a program can define any of these
+; names itself and its definition is used instead.
+
+; Control flow
+(defmacro when (test . body) `(if ,test (let () ,@body)))
+(defmacro unless (test . body) `(if ,test 0 (let () ,@body)))
+(defmacro cond (. clauses)
+  (if (null? clauses)
+      0
+      (let ((clause (car clauses)))
+        (if (eq? (car clause) 'else)
+            `(let () ,@(cdr clause))
+            `(if ,(car clause) (let () ,@(cdr clause)) (cond ,@(cdr clauses)))))))
+(defmacro dotimes (spec . body)
+  `(let ((limit ,(car (cdr spec))))
+     (do ((,(car spec) 0 (+ ,(car spec) 1))) ((= ,(car spec) limit) 0) ,@body)))
+(defmacro inc! (name) `(set! ,name (+ ,name 1)))
+(defmacro dec! (name) `(set! ,name (- ,name 1)))
+(defmacro swap! (a b) `(let ((tmp ,a)) (set! ,a ,b) (set! ,b tmp)))
+
+; Arithmetic
+(def abs(x) (if (< x 0) (- x) x))
+(def max(a b) (if (< a b) b a))
+(def min(a b) (if (< b a) b a))
+(def square(x) (* x x))
+(def gcd(a b) (if (= b 0) (abs a) (gcd b (remainder a b))))
+(def lcm(a b) (if (= a 0) 0 (abs (* (/ a (gcd a b)) b))))
+(def expt(base n) (do ((i 0 (+ i 1)) (result 1 (* result base))) ((= i n) result)))
+(def even?(n) (if (= (modulo n 2) 0) 1 0))
+(def odd?(n) (if (= (modulo n 2) 1) 1 0))
+
+; Lists only exist while macros expand, these work on the arguments they are
+; given: (sum a b c), (maximum a b c)
+(defmacro sum (. xs) (if (null? xs) 0 `(+ ,@xs)))
+(defmacro product (. xs) (if (null? xs) 1 `(* ,@xs)))
+(defmacro maximum (x . xs) (if (null? xs) x `(max ,x (maximum ,@xs))))
+(defmacro minimum (x . xs) (if (null? xs) x `(min ,x (minimum ,@xs))))
+
+; I/O
+(def write_char(c) (sys_write 1 &c 1))
+(def newline() (write_char 10))
+(def space() (write_char 32))
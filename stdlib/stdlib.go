@@ -0,0 +1,12 @@
+// Package stdlib holds the library code written in lisp that ships with the
+// compiler
+package stdlib
+
+import (
+	_ "embed"
+)
+
+// Prelude is read ahead of every program unless it is compiled with --no-prelude
+//
+//go:embed prelude.lisp
+var Prelude string
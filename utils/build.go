@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"lisp-compiler/core"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CacheDir is where compiled units are kept between builds, LISP_CACHE
+// overrides the user cache directory
+func CacheDir() (string, error) {
+	if dir := os.Getenv("LISP_CACHE"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lisp-compiler"), nil
+}
+
+// BuildUnits compiles every unit of program to its own object file and links
+// them with the runtime into output. Objects are cached under the hash of the
+// unit's source and the IR generated for it, so only units that changed, or
+// whose imports changed, are compiled again.
+func BuildUnits(program []core.ASTNode, units []*core.Unit, output string) error {
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	objects := make([]string, 0, len(units)+1)
+	for _, unit := range units {
+		asm := core.CodegenUnit(program, units, unit)
+		object, err := cachedObject(cacheDir, objectKey(unit, asm), func(object string) error {
+			return compileUnit(asm, object)
+		})
+		if err != nil {
+			generate := func() string { return core.CodegenUnit(program, units, unit) }
+			return fmt.Errorf("compiling %s: %w", unit.Source.Path, locateLLVMError(generate, err))
+		}
+		objects = append(objects, object)
+	}
+	runtimeObject, err := cachedObject(cacheDir, core.RuntimeCSource, func(object string) error {
+		return compileRuntime(object)
+	})
+	if err != nil {
+		return fmt.Errorf("compiling the runtime: %w", err)
+	}
+	linkCommand := append([]string{"gcc", "-o", output}, objects...)
+	return runCommand(append(linkCommand, runtimeObject, "-lm"))
+}
+
+// objectKey is what the object compileUnit builds for a unit depends on:
+// the unit, its IR and how hard llc and opt optimise it
+func objectKey(unit *core.Unit, asm string) string {
+	return fmt.Sprintf("%s\x00-O%d\x00%s", unit.Hash, core.OptimizationLevel, asm)
+}
+
+// cachedObject returns the object cached under key, building it first if it
+// isn't there. Objects are built next to the cache entry and renamed into
+// place, so an interrupted build never leaves a broken one behind.
+func cachedObject(cacheDir string, key string, build func(object string) error) (string, error) {
+	sum := sha256.Sum256([]byte(key))
+	object := filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".o")
+	if _, err := os.Stat(object); err == nil {
+		return object, nil
+	}
+	temporary, err := os.CreateTemp(cacheDir, "unit-*.o")
+	if err != nil {
+		return "", err
+	}
+	temporary.Close()
+	defer os.Remove(temporary.Name())
+	if err := build(temporary.Name()); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(temporary.Name(), 0644); err != nil {
+		return "", err
+	}
+	return object, os.Rename(temporary.Name(), object)
+}
+
+// EmitUnits writes the LLVM IR of every unit instead of building them, the
+// program's to output.ll and each module's to output.module.ll
+func EmitUnits(program []core.ASTNode, units []*core.Unit, output string) error {
+	for _, unit := range units {
+		path := output + ".ll"
+		if !unit.Main {
+			path = output + "." + strings.ReplaceAll(unit.Name, "/", ".") + ".ll"
+		}
+		if err := os.WriteFile(path, []byte(core.CodegenUnit(program, units, unit)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// llvmError is llc or opt rejecting a unit's IR, Line is the line it
+// complained about
+type llvmError struct {
+	Line   int
+	Output string
+}
+
+func (e *llvmError) Error() string {
+	return strings.TrimPrefix(strings.TrimSpace(e.Output), "llc: error: ")
+}
+
+var llvmErrorLine = regexp.MustCompile(`\.ll:(\d+):\d+: error`)
+
+// locateLLVMError names the expression the IR llc or opt rejected was
+// generated for. The IR is generated again with annotations, and compiled
+// again to find the line complained about in that IR.
+func locateLLVMError(generate func() string, err error) error {
+	if _, ok := err.(*llvmError); !ok {
+		return err
+	}
+	annotate := core.Annotate
+	core.Annotate = true
+	asm := generate()
+	core.Annotate = annotate
+	annotated, ok := compileUnit(asm, os.DevNull).(*llvmError)
+	if !ok {
+		return err
+	}
+	if source, ok := core.SourceOfLine(asm, annotated.Line); ok {
+		return fmt.Errorf("in the code generated for %s: %w", source, annotated)
+	}
+	return err
+}
+
+func compileUnit(asm string, object string) error {
+	dir, err := os.MkdirTemp("", "lisp-unit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "unit.ll")
+	if err := os.WriteFile(path, []byte(asm), 0644); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("opt"); err == nil && core.OptimizationLevel >= 2 {
+		optimized := filepath.Join(dir, "unit.bc")
+		if err := runLLVM([]string{"opt", "-O2", "-o", optimized, path}); err != nil {
+			return err
+		}
+		path = optimized
+	}
+	command := []string{"llc", "-relocation-model=pic", "-filetype=obj", "-o", object, path}
+	if core.OptimizationLevel == 0 {
+		command = append(command, "-O0")
+	}
+	return runLLVM(command)
+}
+
+// runLLVM runs an LLVM tool on a unit's IR, a failure is returned as an
+// llvmError
+func runLLVM(command []string) error {
+	output, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+	if _, ok := err.(*exec.ExitError); ok {
+		failure := &llvmError{Output: string(output)}
+		if match := llvmErrorLine.FindStringSubmatch(failure.Output); match != nil {
+			failure.Line, _ = strconv.Atoi(match[1])
+		}
+		return failure
+	}
+	return err
+}
+
+func compileRuntime(object string) error {
+	dir, err := os.MkdirTemp("", "lisp-runtime")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lisp_runtime.c")
+	if err := os.WriteFile(path, []byte(core.RuntimeCSource), 0644); err != nil {
+		return err
+	}
+	return runCommand([]string{"gcc", "-c", "-fPIC", "-o", object, path})
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"lisp-compiler/core"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadProgram loads input as path without the prelude
+func loadProgram(t *testing.T, path string, input string) ([]core.ASTNode, []*core.Unit) {
+	t.Helper()
+	loader := core.NewLoader(nil)
+	loader.Prelude = false
+	program, err := loader.Load(path, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program, loader.Units()
+}
+
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found in PATH", tool)
+		}
+	}
+}
+
+func TestBuildCachesEachOptimizationLevel(t *testing.T) {
+	requireTools(t, "llc", "gcc")
+	cache := t.TempDir()
+	t.Setenv("LISP_CACHE", cache)
+	level := core.OptimizationLevel
+	defer func() { core.OptimizationLevel = level }()
+	program, units := loadProgram(t, "main.lisp", "(def main() (print 1) 0)")
+	output := filepath.Join(t.TempDir(), "output")
+	for _, level := range []int{0, 2, 0} {
+		core.OptimizationLevel = level
+		if err := BuildUnits(program, units, output); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := filepath.Glob(filepath.Join(cache, "*.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The runtime's object and the unit's at -O0 and -O2
+	if len(objects) != 3 {
+		t.Errorf("Expected 3 cached objects, got %v", objects)
+	}
+}
+
+func TestLLVMErrorsNameTheExpression(t *testing.T) {
+	requireTools(t, "llc")
+	level := core.OptimizationLevel
+	defer func() { core.OptimizationLevel = level }()
+	core.OptimizationLevel = 0
+	program, units := loadProgram(t, "main.lisp", "(def twice(n) (* n 2))\n(def main()\n  (print (twice 21))\n  0)")
+	// Calling a function that isn't declared stands in for a codegen bug
+	generate := func() string {
+		return strings.Replace(core.CodegenUnit(program, units, units[0]), "call i64 @lisp_print(", "call i64 @lisp_missing(", 1)
+	}
+	err := compileUnit(generate(), os.DevNull)
+	if err == nil {
+		t.Fatal("Expected llc to reject the IR")
+	}
+	err = locateLLVMError(generate, err)
+	expected := "in the code generated for main.lisp:3:3 (print (twice 21)): "
+	if !strings.HasPrefix(err.Error(), expected) || !strings.Contains(err.Error(), "@lisp_missing") {
+		t.Errorf("Expected the error to start with %q, got %q", expected, err)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lisp-compiler/core"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// jitEngine runs the IR of every unit, the main unit's last, linked against
+// the compiled runtime and returns lisp_jit_main's result. lli runs it unless
+// the binary is built with the llvmorc tag, which runs it in process.
+var jitEngine = runLLI
+
+// RunJIT runs program without building an executable: every unit's IR is
+// handed to the JIT along with the runtime, which is compiled once and
+// cached like BuildUnits' objects. The value main returns is printed and the
+// result is the status the program exits with.
+func RunJIT(program []core.ASTNode, units []*core.Unit) (int, error) {
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return 0, err
+	}
+	runtimeObject, err := cachedObject(cacheDir, core.RuntimeCSource, func(object string) error {
+		return compileRuntime(object)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("compiling the runtime: %w", err)
+	}
+	modules := make([]string, 0, len(units))
+	var main string
+	for _, unit := range units {
+		asm := core.CodegenUnit(program, units, unit)
+		if unit.Main {
+			main = asm + core.JITEntry
+			continue
+		}
+		modules = append(modules, asm)
+	}
+	return jitEngine(append(modules, main), runtimeObject)
+}
+
+// runLLI runs the modules with lli, the program shares our standard streams
+func runLLI(modules []string, runtimeObject string) (int, error) {
+	dir, err := os.MkdirTemp("", "lisp-jit")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	command := []string{"lli", "-entry-function=lisp_jit_main", "-extra-object=" + runtimeObject}
+	if core.OptimizationLevel == 0 {
+		command = append(command, "-O0")
+	}
+	for indx, asm := range modules {
+		path := filepath.Join(dir, fmt.Sprintf("unit%d.ll", indx))
+		if err := os.WriteFile(path, []byte(asm), 0644); err != nil {
+			return 0, err
+		}
+		if indx < len(modules)-1 {
+			command = append(command, "-extra-module="+path)
+		} else {
+			command = append(command, path)
+		}
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	relayStderr(stderr)
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// A program killed by a trap has no exit code
+		if exitErr.ExitCode() < 0 {
+			return 1, nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// relayStderr copies what the program writes to stderr until lli reports the
+// trap a runtime error ends with as a crash of its own, the runtime has
+// already said what went wrong
+func relayStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "PLEASE submit a bug report") {
+			io.Copy(io.Discard, stderr)
+			return
+		}
+		fmt.Fprintln(os.Stderr, scanner.Text())
+	}
+}
@@ -0,0 +1,163 @@
+//go:build llvmorc
+
+package utils
+
+/*
+#cgo LDFLAGS: -lm
+#include <math.h>
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <llvm-c/Core.h>
+#include <llvm-c/Error.h>
+#include <llvm-c/IRReader.h>
+#include <llvm-c/LLJIT.h>
+#include <llvm-c/Orc.h>
+#include <llvm-c/Target.h>
+#include <llvm-c/TargetMachine.h>
+
+// The program's libm calls are resolved in our process, which has to link it
+double (*jit_keep_libm)(double) = sqrt;
+
+static char *jit_error(LLVMErrorRef err) {
+	char *message = LLVMGetErrorMessage(err);
+	char *copy = strdup(message);
+	LLVMDisposeErrorMessage(message);
+	return copy;
+}
+
+// A runtime error ends the program with a trap, the runtime has already
+// reported it
+static void jit_trapped(int sig) {
+	_exit(1);
+}
+
+// jit_builder makes LLJITs that generate code for the host like lli -O0
+// does when optimize is 0, and like plain lli otherwise
+static char *jit_builder(int optimize, LLVMOrcLLJITBuilderRef *builder) {
+	char *triple = LLVMGetDefaultTargetTriple();
+	LLVMTargetRef target;
+	char *message;
+	if (LLVMGetTargetFromTriple(triple, &target, &message)) {
+		char *failure = strdup(message);
+		LLVMDisposeMessage(message);
+		LLVMDisposeMessage(triple);
+		return failure;
+	}
+	char *cpu = LLVMGetHostCPUName();
+	char *features = LLVMGetHostCPUFeatures();
+	LLVMCodeGenOptLevel level = optimize == 0 ? LLVMCodeGenLevelNone : LLVMCodeGenLevelDefault;
+	LLVMTargetMachineRef machine = LLVMCreateTargetMachine(target, triple, cpu, features, level, LLVMRelocDefault, LLVMCodeModelJITDefault);
+	LLVMDisposeMessage(triple);
+	LLVMDisposeMessage(cpu);
+	LLVMDisposeMessage(features);
+	*builder = LLVMOrcCreateLLJITBuilder();
+	LLVMOrcLLJITBuilderSetJITTargetMachineBuilder(*builder, LLVMOrcJITTargetMachineBuilderCreateFromTargetMachine(machine));
+	return NULL;
+}
+
+// run_jit links the modules and the runtime object in an LLJIT and calls
+// lisp_jit_main, an error is returned as a message the caller frees
+static char *run_jit(char **modules, int count, const char *runtime_object, int optimize, int *result) {
+	LLVMInitializeNativeTarget();
+	LLVMInitializeNativeAsmPrinter();
+	LLVMOrcLLJITBuilderRef builder;
+	char *failure = jit_builder(optimize, &builder);
+	if (failure) {
+		return failure;
+	}
+	LLVMOrcLLJITRef jit;
+	LLVMErrorRef err = LLVMOrcCreateLLJIT(&jit, builder);
+	if (err) {
+		return jit_error(err);
+	}
+	LLVMOrcJITDylibRef dylib = LLVMOrcLLJITGetMainJITDylib(jit);
+	LLVMOrcDefinitionGeneratorRef process;
+	err = LLVMOrcCreateDynamicLibrarySearchGeneratorForProcess(&process, LLVMOrcLLJITGetGlobalPrefix(jit), NULL, NULL);
+	if (err) {
+		failure = jit_error(err);
+		goto done;
+	}
+	LLVMOrcJITDylibAddGenerator(dylib, process);
+	LLVMMemoryBufferRef object;
+	char *message;
+	if (LLVMCreateMemoryBufferWithContentsOfFile(runtime_object, &object, &message)) {
+		failure = strdup(message);
+		LLVMDisposeMessage(message);
+		goto done;
+	}
+	if ((err = LLVMOrcLLJITAddObjectFile(jit, dylib, object))) {
+		failure = jit_error(err);
+		goto done;
+	}
+	for (int indx = 0; indx < count; indx++) {
+		LLVMOrcThreadSafeContextRef context = LLVMOrcCreateNewThreadSafeContext();
+		LLVMMemoryBufferRef buffer = LLVMCreateMemoryBufferWithMemoryRangeCopy(modules[indx], strlen(modules[indx]), "unit");
+		LLVMModuleRef module;
+		if (LLVMParseIRInContext(LLVMOrcThreadSafeContextGetContext(context), buffer, &module, &message)) {
+			failure = strdup(message);
+			LLVMDisposeMessage(message);
+			LLVMOrcDisposeThreadSafeContext(context);
+			goto done;
+		}
+		err = LLVMOrcLLJITAddLLVMIRModule(jit, dylib, LLVMOrcCreateNewThreadSafeModule(module, context));
+		LLVMOrcDisposeThreadSafeContext(context);
+		if (err) {
+			failure = jit_error(err);
+			goto done;
+		}
+	}
+	LLVMOrcExecutorAddress entry;
+	if ((err = LLVMOrcLLJITLookup(jit, &entry, "lisp_jit_main"))) {
+		failure = jit_error(err);
+		goto done;
+	}
+	// The handlers are only ours while the program runs, the Go runtime's are
+	// put back after it
+	struct sigaction trapped = {.sa_handler = jit_trapped}, ill, trap;
+	sigemptyset(&trapped.sa_mask);
+	sigaction(SIGILL, &trapped, &ill);
+	sigaction(SIGTRAP, &trapped, &trap);
+	*result = ((int (*)(void))entry)();
+	fflush(stdout);
+	sigaction(SIGILL, &ill, NULL);
+	sigaction(SIGTRAP, &trap, NULL);
+done:
+	LLVMOrcDisposeLLJIT(jit);
+	return failure;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"lisp-compiler/core"
+	"unsafe"
+)
+
+func init() {
+	jitEngine = runORC
+}
+
+// runORC runs the modules in our own process with LLVM's ORC JIT, building
+// with the llvmorc tag needs the LLVM C headers and library:
+//
+//	CGO_CFLAGS="$(llvm-config --cflags)" CGO_LDFLAGS="$(llvm-config --ldflags --libs)" go build -tags llvmorc
+func runORC(modules []string, runtimeObject string) (int, error) {
+	sources := make([]*C.char, len(modules))
+	for indx, asm := range modules {
+		sources[indx] = C.CString(asm)
+		defer C.free(unsafe.Pointer(sources[indx]))
+	}
+	object := C.CString(runtimeObject)
+	defer C.free(unsafe.Pointer(object))
+	var result C.int
+	optimize := C.int(core.OptimizationLevel)
+	if failure := C.run_jit(&sources[0], C.int(len(sources)), object, optimize, &result); failure != nil {
+		defer C.free(unsafe.Pointer(failure))
+		return 0, errors.New(C.GoString(failure))
+	}
+	return int(result), nil
+}
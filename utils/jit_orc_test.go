@@ -0,0 +1,54 @@
+//go:build llvmorc && linux
+
+package utils
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// captureFd returns what fn wrote to file descriptor 1, the JIT's C stdout
+// doesn't go through os.Stdout
+func captureFd(t *testing.T, fn func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := syscall.Dup(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Dup3(int(writer.Fd()), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	fn()
+	syscall.Dup3(stdout, 1, 0)
+	syscall.Close(stdout)
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func TestRunJITWithORC(t *testing.T) {
+	requireTools(t, "gcc")
+	runJITCases(t, runORC, jitCases, captureFd)
+	// The program's trap handler would end the test instead of the signal
+	// reaching the channel
+	traps := make(chan os.Signal, 1)
+	signal.Notify(traps, syscall.SIGTRAP)
+	defer signal.Stop(traps)
+	syscall.Kill(os.Getpid(), syscall.SIGTRAP)
+	select {
+	case <-traps:
+	case <-time.After(5 * time.Second):
+		t.Error("SIGTRAP wasn't delivered to the Go runtime after the program ran")
+	}
+}
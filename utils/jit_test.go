@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"io"
+	"lisp-compiler/core"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type jitCase struct {
+	input  string
+	stdout string
+	status int
+}
+
+var jitCases = []jitCase{
+	{input: "(def main() (print 1) 42)", stdout: "1\n42\n"},
+	{input: "(require double) (def main() (double 2.5))", stdout: "5.0\n"},
+	{input: "(def fact(n) (if (< n 2) 1 (* n (fact (- n 1))))) (def main() (fact 25))", stdout: "15511210043330985984000000\n"},
+}
+
+// runJITCases runs every case with engine at -O0 and -O1, capture returns
+// what its function wrote to stdout
+func runJITCases(t *testing.T, engine func([]string, string) (int, error), cases []jitCase, capture func(t *testing.T, fn func()) string) {
+	t.Helper()
+	t.Setenv("LISP_CACHE", t.TempDir())
+	defaultEngine, level := jitEngine, core.OptimizationLevel
+	defer func() { jitEngine, core.OptimizationLevel = defaultEngine, level }()
+	jitEngine = engine
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "double.lisp"), []byte("(def double(x) (* x 2))"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{0, 1} {
+		core.OptimizationLevel = level
+		for _, testCase := range cases {
+			program, units := loadProgram(t, filepath.Join(dir, "main.lisp"), testCase.input)
+			var status int
+			var err error
+			stdout := capture(t, func() { status, err = RunJIT(program, units) })
+			if err != nil {
+				t.Fatalf("-O%d %s: %v", level, testCase.input, err)
+			}
+			if stdout != testCase.stdout || status != testCase.status {
+				t.Errorf("-O%d %s: expected %q and status %d, got %q and status %d", level, testCase.input, testCase.stdout, testCase.status, stdout, status)
+			}
+		}
+	}
+}
+
+// captureStdout returns what fn printed to os.Stdout, which lli shares
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	fn()
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func TestRunJITWithLLI(t *testing.T) {
+	requireTools(t, "lli", "gcc")
+	// A runtime error ends the program with a trap
+	cases := append(jitCases, jitCase{input: "(def main() (/ 1 0))", status: 1})
+	runJITCases(t, runLLI, cases, captureStdout)
+}
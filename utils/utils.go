@@ -6,6 +6,7 @@ import (
 	"lisp-compiler/core"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -19,12 +20,20 @@ func WriteLLVMAssembly(asm string) {
 	if _, err := writer.WriteString(asm); err != nil {
 		panic(err)
 	}
-	err := writer.Flush()
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+	runtimeDir, err := os.MkdirTemp("", "lisp-runtime")
 	if err != nil {
 		panic(err)
 	}
-	llvmCommand := []string{"llc", "-o", "output.s", "output.ll"}
-	compileCommand := []string{"gcc", "-o", "output", "output.s"}
+	defer os.RemoveAll(runtimeDir)
+	runtimePath := filepath.Join(runtimeDir, "lisp_runtime.c")
+	if err := os.WriteFile(runtimePath, []byte(core.RuntimeCSource), 0644); err != nil {
+		panic(err)
+	}
+	llvmCommand := []string{"llc", "-relocation-model=pic", "-o", "output.s", "output.ll"}
+	compileCommand := []string{"gcc", "-o", "output", "output.s", runtimePath, "-lm"}
 
 	if err := runCommand(llvmCommand); err != nil {
 		fmt.Println("Error running 'as' command:", err)